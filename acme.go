@@ -0,0 +1,122 @@
+package bandaid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// ChallengeFQDN returns the record name used for a DNS-01 challenge of the domain, wildcards included.
+func ChallengeFQDN(domain string) string {
+	domain = strings.TrimPrefix(strings.TrimSuffix(domain, "."), "*.")
+	return fmt.Sprintf("_acme-challenge.%v.", domain)
+}
+
+// ChallengeValue returns the TXT record value for a DNS-01 challenge from the key authorization.
+func ChallengeValue(keyAuth string) string {
+	sum := sha256.Sum256([]byte(keyAuth))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (c *CloudflareConfig) challenge(fqdn, value string) *CloudflareConfig {
+	challenge := *c
+	challenge.DNS = DNSConfig{
+		Type:    "TXT",
+		Name:    strings.TrimSuffix(fqdn, "."),
+		Content: value,
+		TTL:     120,
+	}
+	return &challenge
+}
+
+// PresentChallenge creates the TXT record for a DNS-01 challenge.
+func (c *CloudflareConfig) PresentChallenge(fqdn, value string) (DNSRecord, error) {
+	log.Println("[acme] Presenting challenge for", fqdn)
+	return c.challenge(fqdn, value).SendConfiguration()
+}
+
+// CleanupChallenge removes the TXT record created by PresentChallenge, it's not an error if it's already gone.
+func (c *CloudflareConfig) CleanupChallenge(fqdn, value string) error {
+	log.Println("[acme] Cleaning up challenge for", fqdn)
+	challenge := c.challenge(fqdn, value)
+	zone, err := challenge.ResolveZone()
+	if err != nil {
+		return err
+	}
+	record, err := challenge.findRecord(zone.ID)
+	if err != nil || record == nil {
+		return err
+	}
+	return challenge.RemoveConfiguration(*record)
+}
+
+// WaitForChallenge blocks until every authoritative nameserver of the zone serves the challenge value.
+func (c *CloudflareConfig) WaitForChallenge(fqdn, value string, timeout time.Duration) error {
+	challenge := c.challenge(fqdn, value)
+	zone, err := challenge.ResolveZone()
+	if err != nil {
+		return err
+	}
+
+	nameservers := zone.NameServers
+	if len(nameservers) == 0 {
+		records, err := net.LookupNS(zone.Name)
+		if err != nil {
+			return fmt.Errorf("failed to find nameservers for %v: %v", zone.Name, err)
+		}
+		for _, record := range records {
+			nameservers = append(nameservers, record.Host)
+		}
+	}
+	return WaitForPropagation(fqdn, value, nameservers, timeout)
+}
+
+// WaitForPropagation polls the given nameservers directly until all of them return the TXT value for fqdn.
+func WaitForPropagation(fqdn, value string, nameservers []string, timeout time.Duration) error {
+	log.Printf("[acme] Waiting for %v to propagate to %v\n", fqdn, nameservers)
+	deadline := time.Now().Add(timeout)
+	pending := nameservers
+	for {
+		remaining := []string{}
+		for _, nameserver := range pending {
+			if !nameserverHasTXT(nameserver, fqdn, value) {
+				remaining = append(remaining, nameserver)
+			}
+		}
+		if len(remaining) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%v did not propagate to %v within %v", fqdn, strings.Join(remaining, ", "), timeout)
+		}
+		pending = remaining
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func nameserverHasTXT(nameserver, fqdn, value string) bool {
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return (&net.Dialer{Timeout: 5 * time.Second}).DialContext(ctx, network, net.JoinHostPort(nameserver, "53"))
+		},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	records, err := resolver.LookupTXT(ctx, fqdn)
+	if err != nil {
+		return false
+	}
+	for _, record := range records {
+		if record == value {
+			return true
+		}
+	}
+	return false
+}
@@ -9,6 +9,15 @@ import (
 	"strings"
 )
 
+// ObserveCall is told about every request sent to the Caddy and Cloudflare APIs and whether it failed, which
+// is how the manager counts them.
+var ObserveCall = func(service string, failed bool) {}
+
+// observeCaddy counts a Caddy API request, expected answers other than 2xx aren't failures.
+func observeCaddy(resp *grequests.Response, err error, expected bool) {
+	ObserveCall("caddy", err != nil || (!resp.Ok && !expected))
+}
+
 type CaddyConfig struct {
 	ID       string         `json:"@id,omitempty"`
 	Match    []DomainConfig `json:"match,omitempty"`
@@ -94,12 +103,14 @@ func (b *AutoCaddyConfig) AttemptInitializeCaddy() *AutoCaddyConfig {
 		},
 	}
 
-	resp, _ := grequests.Get(fmt.Sprintf("%v/config", b.CaddyAPI), nil)
+	resp, err := grequests.Get(fmt.Sprintf("%v/config", b.CaddyAPI), nil)
+	observeCaddy(resp, err, false)
 	if strings.TrimSpace(resp.String()) == "null" {
 		log.Println("[bandaid] Initializing configuration")
-		resp, _ := grequests.Post(fmt.Sprintf("%v/load", b.CaddyAPI), &grequests.RequestOptions{
+		resp, err := grequests.Post(fmt.Sprintf("%v/load", b.CaddyAPI), &grequests.RequestOptions{
 			JSON: def,
 		})
+		observeCaddy(resp, err, false)
 		if !resp.Ok {
 			log.Panicln("failed to initialize configuration:", resp.String())
 		}
@@ -131,33 +142,23 @@ func (b *AutoCaddyConfig) Apply() (string, error) {
 		}
 		host = fmt.Sprintf("localhost:%v", port)
 	}
-	b.Config.Handle = []ConfigHandle{
-		{
-			Handler: "subroute",
-			Routes: []Route{
-				{Handle: []RouteHandle{
-					{
-						Handler: "reverse_proxy",
-						Upstreams: []Upstream{
-							{Dial: host},
-						},
-					},
-				}},
-			},
-		},
-	}
+	b.Config.Handle = proxyHandle(host)
 
 	resp, err := grequests.Delete(fmt.Sprintf("%v/id/%v", b.CaddyAPI, b.Config.ID), nil)
 	if err != nil {
+		observeCaddy(resp, err, false)
 		return "", err
 	}
-	if !resp.Ok && !strings.Contains(resp.String(), "unknown object ID") {
+	unknown := strings.Contains(resp.String(), "unknown object ID")
+	observeCaddy(resp, err, unknown)
+	if !resp.Ok && !unknown {
 		return "", errors.New(resp.String())
 	}
 
 	resp, err = grequests.Post(fmt.Sprintf("%v/%v", b.CaddyAPI, b.RoutePath), &grequests.RequestOptions{
 		JSON: b.Config,
 	})
+	observeCaddy(resp, err, false)
 	if err != nil {
 		return "", err
 	}
@@ -166,3 +167,47 @@ func (b *AutoCaddyConfig) Apply() (string, error) {
 	}
 	return host, nil
 }
+
+// Switch points the existing route at a new upstream. Only the route's handler is replaced, in a single
+// request, so requests are served by either the old or the new upstream and never hit a missing route.
+// If the route doesn't exist yet it's created with Apply.
+func (b *AutoCaddyConfig) Switch(host string) error {
+	log.Printf("[bandaid] Switching upstream of %v to '%v'\n", b.Config.ID, host)
+	b.host = host
+	b.Config.Handle = proxyHandle(host)
+
+	resp, err := grequests.Patch(fmt.Sprintf("%v/id/%v/handle", b.CaddyAPI, b.Config.ID), &grequests.RequestOptions{
+		JSON: b.Config.Handle,
+	})
+	if err != nil {
+		observeCaddy(resp, err, false)
+		return err
+	}
+	observeCaddy(resp, err, strings.Contains(resp.String(), "unknown object ID"))
+	if !resp.Ok {
+		if strings.Contains(resp.String(), "unknown object ID") {
+			_, err := b.Apply()
+			return err
+		}
+		return errors.New(resp.String())
+	}
+	return nil
+}
+
+func proxyHandle(host string) []ConfigHandle {
+	return []ConfigHandle{
+		{
+			Handler: "subroute",
+			Routes: []Route{
+				{Handle: []RouteHandle{
+					{
+						Handler: "reverse_proxy",
+						Upstreams: []Upstream{
+							{Dial: host},
+						},
+					},
+				}},
+			},
+		},
+	}
+}
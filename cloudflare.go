@@ -20,9 +20,10 @@ type DNSConfig struct {
 }
 
 type CloudflareConfig struct {
-	Token string
-	Zone  string
-	DNS   DNSConfig
+	Token   string
+	Zone    string
+	Account string
+	DNS     DNSConfig
 
 	apiURL  string
 	devMode bool
@@ -62,6 +63,12 @@ func (c *CloudflareConfig) Proxied(value bool) *CloudflareConfig {
 	return c
 }
 
+// SetAPIURL points the client at a different Cloudflare API, e.g. a local stand-in.
+func (c *CloudflareConfig) SetAPIURL(url string) *CloudflareConfig {
+	c.apiURL = url
+	return c
+}
+
 func (c *CloudflareConfig) DevMode() *CloudflareConfig {
 	c.devMode = true
 	return c
@@ -118,7 +125,7 @@ func (c *CloudflareConfig) Install() error {
 }
 
 func (c *CloudflareConfig) SendConfiguration() (DNSRecord, error) {
-	zone, err := c.getZone()
+	zone, err := c.ResolveZone()
 	if err != nil {
 		return DNSRecord{}, err
 	}
@@ -134,15 +141,21 @@ func (c *CloudflareConfig) SendConfiguration() (DNSRecord, error) {
 		c.DNS.Content = ip
 	}
 
-	resp, err := grequests.Post(fmt.Sprintf("%v/zones/%v/dns_records", c.apiURL, zone.ID), &grequests.RequestOptions{
+	// A create that timed out may still have gone through, look for it before posting again
+	var existing *DNSRecord
+	resp, recovered, err := c.send("POST", fmt.Sprintf("%v/zones/%v/dns_records", c.apiURL, zone.ID), &grequests.RequestOptions{
 		JSON: c.DNS,
-		Headers: map[string]string{
-			"authorization": fmt.Sprintf("Bearer %v", c.Token),
-		},
+	}, func() bool {
+		record, err := c.findRecord(zone.ID)
+		existing = record
+		return err == nil && record != nil
 	})
 	if err != nil {
 		return DNSRecord{}, err
 	}
+	if recovered {
+		return *existing, nil
+	}
 	if !resp.Ok {
 		return DNSRecord{}, fmt.Errorf("failed: %v", resp.String())
 	}
@@ -158,43 +171,29 @@ func (c *CloudflareConfig) SendConfiguration() (DNSRecord, error) {
 }
 
 func (c *CloudflareConfig) RemoveConfiguration(record DNSRecord) error {
-	req, err := grequests.Delete(fmt.Sprintf("%v/zones/%v/dns_records/%v", c.apiURL, record.ZoneID, record.ID),
-		&grequests.RequestOptions{
-			Headers: map[string]string{
-				"authorization": fmt.Sprintf("Bearer %v", c.Token),
-			},
-		},
-	)
+	url := fmt.Sprintf("%v/zones/%v/dns_records/%v", c.apiURL, record.ZoneID, record.ID)
+	// A delete that timed out may still have gone through, don't treat the missing record as a failure
+	req, recovered, err := c.send("DELETE", url, nil, func() bool {
+		resp, _, err := c.send("GET", url, nil, nil)
+		return err == nil && resp.StatusCode == 404
+	})
 
 	if err != nil {
 		return err
 	}
+	if recovered {
+		return nil
+	}
 	if !strings.Contains(req.String(), record.ID) {
 		return fmt.Errorf("unsuccessful request: %v", req.String())
 	}
 	return nil
 }
 
-func (c *CloudflareConfig) getZone() (*Zone, error) {
-	log.Println("[cloudflare] Retrieving zone record for", c.Zone)
-	resp, err := grequests.Get(fmt.Sprintf("%v/zones?name=%v", c.apiURL, c.Zone), &grequests.RequestOptions{
-		Headers: map[string]string{
-			"authorization": fmt.Sprintf("Bearer %v", c.Token),
-		},
-	})
-	if err != nil {
-		return nil, err
-	}
-
-	zoneResponse, err := UnmarshalZoneResponse(resp.Bytes())
-	if err != nil {
-		return nil, err
+func (c *CloudflareConfig) headers() map[string]string {
+	return map[string]string{
+		"authorization": fmt.Sprintf("Bearer %v", c.Token),
 	}
-	if len(zoneResponse.Result) == 0 {
-		return nil, fmt.Errorf("no zone records found for: %v", c.Zone)
-	}
-
-	return &zoneResponse.Result[0], nil
 }
 
 func UnmarshalDNSRecordResponse(data []byte) (DNSRecordResponse, error) {
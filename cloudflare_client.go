@@ -0,0 +1,218 @@
+package bandaid
+
+import (
+	"fmt"
+	"github.com/levigross/grequests"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// CloudflareRetry controls how failed Cloudflare requests (network errors, 429s and 5xx responses) are retried.
+var CloudflareRetry = struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Timeout     time.Duration
+}{
+	MaxAttempts: 6,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    time.Minute,
+	Timeout:     30 * time.Second,
+}
+
+// requestBudget is a token bucket shared by every CloudflareConfig in the process, so that many deploys
+// running at once stay under Cloudflare's API limit together.
+type requestBudget struct {
+	sync.Mutex
+	capacity float64
+	tokens   float64
+	rate     float64
+	last     time.Time
+	paused   time.Time
+}
+
+// Cloudflare allows 1200 requests per 5 minutes for a user, stay a bit below it.
+var cloudflareBudget = newRequestBudget(1000, 5*time.Minute)
+
+func newRequestBudget(requests int, per time.Duration) *requestBudget {
+	return &requestBudget{
+		capacity: float64(requests),
+		tokens:   float64(requests),
+		rate:     float64(requests) / per.Seconds(),
+		last:     time.Now(),
+	}
+}
+
+// SetCloudflareBudget changes how many Cloudflare API requests the process may send per time window.
+func SetCloudflareBudget(requests int, per time.Duration) {
+	budget := newRequestBudget(requests, per)
+	cloudflareBudget.Lock()
+	cloudflareBudget.capacity = budget.capacity
+	cloudflareBudget.rate = budget.rate
+	if cloudflareBudget.tokens > budget.capacity {
+		cloudflareBudget.tokens = budget.capacity
+	}
+	cloudflareBudget.Unlock()
+}
+
+func (b *requestBudget) wait() {
+	for {
+		b.Lock()
+		now := time.Now()
+		if now.Before(b.paused) {
+			delay := b.paused.Sub(now)
+			b.Unlock()
+			time.Sleep(delay)
+			continue
+		}
+
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+		b.last = now
+		if b.tokens >= 1 {
+			b.tokens--
+			b.Unlock()
+			return
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+		b.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// pause holds every request in the process until the given time, used when Cloudflare asks us to back off.
+func (b *requestBudget) pause(until time.Time) {
+	b.Lock()
+	if until.After(b.paused) {
+		b.paused = until
+	}
+	b.Unlock()
+}
+
+// retryHook is called before a request is sent again. Returning true means the previous attempt actually
+// went through and the request must not be repeated.
+type retryHook func() bool
+
+// send performs a Cloudflare API request, waiting for the shared request budget and retrying with
+// exponential backoff on network errors, 429s and 5xx responses.
+func (c *CloudflareConfig) send(method, url string, options *grequests.RequestOptions, hook retryHook) (resp *grequests.Response, recovered bool, err error) {
+	if options == nil {
+		options = &grequests.RequestOptions{}
+	}
+	if options.Headers == nil {
+		options.Headers = c.headers()
+	}
+	if options.RequestTimeout == 0 {
+		options.RequestTimeout = CloudflareRetry.Timeout
+	}
+
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 && hook != nil && hook() {
+			return nil, true, nil
+		}
+
+		cloudflareBudget.wait()
+		resp, err = grequests.Req(method, url, options)
+		ObserveCall("cloudflare", err != nil || !resp.Ok)
+		if !shouldRetry(resp, err) || attempt >= CloudflareRetry.MaxAttempts {
+			return resp, false, err
+		}
+
+		delay := backoff(attempt)
+		if resp != nil {
+			if after, ok := retryAfter(resp); ok {
+				delay = after
+				if resp.StatusCode == http.StatusTooManyRequests {
+					cloudflareBudget.pause(time.Now().Add(after))
+				}
+			}
+			log.Printf("[cloudflare] %v %v returned %v, retrying in %v (%v/%v)\n",
+				method, url, resp.StatusCode, delay, attempt, CloudflareRetry.MaxAttempts)
+			_ = resp.Close()
+		} else {
+			log.Printf("[cloudflare] %v %v failed: %v, retrying in %v (%v/%v)\n",
+				method, url, err, delay, attempt, CloudflareRetry.MaxAttempts)
+		}
+		time.Sleep(delay)
+	}
+}
+
+func shouldRetry(resp *grequests.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+// backoff returns the delay before the next attempt, doubling each time with full jitter.
+func backoff(attempt int) time.Duration {
+	delay := CloudflareRetry.BaseDelay << uint(attempt-1)
+	if delay <= 0 || delay > CloudflareRetry.MaxDelay {
+		delay = CloudflareRetry.MaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// retryAfter reads the Retry-After header, capped at the longest backoff so a bad value can't stall the
+// request and the shared budget.
+func retryAfter(resp *grequests.Response) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	var after time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		after = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		after = time.Until(at)
+	} else {
+		return 0, false
+	}
+	if after < 0 {
+		after = 0
+	}
+	if after > CloudflareRetry.MaxDelay {
+		after = CloudflareRetry.MaxDelay
+	}
+	return after, true
+}
+
+// findRecord looks for a record identical to the configured one, used to make record creation safe to retry.
+func (c *CloudflareConfig) findRecord(zoneID string) (*DNSRecord, error) {
+	resp, _, err := c.send("GET", fmt.Sprintf("%v/zones/%v/dns_records", c.apiURL, zoneID), &grequests.RequestOptions{
+		Params: map[string]string{
+			"type":    c.DNS.Type,
+			"name":    c.DNS.Name,
+			"content": c.DNS.Content,
+		},
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.Ok {
+		return nil, fmt.Errorf("failed to list records: %v", resp.String())
+	}
+
+	records := DNSRecordsResponse{}
+	if err := resp.JSON(&records); err != nil {
+		return nil, err
+	}
+	if len(records.Result) == 0 {
+		return nil, nil
+	}
+	return &records.Result[0], nil
+}
+
+type DNSRecordsResponse struct {
+	Success    bool          `json:"success"`
+	Errors     []interface{} `json:"errors"`
+	Messages   []interface{} `json:"messages"`
+	Result     []DNSRecord   `json:"result"`
+	ResultInfo ResultInfo    `json:"result_info"`
+}
@@ -0,0 +1,204 @@
+package bandaid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fastRetries shortens the retry delays for the duration of a test.
+func fastRetries(t *testing.T, attempts int) {
+	saved := CloudflareRetry
+	CloudflareRetry.MaxAttempts = attempts
+	CloudflareRetry.BaseDelay = 20 * time.Millisecond
+	CloudflareRetry.MaxDelay = 80 * time.Millisecond
+	CloudflareRetry.Timeout = 5 * time.Second
+	t.Cleanup(func() { CloudflareRetry = saved })
+}
+
+// standIn is a local Cloudflare API that records when each request arrived.
+type standIn struct {
+	sync.Mutex
+	requests []time.Time
+}
+
+func (s *standIn) arrived() int {
+	s.Lock()
+	defer s.Unlock()
+	s.requests = append(s.requests, time.Now())
+	return len(s.requests)
+}
+
+func (s *standIn) count() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.requests)
+}
+
+func TestSendHonorsRetryAfter(t *testing.T) {
+	fastRetries(t, 3)
+	// Retry-After is capped at the longest backoff
+	CloudflareRetry.MaxDelay = 2 * time.Second
+	stand := &standIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stand.arrived() == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer server.Close()
+
+	c := AutoCloudflare("token").SetAPIURL(server.URL)
+	resp, _, err := c.send("GET", server.URL+"/zones", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("got %v, want 200", resp.StatusCode)
+	}
+	if stand.count() != 2 {
+		t.Fatalf("sent %v requests, want 2", stand.count())
+	}
+	if waited := stand.requests[1].Sub(stand.requests[0]); waited < 900*time.Millisecond {
+		t.Fatalf("retried after %v, Retry-After asked for 1s", waited)
+	}
+}
+
+func TestSendCapsRetryAfter(t *testing.T) {
+	fastRetries(t, 2)
+	stand := &standIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if stand.arrived() == 1 {
+			w.Header().Set("Retry-After", "86400")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"success": true}`))
+	}))
+	defer server.Close()
+
+	started := time.Now()
+	resp, _, err := AutoCloudflare("token").send("GET", server.URL+"/zones", nil, nil)
+	if err != nil || resp.StatusCode != 200 {
+		t.Fatalf("got %v, want 200", err)
+	}
+	if waited := time.Since(started); waited > time.Second {
+		t.Errorf("waited %v for a day long Retry-After, want at most %v", waited, CloudflareRetry.MaxDelay)
+	}
+}
+
+func TestSendStopsAtMaxAttempts(t *testing.T) {
+	fastRetries(t, 4)
+	stand := &standIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stand.arrived()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	c := AutoCloudflare("token").SetAPIURL(server.URL)
+	resp, recovered, err := c.send("GET", server.URL+"/zones", nil, nil)
+	if err != nil || recovered {
+		t.Fatalf("got %v, %v, want the last response", recovered, err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want 503", resp.StatusCode)
+	}
+	if stand.count() != 4 {
+		t.Fatalf("sent %v requests, want 4", stand.count())
+	}
+	// Each delay is between half and all of the doubled base delay
+	for i := 1; i < len(stand.requests); i++ {
+		waited := stand.requests[i].Sub(stand.requests[i-1])
+		if min := CloudflareRetry.BaseDelay << uint(i-1) / 2; waited < min {
+			t.Errorf("attempt %v came after %v, want at least %v", i+1, waited, min)
+		}
+	}
+}
+
+func TestSendDoesNotRetryClientErrors(t *testing.T) {
+	fastRetries(t, 4)
+	stand := &standIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stand.arrived()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer server.Close()
+
+	resp, _, err := AutoCloudflare("token").send("GET", server.URL+"/zones", nil, nil)
+	if err != nil || resp.StatusCode != http.StatusForbidden || stand.count() != 1 {
+		t.Fatalf("got %v after %v requests, want one 403", err, stand.count())
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	fastRetries(t, 6)
+	for attempt := 1; attempt <= 10; attempt++ {
+		max := CloudflareRetry.BaseDelay << uint(attempt-1)
+		if max > CloudflareRetry.MaxDelay {
+			max = CloudflareRetry.MaxDelay
+		}
+		for i := 0; i < 100; i++ {
+			if delay := backoff(attempt); delay < max/2 || delay > max {
+				t.Fatalf("attempt %v waited %v, want between %v and %v", attempt, delay, max/2, max)
+			}
+		}
+	}
+}
+
+func TestSendConfigurationRecoversPartialCreate(t *testing.T) {
+	fastRetries(t, 4)
+	var lock sync.Mutex
+	records := []DNSRecord{}
+	posts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case r.URL.Path == "/zones":
+			json.NewEncoder(w).Encode(ZoneResponse{
+				Success:    true,
+				Result:     []Zone{{ID: "zone1", Name: "partial.example"}},
+				ResultInfo: ResultInfo{Page: 1, TotalPages: 1},
+			})
+		case r.URL.Path == "/zones/zone1/dns_records" && r.Method == "POST":
+			// The record is created but the response is lost
+			posts++
+			record := DNSRecord{}
+			json.NewDecoder(r.Body).Decode(&record)
+			record.ID, record.ZoneID = "record1", "zone1"
+			records = append(records, record)
+			w.WriteHeader(http.StatusBadGateway)
+		case r.URL.Path == "/zones/zone1/dns_records" && r.Method == "GET":
+			query := r.URL.Query()
+			matches := []DNSRecord{}
+			for _, record := range records {
+				if record.Type == query.Get("type") && record.Name == query.Get("name") && record.Content == query.Get("content") {
+					matches = append(matches, record)
+				}
+			}
+			json.NewEncoder(w).Encode(DNSRecordsResponse{Success: true, Result: matches})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	c := AutoCloudflare("token").SetAPIURL(server.URL).SetZone("partial.example").
+		SetDomain("app.partial.example").SetIP("192.0.2.1")
+	record, err := c.SendConfiguration()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.ID != "record1" {
+		t.Fatalf("got record %+v, want the one the failed create made", record)
+	}
+	if posts != 1 || len(records) != 1 {
+		t.Fatalf("posted %v times and created %v records, want 1", posts, len(records))
+	}
+}
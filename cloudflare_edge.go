@@ -0,0 +1,198 @@
+package bandaid
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/levigross/grequests"
+	"log"
+	"strings"
+)
+
+type PageRule struct {
+	ID       string           `json:"id,omitempty"`
+	Targets  []PageRuleTarget `json:"targets"`
+	Actions  []PageRuleAction `json:"actions"`
+	Priority int64            `json:"priority,omitempty"`
+	Status   string           `json:"status"`
+}
+
+type PageRuleTarget struct {
+	Target     string `json:"target"`
+	Constraint struct {
+		Operator string `json:"operator"`
+		Value    string `json:"value"`
+	} `json:"constraint"`
+}
+
+type PageRuleAction struct {
+	ID    string      `json:"id"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+type pageRulesResponse struct {
+	Success bool          `json:"success"`
+	Errors  []interface{} `json:"errors"`
+	Result  []PageRule    `json:"result"`
+}
+
+type cloudflareResponse struct {
+	Success bool          `json:"success"`
+	Errors  []interface{} `json:"errors"`
+}
+
+func pageRuleFor(host, path string, actions ...PageRuleAction) PageRule {
+	if path == "" {
+		path = "/*"
+	}
+	target := PageRuleTarget{Target: "url"}
+	target.Constraint.Operator = "matches"
+	target.Constraint.Value = host + "/" + strings.TrimPrefix(path, "/")
+	return PageRule{
+		Targets: []PageRuleTarget{target},
+		Actions: actions,
+		Status:  "active",
+	}
+}
+
+// RedirectRule forwards requests for host matching path to the url with the status code (301 or 302).
+func RedirectRule(host, path, url string, status int) PageRule {
+	return pageRuleFor(host, path, PageRuleAction{
+		ID: "forwarding_url",
+		Value: map[string]interface{}{
+			"url":         url,
+			"status_code": status,
+		},
+	})
+}
+
+// CacheRule caches everything for host matching path at the edge, for edgeTTL seconds when it's set.
+func CacheRule(host, path string, edgeTTL int64) PageRule {
+	actions := []PageRuleAction{{ID: "cache_level", Value: "cache_everything"}}
+	if edgeTTL > 0 {
+		actions = append(actions, PageRuleAction{ID: "edge_cache_ttl", Value: edgeTTL})
+	}
+	return pageRuleFor(host, path, actions...)
+}
+
+// PurgeCache purges the zone's cache for the given hostnames and URL prefixes.
+func (c *CloudflareConfig) PurgeCache(hosts []string, prefixes []string) error {
+	zone, err := c.ResolveZone()
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%v/zones/%v/purge_cache", c.apiURL, zone.ID)
+	if len(hosts) > 0 {
+		log.Println("[cloudflare] Purging cache for", hosts)
+		if err := c.edgeRequest("POST", url, map[string]interface{}{"hosts": hosts}); err != nil {
+			return err
+		}
+	}
+	if len(prefixes) > 0 {
+		log.Println("[cloudflare] Purging cache for", prefixes)
+		if err := c.edgeRequest("POST", url, map[string]interface{}{"prefixes": prefixes}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetSSLMode sets the zone's SSL mode, one of "off", "flexible", "full" or "strict".
+func (c *CloudflareConfig) SetSSLMode(mode string) error {
+	zone, err := c.ResolveZone()
+	if err != nil {
+		return err
+	}
+	log.Printf("[cloudflare] Setting SSL mode of %v to '%v'\n", zone.Name, mode)
+	return c.edgeRequest("PATCH", fmt.Sprintf("%v/zones/%v/settings/ssl", c.apiURL, zone.ID), map[string]interface{}{
+		"value": mode,
+	})
+}
+
+// PageRules returns the zone's page rules that target the given hostname.
+func (c *CloudflareConfig) PageRules(host string) ([]PageRule, error) {
+	zone, err := c.ResolveZone()
+	if err != nil {
+		return nil, err
+	}
+	resp, _, err := c.send("GET", fmt.Sprintf("%v/zones/%v/pagerules", c.apiURL, zone.ID), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	rules := pageRulesResponse{}
+	if err := json.Unmarshal(resp.Bytes(), &rules); err != nil {
+		return nil, err
+	}
+	if !resp.Ok || !rules.Success {
+		return nil, fmt.Errorf("failed to list page rules: %v", resp.String())
+	}
+
+	matching := []PageRule{}
+	for _, rule := range rules.Result {
+		for _, target := range rule.Targets {
+			value := target.Constraint.Value
+			if value == host || strings.HasPrefix(value, host+"/") {
+				matching = append(matching, rule)
+				break
+			}
+		}
+	}
+	return matching, nil
+}
+
+// RemovePageRules deletes every page rule targeting the hostname.
+func (c *CloudflareConfig) RemovePageRules(host string) error {
+	rules, err := c.PageRules(host)
+	if err != nil {
+		return err
+	}
+	zone, err := c.ResolveZone()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		log.Println("[cloudflare] Removing page rule", rule.ID, "for", host)
+		url := fmt.Sprintf("%v/zones/%v/pagerules/%v", c.apiURL, zone.ID, rule.ID)
+		if err := c.edgeRequest("DELETE", url, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ApplyPageRules replaces the page rules targeting the hostname with the given ones.
+func (c *CloudflareConfig) ApplyPageRules(host string, rules []PageRule) error {
+	if err := c.RemovePageRules(host); err != nil {
+		return err
+	}
+	zone, err := c.ResolveZone()
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		log.Println("[cloudflare] Creating page rule for", rule.Targets[0].Constraint.Value)
+		if err := c.edgeRequest("POST", fmt.Sprintf("%v/zones/%v/pagerules", c.apiURL, zone.ID), rule); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *CloudflareConfig) edgeRequest(method, url string, body interface{}) error {
+	options := &grequests.RequestOptions{}
+	if body != nil {
+		options.JSON = body
+	}
+	resp, _, err := c.send(method, url, options, nil)
+	if err != nil {
+		return err
+	}
+	response := cloudflareResponse{}
+	if err := json.Unmarshal(resp.Bytes(), &response); err != nil {
+		return fmt.Errorf("unexpected response: %v", resp.String())
+	}
+	if !resp.Ok || !response.Success {
+		return fmt.Errorf("unsuccessful request: %v", response.Errors)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package bandaid
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/levigross/grequests"
+	"log"
+	"strings"
+)
+
+// RequiredPermissions are the zone permissions a token needs for bandaid to manage DNS records.
+var RequiredPermissions = []string{"#zone:read", "#dns_records:edit"}
+
+type TokenVerification struct {
+	OK       bool     `json:"ok"`
+	TokenID  string   `json:"token_id,omitempty"`
+	Status   string   `json:"status,omitempty"`
+	Zone     string   `json:"zone,omitempty"`
+	ZoneID   string   `json:"zone_id,omitempty"`
+	Missing  []string `json:"missing_permissions,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+type tokenVerifyResponse struct {
+	Success bool          `json:"success"`
+	Errors  []interface{} `json:"errors"`
+	Result  struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	} `json:"result"`
+}
+
+// Verify checks that the token is active, that it can read the configured zone and that it can edit the
+// zone's DNS records. The returned report is always filled in, the error is set when the token is unusable.
+func (c *CloudflareConfig) Verify() (*TokenVerification, error) {
+	report := &TokenVerification{}
+	fail := func(err error) (*TokenVerification, error) {
+		report.Error = err.Error()
+		return report, err
+	}
+
+	log.Println("[cloudflare] Verifying token")
+	resp, _, err := c.send("GET", fmt.Sprintf("%v/user/tokens/verify", c.apiURL), nil, nil)
+	if err != nil {
+		return fail(err)
+	}
+	verify := tokenVerifyResponse{}
+	if err := json.Unmarshal(resp.Bytes(), &verify); err != nil {
+		return fail(fmt.Errorf("failed to read verification response: %v", resp.String()))
+	}
+	if !resp.Ok || !verify.Success {
+		return fail(fmt.Errorf("token verification failed: %v", verify.Errors))
+	}
+	report.TokenID = verify.Result.ID
+	report.Status = verify.Result.Status
+	if verify.Result.Status != "active" {
+		return fail(fmt.Errorf("token is %v", verify.Result.Status))
+	}
+
+	if c.Zone == "" && c.DNS.Name == "" {
+		report.Warnings = append(report.Warnings, "no zone or domain set, zone permissions were not checked")
+		report.OK = true
+		return report, nil
+	}
+
+	zone, err := c.ResolveZone()
+	if err != nil {
+		report.Missing = append(report.Missing, "#zone:read")
+		return fail(err)
+	}
+	report.Zone = zone.Name
+	report.ZoneID = zone.ID
+
+	if len(zone.Permissions) == 0 {
+		// Cloudflare doesn't always list the permissions, at least make sure the records can be read
+		resp, _, err := c.send("GET", fmt.Sprintf("%v/zones/%v/dns_records", c.apiURL, zone.ID), &grequests.RequestOptions{
+			Params: map[string]string{"per_page": "5"},
+		}, nil)
+		if err != nil {
+			return fail(err)
+		}
+		if !resp.Ok {
+			report.Missing = append(report.Missing, "#dns_records:read")
+			return fail(fmt.Errorf("cannot read DNS records of %v: %v", zone.Name, resp.String()))
+		}
+		report.Warnings = append(report.Warnings, "zone permissions were not listed, DNS edit access could not be confirmed")
+		report.OK = true
+		return report, nil
+	}
+
+	for _, permission := range RequiredPermissions {
+		if !hasPermission(zone.Permissions, permission) {
+			report.Missing = append(report.Missing, permission)
+		}
+	}
+	if len(report.Missing) > 0 {
+		return fail(fmt.Errorf("token is missing permissions for %v: %v", zone.Name, strings.Join(report.Missing, ", ")))
+	}
+
+	report.OK = true
+	return report, nil
+}
+
+func hasPermission(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
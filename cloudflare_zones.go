@@ -0,0 +1,165 @@
+package bandaid
+
+import (
+	"fmt"
+	"github.com/levigross/grequests"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ZoneCacheTTL is how long a resolved zone is reused before Cloudflare is queried again.
+var ZoneCacheTTL = time.Hour
+
+type cachedZone struct {
+	zone    Zone
+	expires time.Time
+}
+
+var zoneCache = struct {
+	sync.Mutex
+	zones map[string]cachedZone
+}{zones: map[string]cachedZone{}}
+
+func (c *CloudflareConfig) SetAccount(account string) *CloudflareConfig {
+	c.Account = account
+	return c
+}
+
+// ListZones returns every zone visible to the token, following pagination. If name is set, only zones
+// with that exact name are requested.
+func (c *CloudflareConfig) ListZones(name string) ([]Zone, error) {
+	zones := []Zone{}
+	for page := 1; ; page++ {
+		params := map[string]string{
+			"page":     strconv.Itoa(page),
+			"per_page": "50",
+		}
+		if name != "" {
+			params["name"] = name
+		}
+		if c.Account != "" {
+			params["account.id"] = c.Account
+		}
+
+		resp, _, err := c.send("GET", fmt.Sprintf("%v/zones", c.apiURL), &grequests.RequestOptions{
+			Params: params,
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+		if !resp.Ok {
+			return nil, fmt.Errorf("failed to list zones: %v", resp.String())
+		}
+
+		zoneResponse, err := UnmarshalZoneResponse(resp.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if len(zoneResponse.Errors) > 0 {
+			return nil, fmt.Errorf("%v", zoneResponse.Errors)
+		}
+
+		zones = append(zones, zoneResponse.Result...)
+		if int64(page) >= zoneResponse.ResultInfo.TotalPages {
+			break
+		}
+	}
+	return zones, nil
+}
+
+// ResolveZone returns the zone for the configured Zone, or infers it from the configured domain when no zone
+// is set. Results are cached for ZoneCacheTTL.
+func (c *CloudflareConfig) ResolveZone() (*Zone, error) {
+	query := c.Zone
+	if query == "" {
+		query = c.DNS.Name
+	}
+	if query == "" {
+		return nil, fmt.Errorf("neither a zone nor a domain has been set")
+	}
+
+	key := strings.Join([]string{c.Token, c.Account, strings.ToLower(query)}, "|")
+	zoneCache.Lock()
+	cached, exists := zoneCache.zones[key]
+	zoneCache.Unlock()
+	if exists && time.Now().Before(cached.expires) {
+		return &cached.zone, nil
+	}
+
+	var zone *Zone
+	var err error
+	if c.Zone != "" {
+		zone, err = c.lookupZone(c.Zone)
+	} else {
+		zone, err = c.inferZone(c.DNS.Name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	zoneCache.Lock()
+	zoneCache.zones[key] = cachedZone{zone: *zone, expires: time.Now().Add(ZoneCacheTTL)}
+	zoneCache.Unlock()
+	return zone, nil
+}
+
+func (c *CloudflareConfig) lookupZone(name string) (*Zone, error) {
+	log.Println("[cloudflare] Retrieving zone record for", name)
+	zones, err := c.ListZones(name)
+	if err != nil {
+		return nil, err
+	}
+	for _, zone := range zones {
+		if strings.EqualFold(zone.Name, name) {
+			return &zone, nil
+		}
+	}
+	return nil, c.noZoneError(name)
+}
+
+// inferZone picks the zone with the longest name that the domain belongs to.
+func (c *CloudflareConfig) inferZone(domain string) (*Zone, error) {
+	log.Println("[cloudflare] Inferring zone for", domain)
+	zones, err := c.ListZones("")
+	if err != nil {
+		return nil, err
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	var match *Zone
+	for i, zone := range zones {
+		name := strings.ToLower(zone.Name)
+		if domain != name && !strings.HasSuffix(domain, "."+name) {
+			continue
+		}
+		if match == nil || len(zone.Name) > len(match.Name) {
+			match = &zones[i]
+		}
+	}
+	if match == nil {
+		return nil, zoneListError(domain, zones)
+	}
+	return match, nil
+}
+
+func (c *CloudflareConfig) noZoneError(query string) error {
+	zones, err := c.ListZones("")
+	if err != nil {
+		return fmt.Errorf("no zone records found for: %v", query)
+	}
+	return zoneListError(query, zones)
+}
+
+func zoneListError(query string, zones []Zone) error {
+	names := []string{}
+	for _, zone := range zones {
+		names = append(names, zone.Name)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("no zone records found for: %v, the token cannot see any zones", query)
+	}
+	return fmt.Errorf("no zone records found for: %v, visible zones: %v", query, strings.Join(names, ", "))
+}
@@ -0,0 +1,116 @@
+package bandaid
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// zoneStandIn serves the zones two to a page, filtered by name like Cloudflare does.
+func zoneStandIn(t *testing.T, zones ...string) (*httptest.Server, *standIn) {
+	stand := &standIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stand.arrived()
+		if r.URL.Path != "/zones" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		matches := []Zone{}
+		for i, name := range zones {
+			if query := r.URL.Query().Get("name"); query == "" || strings.EqualFold(query, name) {
+				matches = append(matches, Zone{ID: "zone" + strconv.Itoa(i+1), Name: name})
+			}
+		}
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		from, to := (page-1)*2, page*2
+		if to > len(matches) {
+			to = len(matches)
+		}
+		if from > to {
+			from = to
+		}
+		json.NewEncoder(w).Encode(ZoneResponse{
+			Success:    true,
+			Result:     matches[from:to],
+			ResultInfo: ResultInfo{Page: int64(page), TotalPages: int64((len(matches) + 1) / 2)},
+		})
+	}))
+	t.Cleanup(server.Close)
+
+	saved := zoneCache.zones
+	zoneCache.zones = map[string]cachedZone{}
+	t.Cleanup(func() { zoneCache.zones = saved })
+	return server, stand
+}
+
+func TestListZonesFollowsPages(t *testing.T) {
+	server, stand := zoneStandIn(t, "a.example", "b.example", "c.example", "d.example", "e.example")
+	zones, err := AutoCloudflare("token").SetAPIURL(server.URL).ListZones("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, zone := range zones {
+		names = append(names, zone.Name)
+	}
+	if strings.Join(names, " ") != "a.example b.example c.example d.example e.example" || stand.count() != 3 {
+		t.Errorf("listed %v in %v requests, want all 5 zones in 3", names, stand.count())
+	}
+}
+
+func TestResolveZoneInfersFromDomain(t *testing.T) {
+	server, _ := zoneStandIn(t, "example.com", "other.net", "dev.example.com", "ample.com", "example.org")
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"example.com", "zone1"},
+		{"app.example.com", "zone1"},
+		{"App.Dev.Example.com.", "zone3"},
+		{"dev.example.com", "zone3"},
+		{"x.example.org", "zone5"},
+	}
+	for _, test := range tests {
+		zone, err := AutoCloudflare("token").SetAPIURL(server.URL).SetDomain(test.domain).ResolveZone()
+		if err != nil || zone.ID != test.want {
+			t.Errorf("%v resolved to %+v, %v, want %v", test.domain, zone, err, test.want)
+		}
+	}
+
+	_, err := AutoCloudflare("token").SetAPIURL(server.URL).SetDomain("notexample.com").ResolveZone()
+	if err == nil || !strings.Contains(err.Error(), "visible zones: example.com, other.net") {
+		t.Errorf("got %v, want the visible zones", err)
+	}
+}
+
+func TestResolveZoneIsCached(t *testing.T) {
+	server, stand := zoneStandIn(t, "example.com", "example.org")
+	resolve := func(token, zone string) string {
+		t.Helper()
+		resolved, err := AutoCloudflare(token).SetAPIURL(server.URL).SetZone(zone).ResolveZone()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resolved.ID
+	}
+
+	if resolve("token", "example.com") != "zone1" || resolve("token", "EXAMPLE.com") != "zone1" || stand.count() != 1 {
+		t.Fatalf("sent %v requests for the same zone, want 1", stand.count())
+	}
+	// Another zone or another token is another entry
+	if resolve("token", "example.org") != "zone2" || resolve("other", "example.com") != "zone1" || stand.count() != 3 {
+		t.Fatalf("sent %v requests, want 3", stand.count())
+	}
+
+	// An expired entry is resolved again
+	saved := ZoneCacheTTL
+	ZoneCacheTTL = -time.Second
+	t.Cleanup(func() { ZoneCacheTTL = saved })
+	if resolve("expired", "example.com") != "zone1" || resolve("expired", "example.com") != "zone1" || stand.count() != 5 {
+		t.Fatalf("sent %v requests, want 5", stand.count())
+	}
+}
@@ -4,11 +4,13 @@ go 1.14
 
 require (
 	github.com/BurntSushi/toml v0.3.1
+	github.com/Masterminds/semver/v3 v3.1.1
 	github.com/gin-gonic/gin v1.6.3
 	github.com/imroc/req v0.3.0
 	github.com/levigross/grequests v0.0.0-20190908174114-253788527a1a
 	github.com/nokusukun/stemp v0.0.0-20190721151213-e6029a1e4f9a
 	github.com/phayes/freeport v0.0.0-20180830031419-95f893ade6f2
 	github.com/rs/xid v1.2.1 // indirect
+	golang.org/x/net v0.0.0-20181011144130-49bb7cea24b1
 	gopkg.in/ini.v1 v1.61.0
 )
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/ini.v1"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AlertUnhealthy    = "unhealthy"
+	AlertCrashLoop    = "crash_loop"
+	AlertDeployFailed = "deploy_failed"
+	AlertRecovered    = "recovered"
+)
+
+var alertConditions = []string{AlertUnhealthy, AlertCrashLoop, AlertDeployFailed, AlertRecovered}
+
+const (
+	NotifySlack   = "slack"
+	NotifyWebhook = "webhook"
+	NotifySMTP    = "smtp"
+)
+
+// AlertRules pick the conditions that alert and the notifiers that are told. The [alerts] section of config.ini
+// sets them for every application, the [alerts] table of a Bandaidfile overrides the ones it sets. An
+// application has to stay unhealthy for 'for' before it alerts, and alerts are sent again every 'repeat' until
+// they're resolved, recovered tells when they are.
+type AlertRules struct {
+	Disabled   bool     `toml:"disabled"`
+	Conditions []string `toml:"conditions"`
+	Notify     []string `toml:"notify"`
+	For        string   `toml:"for"`
+	Repeat     string   `toml:"repeat"`
+}
+
+func (rules AlertRules) Validate() error {
+	for _, condition := range rules.Conditions {
+		if !contains(alertConditions, condition) {
+			return fmt.Errorf("unknown alert condition '%v', use %v", condition, strings.Join(alertConditions, ", "))
+		}
+	}
+	for _, duration := range []string{rules.For, rules.Repeat} {
+		if duration == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(duration); err != nil || d < 0 {
+			return fmt.Errorf("invalid alert duration '%v'", duration)
+		}
+	}
+	return nil
+}
+
+// override returns the rules with the ones the application sets.
+func (rules AlertRules) override(app AlertRules) AlertRules {
+	rules.Disabled = rules.Disabled || app.Disabled
+	if app.Conditions != nil {
+		rules.Conditions = app.Conditions
+	}
+	if app.Notify != nil {
+		rules.Notify = app.Notify
+	}
+	if app.For != "" {
+		rules.For = app.For
+	}
+	if app.Repeat != "" {
+		rules.Repeat = app.Repeat
+	}
+	return rules
+}
+
+func (rules AlertRules) Settings() (pending time.Duration, repeat time.Duration) {
+	pending, _ = time.ParseDuration(rules.For)
+	repeat, _ = time.ParseDuration(rules.Repeat)
+	return
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Alert is what notifiers are told, firing when a condition is met and resolved once it's over.
+type Alert struct {
+	App        string    `json:"app"`
+	Repository string    `json:"repository"`
+	Condition  string    `json:"condition"`
+	Status     string    `json:"status"`
+	Message    string    `json:"message"`
+	Since      time.Time `json:"since"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+const (
+	AlertFiring   = "firing"
+	AlertResolved = "resolved"
+)
+
+func (alert Alert) Title() string {
+	if alert.Status == AlertResolved {
+		return fmt.Sprintf("%v recovered", alert.App)
+	}
+	switch alert.Condition {
+	case AlertUnhealthy:
+		return fmt.Sprintf("%v is unhealthy", alert.App)
+	case AlertCrashLoop:
+		return fmt.Sprintf("%v is crash looping", alert.App)
+	case AlertDeployFailed:
+		return fmt.Sprintf("%v failed to deploy", alert.App)
+	}
+	return fmt.Sprintf("%v: %v", alert.App, alert.Condition)
+}
+
+// notifier delivers alerts, set in a [notify.<name>] section of config.ini.
+type notifier interface {
+	Notify(alert Alert) error
+}
+
+// activeAlert is a condition that's met, it fires once it's been for long enough.
+type activeAlert struct {
+	Alert
+	Fired      bool      `json:"fired"`
+	NotifiedAt time.Time `json:"notified_at,omitempty"`
+
+	rules AlertRules
+}
+
+// NotifierStatus is what GET /manager/alerts reports about a notifier.
+type NotifierStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Sent      uint64 `json:"sent"`
+	Failed    uint64 `json:"failed"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// alertEngine keeps the conditions that are met, per application, and notifies about them.
+type alertEngine struct {
+	rules     AlertRules
+	notifiers map[string]notifier
+
+	lock     sync.Mutex
+	active   map[string]*activeAlert
+	statuses map[string]*NotifierStatus
+}
+
+// loadAlerts reads the [alerts] rules and the [notify.<name>] sections of config.ini, the [slack] webhook is the
+// slack notifier.
+func loadAlerts(config *ini.File) (*alertEngine, error) {
+	section := config.Section("alerts")
+	engine := &alertEngine{
+		rules: AlertRules{
+			Disabled:   section.Key("disabled").MustBool(false),
+			Conditions: splitList(section.Key("conditions").MustString(strings.Join(alertConditions, ","))),
+			Notify:     splitList(section.Key("notify").String()),
+			For:        section.Key("for").MustString("1m"),
+			Repeat:     section.Key("repeat").MustString("4h"),
+		},
+		notifiers: map[string]notifier{},
+		active:    map[string]*activeAlert{},
+		statuses:  map[string]*NotifierStatus{},
+	}
+	if err := engine.rules.Validate(); err != nil {
+		return nil, fmt.Errorf("[alerts]: %v", err)
+	}
+	if hook := config.Section("slack").Key("webhook").String(); hook != "" {
+		engine.add(NotifySlack, NotifySlack, slackNotifier{url: hook})
+	}
+
+	for _, section := range config.Sections() {
+		if !strings.HasPrefix(section.Name(), "notify.") {
+			continue
+		}
+		name, kind := strings.TrimPrefix(section.Name(), "notify."), section.Key("type").String()
+		var n notifier
+		switch kind {
+		case NotifySlack:
+			n = slackNotifier{url: section.Key("url").String()}
+		case NotifyWebhook:
+			n = webhookNotifier{url: section.Key("url").String(), authorization: section.Key("authorization").String()}
+		case NotifySMTP:
+			mail := smtpNotifier{
+				address:  section.Key("address").String(),
+				from:     section.Key("from").String(),
+				to:       splitList(section.Key("to").String()),
+				username: section.Key("username").String(),
+				password: section.Key("password").String(),
+			}
+			if mail.address == "" || mail.from == "" || len(mail.to) == 0 {
+				return nil, fmt.Errorf("[%v]: smtp notifiers need an address, from and to", section.Name())
+			}
+			n = mail
+		default:
+			return nil, fmt.Errorf("[%v]: unknown notifier type '%v', use slack, webhook or smtp", section.Name(), kind)
+		}
+		if kind != NotifySMTP && section.Key("url").String() == "" {
+			return nil, fmt.Errorf("[%v]: %v notifiers need a url", section.Name(), kind)
+		}
+		engine.add(name, kind, n)
+	}
+	for _, name := range engine.rules.Notify {
+		if engine.notifiers[name] == nil {
+			return nil, fmt.Errorf("[alerts]: unknown notifier '%v'", name)
+		}
+	}
+	return engine, nil
+}
+
+func (engine *alertEngine) add(name string, kind string, n notifier) {
+	engine.notifiers[name] = n
+	engine.statuses[name] = &NotifierStatus{Name: name, Type: kind}
+}
+
+func splitList(list string) []string {
+	values := []string{}
+	for _, value := range strings.Split(list, ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// rulesFor applies the application's Bandaidfile to the global rules.
+func (engine *alertEngine) rulesFor(app *Application) AlertRules {
+	config, err := app.Config()
+	if err != nil {
+		return engine.rules
+	}
+	return engine.rules.override(config.Alerts)
+}
+
+// raise tells the engine the condition is met, again or for the first time.
+func (engine *alertEngine) raise(app *Application, condition string, message string) {
+	rules := engine.rulesFor(app)
+	if rules.Disabled || !contains(rules.Conditions, condition) {
+		return
+	}
+	app.lock.Lock()
+	repository := app.Repository
+	app.lock.Unlock()
+
+	now := time.Now()
+	engine.lock.Lock()
+	key := app.ID + "/" + condition
+	active, exists := engine.active[key]
+	if !exists {
+		active = &activeAlert{Alert: Alert{App: app.ID, Repository: repository, Condition: condition, Since: now}}
+		engine.active[key] = active
+	}
+	active.Message, active.rules = redact(message), rules
+	engine.lock.Unlock()
+	engine.evaluate(now)
+}
+
+// resolve tells the engine the condition is over, alerts that fired are resolved.
+func (engine *alertEngine) resolve(app *Application, condition string) {
+	engine.lock.Lock()
+	key := app.ID + "/" + condition
+	active, exists := engine.active[key]
+	delete(engine.active, key)
+	engine.lock.Unlock()
+	if !exists || !active.Fired || !contains(active.rules.Conditions, AlertRecovered) {
+		return
+	}
+	alert := active.Alert
+	alert.Status, alert.Timestamp = AlertResolved, time.Now()
+	alert.Message = fmt.Sprintf("%v for %v", strings.Replace(alert.Condition, "_", " ", -1),
+		alert.Timestamp.Sub(alert.Since).Truncate(time.Second))
+	engine.send(alert, active.rules)
+}
+
+// clear forgets the application's alerts without resolving them, when it's deleted.
+func (engine *alertEngine) clear(id string) {
+	engine.lock.Lock()
+	defer engine.lock.Unlock()
+	for key, active := range engine.active {
+		if active.App == id {
+			delete(engine.active, key)
+		}
+	}
+}
+
+// evaluate fires the alerts that have been pending long enough and repeats the ones due. Only unhealthy
+// applications wait, the other conditions are conclusive.
+func (engine *alertEngine) evaluate(now time.Time) {
+	type notification struct {
+		alert Alert
+		rules AlertRules
+	}
+	notifications := []notification{}
+	engine.lock.Lock()
+	for _, active := range engine.active {
+		pending, repeat := active.rules.Settings()
+		if active.Condition != AlertUnhealthy {
+			pending = 0
+		}
+		switch {
+		case !active.Fired && now.Sub(active.Since) >= pending:
+		case active.Fired && repeat > 0 && now.Sub(active.NotifiedAt) >= repeat:
+		default:
+			continue
+		}
+		active.Fired, active.NotifiedAt = true, now
+		alert := active.Alert
+		alert.Status, alert.Timestamp = AlertFiring, now
+		notifications = append(notifications, notification{alert, active.rules})
+	}
+	engine.lock.Unlock()
+	for _, n := range notifications {
+		engine.send(n.alert, n.rules)
+	}
+}
+
+// send delivers the alert to the rules' notifiers, every one of them when they don't name any, in the
+// background. Failed deliveries are tried twice more.
+func (engine *alertEngine) send(alert Alert, rules AlertRules) {
+	names := rules.Notify
+	if len(names) == 0 {
+		for name := range engine.notifiers {
+			names = append(names, name)
+		}
+	}
+	log.Printf("[alerts] %v: %v\n", alert.Title(), alert.Message)
+	for _, name := range names {
+		n, exists := engine.notifiers[name]
+		if !exists {
+			log.Printf("[alerts] %v: unknown notifier '%v'\n", alert.App, name)
+			continue
+		}
+		go func(name string, n notifier) {
+			var err error
+			for attempt, delay := 0, time.Second; attempt < 3; attempt, delay = attempt+1, delay*2 {
+				if err = n.Notify(alert); err == nil {
+					break
+				}
+				if _, rejected := err.(rejectedError); rejected {
+					break
+				}
+				time.Sleep(delay)
+			}
+			engine.lock.Lock()
+			defer engine.lock.Unlock()
+			status := engine.statuses[name]
+			if err != nil {
+				status.Failed++
+				status.LastError = redact(err.Error())
+				log.Printf("[alerts] failed to notify %v: %v\n", name, status.LastError)
+				return
+			}
+			status.Sent++
+		}(name, n)
+	}
+}
+
+// StartAlerts loads the alert rules and notifiers from config.ini and evaluates the pending alerts in the
+// background.
+func (api *API) StartAlerts() error {
+	engine, err := loadAlerts(api.Config)
+	if err != nil {
+		return err
+	}
+	api.alerts = engine
+	go func() {
+		for now := range time.Tick(5 * time.Second) {
+			engine.evaluate(now)
+		}
+	}()
+	return nil
+}
+
+func (api *API) raiseAlert(app *Application, condition string, message string) {
+	if api != nil && api.alerts != nil {
+		api.alerts.raise(app, condition, message)
+	}
+}
+
+func (api *API) resolveAlert(app *Application, condition string) {
+	if api != nil && api.alerts != nil {
+		api.alerts.resolve(app, condition)
+	}
+}
+
+// MANAGER_GET_ALERTS returns the conditions that are met, firing or not yet, and the notifiers.
+func (api *API) MANAGER_GET_ALERTS(ctx *gin.Context) {
+	engine := api.alerts
+	engine.lock.Lock()
+	active := []activeAlert{}
+	for _, alert := range engine.active {
+		active = append(active, *alert)
+	}
+	statuses := []NotifierStatus{}
+	for _, status := range engine.statuses {
+		statuses = append(statuses, *status)
+	}
+	engine.lock.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].Since.Before(active[j].Since) })
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	ctx.JSON(200, gin.H{"alerts": active, "notifiers": statuses})
+}
+
+// slackNotifier posts to a Slack incoming webhook.
+type slackNotifier struct {
+	url string
+}
+
+func (n slackNotifier) Notify(alert Alert) error {
+	emoji := "🚨"
+	if alert.Status == AlertResolved {
+		emoji = "✅"
+	}
+	title := fmt.Sprintf("%v %v", emoji, alert.Title())
+	return postJSON(&http.Client{Timeout: 10 * time.Second}, n.url, "", gin.H{
+		"text": title,
+		"blocks": []gin.H{
+			{
+				"type": "header",
+				"text": gin.H{"type": "plain_text", "text": title, "emoji": true},
+			},
+			{
+				"type": "section",
+				"fields": []gin.H{
+					{"type": "mrkdwn", "text": "*Application:*\n`" + alert.App + "`"},
+					{"type": "mrkdwn", "text": "*Repository:*\n" + alert.Repository},
+					{"type": "mrkdwn", "text": "*Since:*\n" + alert.Since.Format(time.RFC1123)},
+				},
+			},
+			{
+				"type": "section",
+				"text": gin.H{"type": "mrkdwn", "text": "```" + alert.Message + "```"},
+			},
+		},
+	})
+}
+
+// webhookNotifier POSTs the alert as JSON.
+type webhookNotifier struct {
+	url           string
+	authorization string
+}
+
+func (n webhookNotifier) Notify(alert Alert) error {
+	return postJSON(&http.Client{Timeout: 10 * time.Second}, n.url, n.authorization, alert)
+}
+
+// smtpNotifier emails the alert, over STARTTLS when the server offers it. Credentials are only sent over TLS
+// or to localhost.
+type smtpNotifier struct {
+	address  string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (n smtpNotifier) Notify(alert Alert) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		host, _, _ := net.SplitHostPort(n.address)
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %v\r\n", n.from)
+	fmt.Fprintf(&message, "To: %v\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&message, "Subject: [bandaid] %v\r\n", alert.Title())
+	fmt.Fprintf(&message, "Date: %v\r\n", alert.Timestamp.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&message, "%v\r\n\r\n", strings.Replace(alert.Message, "\n", "\r\n", -1))
+	fmt.Fprintf(&message, "Application: %v\r\nRepository: %v\r\nCondition: %v\r\nStatus: %v\r\nSince: %v\r\n",
+		alert.App, alert.Repository, alert.Condition, alert.Status, alert.Since.Format(time.RFC1123Z))
+	return smtp.SendMail(n.address, auth, n.from, n.to, message.Bytes())
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpSession is what a client told the fake SMTP server.
+type smtpSession struct {
+	auth string
+	from string
+	to   []string
+	data string
+}
+
+// fakeSMTP accepts one session without TLS and reports it once the client quits.
+func fakeSMTP(t *testing.T) (string, <-chan smtpSession) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		session := smtpSession{}
+		text.PrintfLine("220 localhost ESMTP fake")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+			switch command {
+			case "EHLO", "HELO":
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				session.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+				text.PrintfLine("235 2.7.0 Authentication successful")
+			case "MAIL":
+				session.from = strings.TrimSuffix(strings.TrimPrefix(line, "MAIL FROM:<"), ">")
+				if i := strings.Index(session.from, ">"); i >= 0 {
+					session.from = session.from[:i]
+				}
+				text.PrintfLine("250 OK")
+			case "RCPT":
+				session.to = append(session.to, strings.TrimSuffix(strings.TrimPrefix(line, "RCPT TO:<"), ">"))
+				text.PrintfLine("250 OK")
+			case "DATA":
+				text.PrintfLine("354 End data with <CR><LF>.<CR><LF>")
+				data, err := text.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				session.data = string(data)
+				text.PrintfLine("250 OK")
+			case "QUIT":
+				text.PrintfLine("221 Bye")
+				sessions <- session
+				return
+			default:
+				text.PrintfLine("502 Command not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), sessions
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	address, sessions := fakeSMTP(t)
+	n := smtpNotifier{
+		address:  address,
+		from:     "bandaid@example.com",
+		to:       []string{"ops@example.com", "dev@example.com"},
+		username: "bandaid",
+		password: "secret",
+	}
+	since := time.Date(2020, 10, 9, 8, 0, 0, 0, time.UTC)
+	err := n.Notify(Alert{App: "app", Repository: "https://example.com/app.git", Condition: AlertCrashLoop,
+		Status: AlertFiring, Message: "5 restarts\nlast exit: 1", Since: since, Timestamp: since.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var session smtpSession
+	select {
+	case session = <-sessions:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the mail never arrived")
+	}
+	if auth, _ := base64.StdEncoding.DecodeString(session.auth); string(auth) != "\x00bandaid\x00secret" {
+		t.Errorf("authenticated with %q", auth)
+	}
+	if session.from != "bandaid@example.com" {
+		t.Errorf("mail from %q", session.from)
+	}
+	if strings.Join(session.to, ",") != "ops@example.com,dev@example.com" {
+		t.Errorf("mail to %v", session.to)
+	}
+	message, err := textproto.NewReader(bufio.NewReader(strings.NewReader(session.data))).ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for header, want := range map[string]string{
+		"From":    "bandaid@example.com",
+		"To":      "ops@example.com, dev@example.com",
+		"Subject": "[bandaid] app is crash looping",
+		"Date":    "Fri, 09 Oct 2020 08:01:00 +0000",
+	} {
+		if got := message.Get(header); got != want {
+			t.Errorf("%v is %q, want %q", header, got, want)
+		}
+	}
+	for _, line := range []string{"5 restarts\nlast exit: 1", "Condition: crash_loop", "Status: firing"} {
+		if !strings.Contains(session.data, line) {
+			t.Errorf("the mail doesn't say %q:\n%v", line, session.data)
+		}
+	}
+}
+
+// recordingNotifier reports every alert it's told about.
+type recordingNotifier chan Alert
+
+func (n recordingNotifier) Notify(alert Alert) error {
+	n <- alert
+	return nil
+}
+
+// expect checks the notifications sent since the last step, as status:condition.
+func (n recordingNotifier) expect(t *testing.T, step string, want ...string) {
+	got := []string{}
+	for len(got) < len(want) {
+		select {
+		case alert := <-n:
+			got = append(got, alert.Status+":"+alert.Condition)
+		case <-time.After(time.Second):
+			t.Fatalf("%v: sent %v, want %v", step, got, want)
+		}
+	}
+	select {
+	case alert := <-n:
+		got = append(got, alert.Status+":"+alert.Condition)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("%v: sent %v, want %v", step, got, want)
+	}
+}
+
+func TestAlertTransitions(t *testing.T) {
+	type step struct {
+		at        time.Duration // evaluate at this long after the first raise
+		raise     string
+		resolve   string
+		notifying []string
+	}
+	tests := []struct {
+		name  string
+		rules AlertRules
+		steps []step
+	}{
+		{
+			name:  "unhealthy waits for 'for' and repeats",
+			rules: AlertRules{Conditions: alertConditions, For: "1m", Repeat: "1h"},
+			steps: []step{
+				{raise: AlertUnhealthy},
+				{at: 30 * time.Second},
+				{at: time.Minute, notifying: []string{"firing:unhealthy"}},
+				{at: 30 * time.Minute},
+				{at: time.Hour + time.Minute, notifying: []string{"firing:unhealthy"}},
+				{resolve: AlertUnhealthy, notifying: []string{"resolved:unhealthy"}},
+				{at: 3 * time.Hour},
+			},
+		},
+		{
+			name:  "unhealthy resolved before 'for' never fires",
+			rules: AlertRules{Conditions: alertConditions, For: "1m", Repeat: "1h"},
+			steps: []step{
+				{raise: AlertUnhealthy},
+				{at: 30 * time.Second},
+				{resolve: AlertUnhealthy},
+				{at: 2 * time.Minute},
+			},
+		},
+		{
+			name:  "crash loops fire right away",
+			rules: AlertRules{Conditions: alertConditions, For: "1m", Repeat: "1h"},
+			steps: []step{
+				{raise: AlertCrashLoop, notifying: []string{"firing:crash_loop"}},
+				{raise: AlertCrashLoop},
+				{at: 30 * time.Minute},
+				{resolve: AlertCrashLoop, notifying: []string{"resolved:crash_loop"}},
+				{raise: AlertCrashLoop, notifying: []string{"firing:crash_loop"}},
+			},
+		},
+		{
+			name:  "repeat 0s never repeats",
+			rules: AlertRules{Conditions: alertConditions, For: "0s", Repeat: "0s"},
+			steps: []step{
+				{raise: AlertDeployFailed, notifying: []string{"firing:deploy_failed"}},
+				{at: 24 * time.Hour},
+			},
+		},
+		{
+			name:  "without recovered resolutions aren't sent",
+			rules: AlertRules{Conditions: []string{AlertDeployFailed}, For: "1m", Repeat: "1h"},
+			steps: []step{
+				{raise: AlertDeployFailed, notifying: []string{"firing:deploy_failed"}},
+				{resolve: AlertDeployFailed},
+			},
+		},
+		{
+			name:  "conditions that aren't listed don't alert",
+			rules: AlertRules{Conditions: []string{AlertDeployFailed}, For: "0s", Repeat: "1h"},
+			steps: []step{
+				{raise: AlertCrashLoop},
+				{raise: AlertUnhealthy},
+				{at: time.Hour},
+			},
+		},
+		{
+			name:  "disabled",
+			rules: AlertRules{Disabled: true, Conditions: alertConditions, For: "0s", Repeat: "1h"},
+			steps: []step{
+				{raise: AlertCrashLoop},
+				{at: time.Hour},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorder := make(recordingNotifier, 10)
+			engine := &alertEngine{rules: test.rules, notifiers: map[string]notifier{}, active: map[string]*activeAlert{},
+				statuses: map[string]*NotifierStatus{}}
+			engine.add("recorder", "test", recorder)
+			app := &Application{ID: "app", directory: "does-not-exist"}
+
+			start := time.Now()
+			for i, step := range test.steps {
+				name := fmt.Sprintf("step %v", i+1)
+				switch {
+				case step.raise != "":
+					engine.raise(app, step.raise, "failing")
+				case step.resolve != "":
+					engine.resolve(app, step.resolve)
+				default:
+					// The raise comes a moment after start
+					engine.evaluate(start.Add(step.at + time.Second))
+				}
+				recorder.expect(t, name, step.notifying...)
+			}
+		})
+	}
+}
+
+func TestAlertRulesOverride(t *testing.T) {
+	global := AlertRules{Conditions: alertConditions, Notify: []string{"slack"}, For: "1m", Repeat: "4h"}
+	got := global.override(AlertRules{Notify: []string{"mail"}, For: "5m"})
+	if fmt.Sprint(got.Conditions) != fmt.Sprint(alertConditions) || fmt.Sprint(got.Notify) != "[mail]" ||
+		got.For != "5m" || got.Repeat != "4h" || got.Disabled {
+		t.Errorf("got %+v", got)
+	}
+	if !global.override(AlertRules{Disabled: true}).Disabled {
+		t.Error("the application can't disable its alerts")
+	}
+}
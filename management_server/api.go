@@ -12,16 +12,20 @@ import (
 	"gopkg.in/ini.v1"
 	"io/ioutil"
 	"log"
-	"net/http"
+	"net"
+	"net/url"
 	"os"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Configuration struct {
 	DNS struct {
 		Zone    string `json:"zone"`
+		Account string `json:"account"`
 		Domain  string `json:"domain"`
 		Proxied bool   `json:"proxied"`
 	} `json:"dns"`
@@ -53,15 +57,20 @@ type API struct {
 	Config   *ini.File
 	CaddyAPI string
 
-	reserved map[int]interface{}
-	configs  map[string]Configuration
+	apps        *Registry
+	store       *Store
+	credentials *CredentialStore
+	forwarders  []*forwarder
+	alerts      *alertEngine
 
-	deployed map[string]*Application
+	tokens     map[string]*bandaid.TokenVerification
+	tokensLock sync.RWMutex
 }
 
 func (api *API) BuildAPI() *gin.Engine {
 	engine := gin.Default()
 
+	engine.GET("/metrics", api.MANAGER_GET_METRICS)
 	engine.GET("/", func(context *gin.Context) {
 		context.String(200, "bandaid-"+VERSION)
 	})
@@ -72,12 +81,30 @@ func (api *API) BuildAPI() *gin.Engine {
 		a.POST("/launch/:configId", api.POST_INSTALL_CONFIG)
 	}
 
+	// DNS-01 challenges delegated by lego/Caddy's httpreq provider
+	if handlers, err := api.ACMEHandlers(); err == nil {
+		acme := engine.Group("/acme/httpreq", handlers...)
+		{
+			acme.POST("/present", api.ACME_POST_PRESENT)
+			acme.POST("/cleanup", api.ACME_POST_CLEANUP)
+		}
+	} else {
+		log.Println("[acme] DNS-01 challenges are disabled,", err)
+	}
+
 	manager := engine.Group("/manager")
 	{
 		manager.GET("/app/:serviceId/stdout", api.MANAGER_GET_STDOUT)
 		manager.GET("/app/:serviceId/stderr", api.MANAGER_GET_STDERR)
+		manager.GET("/app/:serviceId/build", api.MANAGER_GET_BUILDLOG)
 		manager.GET("/app/:serviceId/events", api.MANAGER_GET_EVENTS)
+		manager.GET("/app/:serviceId/stream", api.MANAGER_GET_STREAM)
 		manager.GET("/app/:serviceId/reload", api.MANAGER_GET_RELOAD)
+		manager.POST("/app/:serviceId/rollback", api.MANAGER_POST_ROLLBACK)
+		manager.GET("/app/:serviceId/deployments", api.MANAGER_GET_DEPLOYMENTS)
+		manager.GET("/app/:serviceId/deliveries", api.MANAGER_GET_DELIVERIES)
+		manager.POST("/app/:serviceId/deliveries/:deliveryId/retry", api.MANAGER_POST_REDELIVER)
+		manager.GET("/app/:serviceId/health/history", api.MANAGER_GET_HEALTH_HISTORY)
 		manager.GET("/app/:serviceId/config", api.MANAGER_GET_CONFIG)
 		manager.POST("/app/:serviceId/eventurl", api.MANAGER_POST_EVENTURL)
 		manager.DELETE("/app/:serviceId", api.MANAGER_DELETE_APPLICATION)
@@ -85,6 +112,14 @@ func (api *API) BuildAPI() *gin.Engine {
 		manager.POST("/app", api.MANAGER_POST_DEPLOY)
 		manager.POST("/validate", api.MANAGER_GET_VALIDATE)
 		manager.GET("/apps", api.MANAGER_GET_APPS)
+		manager.GET("/logs/search", api.MANAGER_GET_LOG_SEARCH)
+		manager.GET("/forwarders", api.MANAGER_GET_FORWARDERS)
+		manager.GET("/alerts", api.MANAGER_GET_ALERTS)
+		manager.GET("/dns/tokens", api.MANAGER_GET_DNS_TOKENS)
+		manager.GET("/credentials", api.MANAGER_GET_CREDENTIALS)
+		manager.POST("/credentials/ssh", api.MANAGER_POST_DEPLOY_KEY)
+		manager.POST("/credentials/https", api.MANAGER_POST_GIT_TOKEN)
+		manager.DELETE("/credentials/:credentialId", api.MANAGER_DELETE_CREDENTIAL)
 
 		// Webhook Execution
 		manager.POST("/webhook/gitlab", api.MANAGER_POST_WEBHOOK_GITLAB)
@@ -94,8 +129,7 @@ func (api *API) BuildAPI() *gin.Engine {
 
 type AppStatus struct {
 	Application *Application `json:"application"`
-	Status      interface{}  `json:"status"`
-	Error       interface{}  `json:"error"`
+	Status      HealthStatus `json:"status"`
 }
 
 func (api *API) MANAGER_POST_WEBHOOK_GITLAB(ctx *gin.Context) {
@@ -113,7 +147,7 @@ func (api *API) MANAGER_POST_WEBHOOK_GITLAB(ctx *gin.Context) {
 	}
 
 	// Look for the app
-	for _, app := range api.deployed {
+	for _, app := range api.apps.Applications() {
 		app_urls := strings.Join(
 			[]string{payload.Repository.URL, payload.Repository.GitHTTPURL, payload.Repository.GitSSHURL},
 			"",
@@ -126,89 +160,131 @@ func (api *API) MANAGER_POST_WEBHOOK_GITLAB(ctx *gin.Context) {
 		_, branch := path.Split(payload.Ref)
 		config, _ := app.Config()
 		if config.Repository.Branch == branch && config.Repository.ReloadOnPush {
-			err := app.Reload()
-			if err != nil {
-				log.Println("failed to reload application", err)
-			}
+			// Queue behind whatever is running on the app instead of dropping the push
+			go func(app *Application) {
+				done := app.Queue("reload")
+				defer done()
+				if err := app.Reload(Trigger{Source: SourceWebhook, User: payload.UserName}); err != nil {
+					log.Println("failed to reload application", err)
+				}
+			}(app)
 		}
 	}
 	ctx.JSON(200, gin.H{"ok": true})
 }
 
+// MANAGER_GET_APPS lists the applications with their cached health, it never waits on a health check.
 func (api *API) MANAGER_GET_APPS(ctx *gin.Context) {
-
 	statuses := []*AppStatus{}
-	for id, application := range api.deployed {
-		app := &AppStatus{Application: application}
-		statuses = append(statuses, app)
-		resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://" + manager_address + "/api/status/" + id)
-		if err != nil {
-			if resp != nil {
-				add_context, _ := ioutil.ReadAll(resp.Body)
-				app.Error = fmt.Errorf("Health check failed: %v", add_context)
-			} else {
-				app.Error = fmt.Errorf("Failed to call status: %v", err)
-			}
-			continue
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&app.Status); err != nil {
-			app.Error = fmt.Errorf("Failed to decode status body: %v", err)
-		}
+	for _, application := range api.apps.Applications() {
+		statuses = append(statuses, &AppStatus{Application: application, Status: application.HealthStatus()})
 	}
 	ctx.JSON(200, statuses)
 }
 
 func (api *API) MANAGER_GET_APPSTATUS(ctx *gin.Context) {
 	type AppStatus struct {
-		Application *Application `json:"application"`
-		Status      interface{}  `json:"status"`
-		Error       interface{}  `json:"error"`
-	}
-	application, exists := api.deployed[ctx.Param("serviceId")]
+		Application *Application   `json:"application"`
+		State       string         `json:"state"`
+		StateSince  time.Time      `json:"state_since"`
+		Operation   string         `json:"operation,omitempty"`
+		Usage       *ResourceUsage `json:"usage,omitempty"`
+		UsageError  string         `json:"usage_error,omitempty"`
+		Status      HealthStatus   `json:"status"`
+	}
+	application, exists := api.apps.Application(ctx.Param("serviceId"))
 	if !exists {
 		ctx.String(404, "App not found: "+ctx.Param("serviceId"))
 		return
 	}
-	app := &AppStatus{Application: application}
-	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://" + manager_address + "/api/status/" + application.ID)
-	if err != nil {
-		if resp != nil {
-			add_context, _ := ioutil.ReadAll(resp.Body)
-			app.Error = fmt.Errorf("Health check failed: %v", add_context)
-		} else {
-			app.Error = fmt.Errorf("Failed to call status: %v", err)
-		}
-	}
-	if err := json.NewDecoder(resp.Body).Decode(&app.Status); err != nil {
-		app.Error = fmt.Errorf("Failed to decode status body: %v", err)
+	snapshot := application.snapshot()
+	operation, _ := application.operations.Current()
+	app := &AppStatus{
+		Application: application,
+		State:       snapshot.State,
+		StateSince:  snapshot.StateSince,
+		Operation:   operation,
+		Status:      application.HealthStatus(),
+	}
+	if usage, err := application.Usage(); err != nil {
+		app.UsageError = err.Error()
+	} else {
+		app.Usage = usage
 	}
-
 	ctx.JSON(200, app)
 }
 
 func (api *API) MANAGER_GET_RELOAD(ctx *gin.Context) {
-	service, exists := api.deployed[ctx.Param("serviceId")]
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
 	if !exists {
 		IsError(404, fmt.Errorf("service not found"), ctx)
 		return
 	}
-	if IsError(500, service.Reload(), ctx) {
+	done, ok := beginOperation(service, "reload", ctx)
+	if !ok {
 		return
 	}
-	ctx.String(200, "OK")
+	// A blue/green reload waits for the new revision to build and become healthy, its progress and outcome
+	// are reported through the application's events
+	trigger := triggerFrom(ctx)
+	go func() {
+		defer done()
+		if err := service.Reload(trigger); err != nil {
+			log.Println("failed to reload application", err)
+		}
+	}()
+	ctx.String(200, "Reloading, follow the application's events for progress")
 }
 
-func (api *API) MANAGER_GET_STDOUT(ctx *gin.Context) {
-	service, exists := api.deployed[ctx.Param("serviceId")]
+func (api *API) MANAGER_POST_ROLLBACK(ctx *gin.Context) {
+	type Body struct {
+		Commit     string `json:"commit"`
+		Deployment int    `json:"deployment"`
+	}
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+	// Without a body it rolls back to the previous successful deployment
+	body := &Body{}
+	if ctx.Request.ContentLength != 0 && IsError(400, ctx.ShouldBindJSON(body), ctx) {
+		return
+	}
+	commit, err := service.rollbackTarget(body.Commit, body.Deployment)
+	if IsError(400, err, ctx) {
+		return
+	}
+
+	done, ok := beginOperation(service, "rollback", ctx)
+	if !ok {
+		return
+	}
+	trigger := triggerFrom(ctx)
+	go func() {
+		defer done()
+		if err := service.Rollback(commit, trigger); err != nil {
+			log.Println("failed to roll back application", err)
+		}
+	}()
+	ctx.JSON(200, gin.H{"commit": commit})
+}
+
+func (api *API) MANAGER_GET_DEPLOYMENTS(ctx *gin.Context) {
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
 	if !exists {
 		IsError(404, fmt.Errorf("service not found"), ctx)
 		return
 	}
-	ctx.String(200, service.log.String())
+	ctx.JSON(200, service.DeploymentList())
+}
+
+func (api *API) MANAGER_GET_STDOUT(ctx *gin.Context) {
+	api.serveLogs(ctx, StreamStdout)
 }
 
 func (api *API) MANAGER_GET_CONFIG(ctx *gin.Context) {
-	service, exists := api.deployed[ctx.Param("serviceId")]
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
 	if !exists {
 		IsError(404, fmt.Errorf("service not found"), ctx)
 		return
@@ -221,27 +297,22 @@ func (api *API) MANAGER_GET_CONFIG(ctx *gin.Context) {
 	}
 }
 
-func (api *API) MANAGER_GET_STDERR(ctx *gin.Context) {
-	service, exists := api.deployed[ctx.Param("serviceId")]
+func (api *API) MANAGER_GET_BUILDLOG(ctx *gin.Context) {
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
 	if !exists {
 		IsError(404, fmt.Errorf("service not found"), ctx)
 		return
 	}
-	ctx.String(200, service.err.String())
+	ctx.String(200, service.build.String())
 }
 
-func (api *API) MANAGER_GET_EVENTS(ctx *gin.Context) {
-	service, exists := api.deployed[ctx.Param("serviceId")]
-	if !exists {
-		IsError(404, fmt.Errorf("service not found"), ctx)
-		return
-	}
-	ctx.JSON(200, service.Events)
+func (api *API) MANAGER_GET_STDERR(ctx *gin.Context) {
+	api.serveLogs(ctx, StreamStderr)
 }
 
 func (api *API) MANAGER_DELETE_APPLICATION(ctx *gin.Context) {
 	serviceID := ctx.Param("serviceId")
-	service, exists := api.deployed[serviceID]
+	service, exists := api.apps.Application(serviceID)
 
 	if !exists {
 		// Attempt to delete the folder if it exists
@@ -259,19 +330,39 @@ func (api *API) MANAGER_DELETE_APPLICATION(ctx *gin.Context) {
 		return
 	}
 
+	done, ok := beginOperation(service, "delete", ctx)
+	if !ok {
+		return
+	}
+	defer done()
+	// A queued delete may find the application already gone
+	if _, exists := api.apps.Application(serviceID); !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+
 	if IsError(500, service.Kill(), ctx) {
 		return
 	}
 
-	applicationPath := path.Join("app_data", serviceID)
-	if _, err := os.Stat(applicationPath); !os.IsNotExist(err) {
-		err = os.RemoveAll(applicationPath)
-		if err != nil {
-			IsError(500, fmt.Errorf("failed to delete existing path '%v' please manually delete it from the app_data folder", applicationPath), ctx)
-			return
+	if config, err := service.Config(); err == nil {
+		if err := api.RemoveEdgeSettings(config); err != nil {
+			log.Println("failed to remove cloudflare edge settings", err)
 		}
 	}
-	delete(api.deployed, serviceID)
+
+	if err := service.Destroy(); err != nil {
+		IsError(500, fmt.Errorf("failed to delete existing path '%v' please manually delete it from the app_data folder", service.Directory()), ctx)
+		return
+	}
+	api.apps.Remove(serviceID)
+	api.alerts.clear(serviceID)
+	service.removeOutbox()
+	service.removeEvents()
+	if config, exists := api.apps.RemoveConfig(serviceID); exists {
+		api.ReleaseHost(config.Caddy.Host)
+	}
+	api.Persist()
 	ctx.String(200, "OK")
 }
 
@@ -280,18 +371,24 @@ func (api *API) MANAGER_POST_DEPLOY(ctx *gin.Context) {
 	if IsError(400, ctx.BindJSON(app), ctx) {
 		return
 	}
-	hash := md5.Sum([]byte(app.Repository + app.SpecificConfig))
-	app.ID = hex.EncodeToString(hash[:])
+	app.ID = ApplicationID(app.Repository, app.SpecificConfig)
 
-	if _, exists := api.deployed[app.ID]; exists {
-		IsError(409, fmt.Errorf("resource already exists as '%v', please reload or delete the deployed application first", app.ID), ctx)
+	// Claim the ID before cloning so concurrent deploys of the same repository can't both go through
+	if IsError(409, api.apps.Add(app), ctx) {
 		return
 	}
+	done, _ := app.Begin("deploy")
+	defer done()
+	deployed := false
+	defer func() {
+		if !deployed {
+			// The clone may have saved the application already
+			api.apps.Remove(app.ID)
+			api.Persist()
+		}
+	}()
 
-	applicationPath := path.Join("app_data", app.ID)
-	if app.SpecificConfig != "" {
-		applicationPath += "." + strings.Replace(app.SpecificConfig, ".", "-", -1)
-	}
+	applicationPath := app.checkoutDirectory("")
 	if _, err := os.Stat(applicationPath); !os.IsNotExist(err) {
 		err = os.RemoveAll(applicationPath)
 		if err != nil {
@@ -300,7 +397,7 @@ func (api *API) MANAGER_POST_DEPLOY(ctx *gin.Context) {
 		}
 	}
 
-	if IsError(400, app.Clone(), ctx) {
+	if IsError(400, app.Clone(triggerFrom(ctx)), ctx) {
 		return
 	}
 
@@ -309,8 +406,9 @@ func (api *API) MANAGER_POST_DEPLOY(ctx *gin.Context) {
 		return
 	}
 
-	api.deployed[app.ID] = app
-	go app.Launch()
+	deployed = true
+	api.Persist()
+	app.Launch()
 	ctx.String(200, app.ID)
 }
 
@@ -323,7 +421,7 @@ func (api *API) MANAGER_GET_VALIDATE(ctx *gin.Context) {
 	hash := md5.Sum([]byte(app.Repository))
 	app.ID = fmt.Sprintf("_temp-%v", hex.EncodeToString(hash[:]))
 	defer app.Destroy()
-	if IsError(400, app.Clone(), ctx) {
+	if IsError(400, app.Clone(triggerFrom(ctx)), ctx) {
 		return
 	}
 
@@ -344,20 +442,25 @@ func (api *API) MANAGER_POST_EVENTURL(ctx *gin.Context) {
 		return
 	}
 
-	service := ctx.Param("configId")
-	app, exists := api.deployed[service]
+	service := ctx.Param("serviceId")
+	app, exists := api.apps.Application(service)
 	if !exists {
-		IsError(404, fmt.Errorf("config '%v' not found", service), ctx)
+		IsError(404, fmt.Errorf("service '%v' not found", service), ctx)
+		return
+	}
+	if _, err := url.ParseRequestURI(body.EventURL); err != nil {
+		IsError(400, fmt.Errorf("invalid event url: %v", err), ctx)
 		return
 	}
 
-	app.event_urls = append(app.event_urls, body.EventURL)
-	ctx.String(200, "OK")
+	app.add_event_url(body.EventURL)
+	api.Persist()
+	ctx.JSON(200, gin.H{"event_url": body.EventURL, "secret": app.webhookSecret()})
 }
 
 func (api *API) GET_STATUS(ctx *gin.Context) {
 	service := ctx.Param("configId")
-	config, exists := api.configs[service]
+	config, exists := api.apps.Config(service)
 	if !exists {
 		IsError(404, fmt.Errorf("config '%v' not found", service), ctx)
 		return
@@ -407,18 +510,16 @@ func (api *API) POST_INSTALL_CONFIG(ctx *gin.Context) {
 	// Caddy
 	log.Println("Setting up caddy configuration for", configId)
 	host := config.Caddy.Host
+	// Keep the host the service had before (e.g. across manager restarts) as long as nothing else took it
+	if previous, exists := api.apps.Config(configId); host == "" && exists && hostAvailable(previous.Caddy.Host) {
+		host = previous.Caddy.Host
+	}
 	if host == "" {
-		ports, err := freeport.GetFreePorts(100)
+		reserved, err := api.ReserveHost()
 		if IsError(500, err, ctx) {
 			return
 		}
-		for _, port := range ports {
-			if _, used := api.reserved[port]; !used {
-				host = fmt.Sprintf("localhost:%v", port)
-				api.reserved[port] = true
-				break
-			}
-		}
+		host = reserved
 	}
 	c := bandaid.AutoCaddy(configId)
 	c.CaddyAPI = fmt.Sprintf("http://%v", caddy_address)
@@ -435,20 +536,20 @@ func (api *API) POST_INSTALL_CONFIG(ctx *gin.Context) {
 	config.Caddy.Host = host
 
 	// Cloudflare/DNS
-	if config.DNS.Zone != "" {
+	if config.DNS.Zone != "" || config.DNS.Domain != "" {
 		log.Println("Setting up cloudflare for", configId)
-		token := api.Config.Section("cloudflare").Key(config.DNS.Zone).String()
-		if token == "" {
-			IsError(400, fmt.Errorf("there is no token saved for %v in the configuration file", config.DNS.Zone), ctx)
+		token, err := api.CloudflareToken(config.DNS.Zone, config.DNS.Domain)
+		if IsError(400, err, ctx) {
 			return
 		}
 		auto := bandaid.AutoCloudflare(token).
 			SetZone(config.DNS.Zone).
+			SetAccount(config.DNS.Account).
 			SetDomain(config.DNS.Domain).
 			Proxied(config.DNS.Proxied)
 
 		// make sure we're not overwriting someone's currently running service
-		for cfid, configuration := range api.configs {
+		for cfid, configuration := range api.apps.Configs() {
 			fmt.Println(configuration.DNS.Domain, config.DNS.Domain, cfid, configId)
 			if configuration.DNS.Domain == config.DNS.Domain && cfid != configId {
 				if !config.Force {
@@ -490,12 +591,69 @@ func (api *API) POST_INSTALL_CONFIG(ctx *gin.Context) {
 		}
 	}
 
-	api.configs[configId] = *config
+	api.apps.SetConfig(configId, *config)
+	api.Persist()
 	ctx.JSON(200, gin.H{
 		"host": host,
 	})
 }
 
+func hostAvailable(host string) bool {
+	if host == "" {
+		return false
+	}
+	listener, err := net.Listen("tcp", host)
+	if err != nil {
+		return false
+	}
+	_ = listener.Close()
+	return true
+}
+
+// ReserveHost picks a free local port that isn't reserved by another service and reserves it.
+func (api *API) ReserveHost() (string, error) {
+	ports, err := freeport.GetFreePorts(100)
+	if err != nil {
+		return "", err
+	}
+	for _, port := range ports {
+		if api.apps.Reserve(port) {
+			return fmt.Sprintf("localhost:%v", port), nil
+		}
+	}
+	return "", fmt.Errorf("no free ports left to reserve")
+}
+
+func (api *API) ReleaseHost(host string) {
+	if _, port, err := net.SplitHostPort(host); err == nil {
+		if p, err := strconv.Atoi(port); err == nil {
+			api.apps.Release(p)
+		}
+	}
+}
+
+// SwitchUpstream points the application's Caddy route at a new host and returns the host it replaced.
+func (api *API) SwitchUpstream(configId, host string) (string, error) {
+	config, exists := api.apps.Config(configId)
+	if !exists {
+		return "", fmt.Errorf("no launch configuration for %v", configId)
+	}
+	c := bandaid.AutoCaddy(configId)
+	c.CaddyAPI = fmt.Sprintf("http://%v", caddy_address)
+	c.SetDomain(bandaid.DomainConfig{
+		Host: config.Caddy.Domains,
+	})
+	if err := c.Switch(host); err != nil {
+		return "", err
+	}
+
+	previous := config.Caddy.Host
+	config.Caddy.Host = host
+	api.apps.SetConfig(configId, config)
+	api.Persist()
+	return previous, nil
+}
+
 func (api *API) RemoveCFConfig(configId string, auto *bandaid.CloudflareConfig, config *Configuration, reload bool) (skipped bool, err error) {
 	if b, err := ioutil.ReadFile(path.Join("configs", configId)); err == nil {
 		rec := bandaid.DNSRecord{}
@@ -505,7 +663,8 @@ func (api *API) RemoveCFConfig(configId string, auto *bandaid.CloudflareConfig,
 		}
 		if !reload {
 			machine_ip, _ := bandaid.GetIP()
-			if config.DNS.Zone == rec.ZoneName && config.DNS.Domain == rec.Name && machine_ip == rec.Content {
+			sameZone := config.DNS.Zone == "" || config.DNS.Zone == rec.ZoneName
+			if sameZone && config.DNS.Domain == rec.Name && machine_ip == rec.Content {
 				log.Println("Skipping config removal, records are identical")
 				return true, nil
 			}
@@ -514,3 +673,45 @@ func (api *API) RemoveCFConfig(configId string, auto *bandaid.CloudflareConfig,
 	}
 	return false, nil
 }
+
+// CloudflareToken finds the token for a zone in the [cloudflare] section of config.ini. When the zone is not
+// given, the token saved under the longest zone name that the domain belongs to is used.
+func (api *API) CloudflareToken(zone, domain string) (string, error) {
+	section := api.Config.Section("cloudflare")
+	if zone != "" {
+		token := section.Key(zone).String()
+		if token == "" {
+			return "", fmt.Errorf("there is no token saved for %v in the configuration file", zone)
+		}
+		return token, nil
+	}
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	token, matched := "", ""
+	for _, key := range section.Keys() {
+		name := strings.ToLower(key.Name())
+		if domain != name && !strings.HasSuffix(domain, "."+name) {
+			continue
+		}
+		if len(name) > len(matched) {
+			token, matched = key.String(), name
+		}
+	}
+	if token == "" {
+		return "", fmt.Errorf("there is no token saved for a zone containing %v in the configuration file", domain)
+	}
+	return token, nil
+}
+
+// beginOperation starts an operation on the application, responding with 409 if another one is in progress.
+// Passing ?wait=true queues the request behind the running operation instead.
+func beginOperation(app *Application, operation string, ctx *gin.Context) (done func(), ok bool) {
+	if ctx.Query("wait") == "true" {
+		return app.Queue(operation), true
+	}
+	done, err := app.Begin(operation)
+	if IsError(409, err, ctx) {
+		return nil, false
+	}
+	return done, true
+}
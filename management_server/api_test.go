@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFailedDeployIsForgotten(t *testing.T) {
+	directory := testAPI(t, "")
+	w := httptest.NewRecorder()
+	api.BuildAPI().ServeHTTP(w, httptest.NewRequest("POST", "/manager/app",
+		strings.NewReader(`{"repository": "`+directory+`/missing.git"}`)))
+	if w.Code != 400 {
+		t.Fatalf("deploying a missing repository answered %v: %v", w.Code, w.Body.String())
+	}
+
+	if apps := api.apps.Applications(); len(apps) != 0 {
+		t.Errorf("%v applications are still registered", len(apps))
+	}
+	state, err := api.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Applications) != 0 {
+		t.Errorf("the failed deploy was saved: %v", state.Applications)
+	}
+}
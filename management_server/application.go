@@ -2,38 +2,85 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/imroc/req"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"path"
-	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
-type AppEvent struct {
-	Timestamp time.Time `json:"timestamp"`
-	Error     string    `json:"error,omitempty"`
-	Message   string    `json:"message,omitempty"`
-}
-
 type Application struct {
-	Repository     string      `json:"repository"`
-	ID             string      `json:"id"`
-	Events         []*AppEvent `json:"events"`
-	SpecificConfig string      `json:"config"`
-	Branch         string      `json:"branch"`
+	Repository     string        `json:"repository"`
+	ID             string        `json:"id"`
+	Events         []*AppEvent   `json:"events"`
+	SpecificConfig string        `json:"config"`
+	Branch         string        `json:"branch"`
+	Ref            string        `json:"ref"`
+	Commit         string        `json:"commit"`
+	Deployments    []*Deployment `json:"deployments"`
+	State          string        `json:"state"`
+	StateSince     time.Time     `json:"state_since"`
+	Restarts       int           `json:"restarts"`
+	LastExit       *ExitStatus   `json:"last_exit,omitempty"`
 
 	directory  string
-	cmd        *exec.Cmd
-	env        []string
-	log        bytes.Buffer
-	err        bytes.Buffer
+	stdout     *logSink
+	stderr     *logSink
+	streams    *streamHub
+	build      outputBuffer
 	event_urls []string
+	health     *healthState
+	// deliveries is the outbox of the events sent to event_urls, signed with webhook_secret
+	deliveries     *outbox
+	webhook_secret string
+	// events_logged is how many events the event log has, last_event_id the ID of the last event ever logged
+	events_logged int
+	last_event_id int64
+
+	// current is the running revision, candidate the one a blue/green reload is bringing up
+	current   *instance
+	candidate *instance
+	// deployment is waiting for the next launch to finish it
+	deployment *Deployment
+
+	// lock guards the exported fields, the directory, the instances, the log sinks, the hub, event_urls and
+	// the webhooks
+	lock       sync.Mutex
+	operations operationLock
+}
+
+// outputBuffer collects the output of a build. A candidate's build may run while the running revision's
+// output is read, so it's safe for concurrent use.
+type outputBuffer struct {
+	lock   sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (b *outputBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.Write(p)
+}
+
+func (b *outputBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buffer.String()
+}
+
+func (b *outputBuffer) Reset() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.buffer.Reset()
 }
 
 type BandaidFile struct {
@@ -42,7 +89,18 @@ type BandaidFile struct {
 		ID            string     `toml:"id"`
 		Name          string     `toml:"name"`
 		Run           [][]string `toml:"run"`
-		EventURL      string     `toml:"event_urls"`
+		Build         [][]string `toml:"build"`
+		Start         []string   `toml:"start"`
+		BuildTimeout  string     `toml:"build_timeout"`
+		StopSignal    string     `toml:"stop_signal"`
+		StopTimeout   string     `toml:"stop_timeout"`
+		Restart       string     `toml:"restart"`
+		MaxRestarts   int        `toml:"max_restarts"`
+		RestartDelay  string     `toml:"restart_delay"`
+		HealthTimeout string     `toml:"health_timeout"`
+		DrainTimeout  string     `toml:"drain_timeout"`
+		EventURL      string     `toml:"event_url"`
+		EventURLs     string     `toml:"event_urls"` // the legacy key, event_url is the new one
 		Health        string     `toml:"health_endpoint"`
 		Envs          []string   `toml:"envs"`
 		BaseDirectory string     `toml:"base_dir"`
@@ -55,14 +113,152 @@ type BandaidFile struct {
 
 	DNS struct {
 		Zone    string `toml:"zone"`
+		Account string `toml:"account"`
 		Domain  string `toml:"domain"`
 		Proxied bool   `toml:"proxied"`
+
+		Cloudflare CloudflareEdge `toml:"cloudflare"`
 	} `toml:"dns"`
 
 	Caddy struct {
 		Domains []string `toml:"domains"`
 		Host    string   `toml:"host"`
 	} `toml:"caddy"`
+
+	Runtime struct {
+		Type       string `toml:"type"`
+		Image      string `toml:"image"`
+		Dockerfile string `toml:"dockerfile"`
+		Port       int    `toml:"port"`
+	} `toml:"runtime"`
+
+	Limits Limits      `toml:"limits"`
+	Logs   LogFormat   `toml:"logs"`
+	Health HealthCheck `toml:"health"`
+	Alerts AlertRules  `toml:"alerts"`
+
+	Metrics struct {
+		Path string `toml:"path"`
+	} `toml:"metrics"`
+}
+
+// CloudflareEdge is the [dns.cloudflare] table of a Bandaidfile, applied after the application is up.
+type CloudflareEdge struct {
+	SSL           string   `toml:"ssl"`
+	Purge         bool     `toml:"purge"`
+	PurgePrefixes []string `toml:"purge_prefixes"`
+
+	Redirects []struct {
+		Path   string `toml:"path"`
+		To     string `toml:"to"`
+		Status int    `toml:"status"`
+	} `toml:"redirects"`
+
+	Cache []struct {
+		Path    string `toml:"path"`
+		EdgeTTL int64  `toml:"edge_ttl"`
+	} `toml:"cache"`
+}
+
+func (edge CloudflareEdge) Empty() bool {
+	return edge.SSL == "" && !edge.Purge && len(edge.PurgePrefixes) == 0 && len(edge.Redirects) == 0 && len(edge.Cache) == 0
+}
+
+func ApplicationID(repository, config string) string {
+	hash := md5.Sum([]byte(repository + config))
+	return hex.EncodeToString(hash[:])
+}
+
+// snapshot returns a copy of the application that's safe to read without holding the lock.
+func (app *Application) snapshot() *Application {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	deployments := make([]*Deployment, len(app.Deployments))
+	for i, deployment := range app.Deployments {
+		copied := *deployment
+		deployments[i] = &copied
+	}
+	return &Application{
+		Repository:     app.Repository,
+		ID:             app.ID,
+		Events:         append([]*AppEvent{}, app.Events...),
+		SpecificConfig: app.SpecificConfig,
+		Branch:         app.Branch,
+		Ref:            app.Ref,
+		Commit:         app.Commit,
+		Deployments:    deployments,
+		State:          app.State,
+		StateSince:     app.StateSince,
+		Restarts:       app.Restarts,
+		LastExit:       app.LastExit,
+		directory:      app.directory,
+		event_urls:     append([]string{}, app.event_urls...),
+		webhook_secret: app.webhook_secret,
+	}
+}
+
+// MarshalJSON leaves the events out but the last one, they're paged through with /manager/app/:serviceId/events.
+func (app *Application) MarshalJSON() ([]byte, error) {
+	type plain Application
+	snapshot := app.snapshot()
+	var last *AppEvent
+	if len(snapshot.Events) > 0 {
+		last = snapshot.Events[len(snapshot.Events)-1]
+	}
+	return json.Marshal(struct {
+		*plain
+		Events    []*AppEvent `json:"events,omitempty"`
+		LastEvent *AppEvent   `json:"last_event,omitempty"`
+	}{plain: (*plain)(snapshot), LastEvent: last})
+}
+
+func (app *Application) EventList() []*AppEvent {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	return append([]*AppEvent{}, app.Events...)
+}
+
+// Commands returns the build steps and the service command. Bandaidfiles that only have 'run' use every
+// command but the last one as a build step. Containers can do without a service command and run their
+// image's default one. It also checks the log format, the health check and the alert rules, so a Bandaidfile with a
+// broken one isn't deployed.
+func (config *BandaidFile) Commands() (build [][]string, start []string, err error) {
+	if err := config.Logs.Validate(); err != nil {
+		return nil, nil, err
+	}
+	if err := config.Health.Validate(config.Runtime.Type); err != nil {
+		return nil, nil, err
+	}
+	if err := config.Alerts.Validate(); err != nil {
+		return nil, nil, err
+	}
+	switch config.Application.Restart {
+	case "", RestartNever, RestartOnFailure, RestartAlways:
+	default:
+		return nil, nil, fmt.Errorf("unknown restart policy '%v', use never, on-failure or always",
+			config.Application.Restart)
+	}
+	build, start = config.Application.Build, config.Application.Start
+	if len(start) == 0 && len(config.Application.Run) > 0 {
+		run := config.Application.Run
+		build, start = run[:len(run)-1], run[len(run)-1]
+	}
+	if len(start) == 0 && config.Runtime.Type != RuntimeContainer {
+		return nil, nil, fmt.Errorf("no service command, add a 'start' entry to the Bandaidfile")
+	}
+	for i, commands := range build {
+		if len(commands) == 0 {
+			return nil, nil, fmt.Errorf("build step %v is empty", i+1)
+		}
+	}
+	return build, start, nil
+}
+
+func (config *BandaidFile) BuildTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(config.Application.BuildTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return 30 * time.Minute
 }
 
 func (app *Application) Log_Eventf(format string, msgs ...interface{}) {
@@ -72,10 +268,29 @@ func (app *Application) Log_Eventf(format string, msgs ...interface{}) {
 func (app *Application) Log_Event(message string) {
 	app.add_event(&AppEvent{
 		Timestamp: time.Now(),
+		Kind:      EventMessage,
 		Message:   message,
 	})
 }
 
+// Log_Kindf logs an event of the given kind.
+func (app *Application) Log_Kindf(kind string, format string, msgs ...interface{}) {
+	app.add_event(&AppEvent{
+		Timestamp: time.Now(),
+		Kind:      kind,
+		Message:   fmt.Sprintf(format, msgs...),
+	})
+}
+
+// Log_KindErrorf logs an error of the given kind.
+func (app *Application) Log_KindErrorf(kind string, format string, msgs ...interface{}) {
+	app.add_event(&AppEvent{
+		Timestamp: time.Now(),
+		Kind:      kind,
+		Error:     fmt.Errorf(format, msgs...).Error(),
+	})
+}
+
 func (app *Application) Log_Errorf(format string, msgs ...interface{}) {
 	app.Log_Error(fmt.Errorf(format, msgs...))
 }
@@ -83,88 +298,132 @@ func (app *Application) Log_Errorf(format string, msgs ...interface{}) {
 func (app *Application) Log_Error(err error) {
 	app.add_event(&AppEvent{
 		Timestamp: time.Now(),
+		Kind:      EventError,
 		Error:     fmt.Sprintf("%v", err.Error()),
 	})
 }
 
+// add_event records the event, saves it to the event log and sends it to the streams, forwarders and webhooks.
 func (app *Application) add_event(event *AppEvent) {
-	// TODO: Do some magical logging stuff here
-	var b bytes.Buffer
-	if json.NewEncoder(&b).Encode(event) != nil {
-		for _, event_url := range app.event_urls {
-			go (&http.Client{Timeout: time.Second * 5}).Post(event_url, "application/json", &b)
-		}
+	event.Message, event.Error = redact(event.Message), redact(event.Error)
+	for name, value := range event.Fields {
+		event.Fields[name] = redact(value)
 	}
-
-	app.Events = append(app.Events, event)
+	event.normalize()
+	settings := api.eventSettings()
+	app.lock.Lock()
+	app.last_event_id++
+	event.ID = app.last_event_id
+	app.Events = settings.retain(append(app.Events, event), event.Timestamp)
+	app.writeEvent(event, settings)
+	app.lock.Unlock()
+	app.publishEvent(event)
+	api.deliver(app, event)
 }
 
-func (app *Application) Clone() error {
-	app.Log_Eventf("Cloning from repository %v", app.Repository)
-	app.directory = path.Join("app_data", app.ID)
-	if app.SpecificConfig != "" {
-		app.directory += "." + strings.Replace(app.SpecificConfig, ".", "-", -1)
+func (app *Application) add_event_url(event_url string) {
+	if event_url == "" {
+		return
 	}
-	app.env = os.Environ()
-
-	args := []string{"clone"}
-	if app.Branch != "" {
-		args = append(args, "--branch", app.Branch)
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	for _, existing := range app.event_urls {
+		if existing == event_url {
+			return
+		}
+	}
+	app.event_urls = append(app.event_urls, event_url)
+	if app.webhook_secret == "" {
+		app.webhook_secret = randomHex(32)
 	}
-	args = append(args, app.Repository, app.directory)
+}
 
-	b, err := exec.Command("git", args...).CombinedOutput()
+func (app *Application) Clone(trigger Trigger) error {
+	app.setState(StateCloning)
+	app.Log_Eventf("Cloning from repository %v", app.Repository)
+	directory := app.checkoutDirectory("")
+	app.lock.Lock()
+	app.directory = directory
+	app.lock.Unlock()
+
+	deployment := app.beginDeployment(trigger, false)
+	err := app.cloneInto(directory)
+	if err == nil {
+		err = app.checkout(directory, "", deployment)
+	}
 	if err != nil {
-		return fmt.Errorf("%v: %v", string(b), err)
+		app.setState(StateFailed)
+		app.finishDeployment(deployment, err)
+		return err
 	}
+	app.lock.Lock()
+	app.deployment = deployment
+	app.lock.Unlock()
 	return nil
 }
 
+// Destroy removes the application's checkout and logs.
 func (app *Application) Destroy() error {
-	if _, err := os.Stat(app.directory); !os.IsNotExist(err) {
-		err = os.RemoveAll(app.directory)
+	directory := app.Directory()
+	if _, err := os.Stat(directory); !os.IsNotExist(err) {
+		err = os.RemoveAll(directory)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+	return app.removeLogs()
 }
 
+// Kill stops the running revision, and a candidate if a reload is bringing one up, and waits for them to exit.
 func (app *Application) Kill() error {
 	log.Println("Killing process", app.ID)
 	app.Log_Eventf("Killing process %v", app.ID)
-	// ProcessState contains information about an exited process available after a call to Wait or Run.
-	if app.cmd != nil {
-		if app.cmd.ProcessState == nil {
-			return app.cmd.Process.Kill()
-		}
-		// Just do it anyways for safe measure
-		_ = app.cmd.Process.Kill()
+	app.lock.Lock()
+	current, candidate := app.current, app.candidate
+	changed := app.State != StateStopped
+	app.setStateLocked(StateStopped)
+	app.lock.Unlock()
+	if changed {
+		api.Persist()
 	}
-	return nil
-}
 
-func (app *Application) Reload() error {
-	app.Log_Eventf("Reloading application %v", app.ID)
-	err := app.Kill()
-	if err != nil {
+	if err := app.stopInstance(candidate); err != nil {
 		return err
 	}
+	return app.stopInstance(current)
+}
 
-	app.Log_Eventf("Pulling from repository %v", app.Repository)
-	cmd := exec.Command("git", "pull")
-	cmd.Dir = app.directory
-	log.Println("Pulling new files for", app.directory)
-	err = cmd.Run()
-	if err != nil {
-		return err
+// applyEdgeSettings waits for the service to respond and then applies its [dns.cloudflare] settings.
+func (app *Application) applyEdgeSettings(config *BandaidFile, host string) {
+	if config.DNS.Cloudflare.Empty() {
+		return
 	}
 
-	go app.Launch()
-	return nil
+	if err := app.waitReady(config, host, 10*time.Minute, nil); err != nil {
+		app.Log_Errorf("%v, skipping cloudflare edge settings", err)
+		return
+	}
+
+	if err := api.ApplyEdgeSettings(config); err != nil {
+		log.Println("Error", err)
+		app.Log_Errorf("failed to apply cloudflare edge settings: %v", err)
+		return
+	}
+	app.Log_Event("Applied cloudflare edge settings")
 }
 
 func (app *Application) Config() (*BandaidFile, error) {
+	return app.configAt(app.Directory())
+}
+
+// Directory is the checkout of the running revision, a blue/green reload moves it to the new one.
+func (app *Application) Directory() string {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	return app.directory
+}
+
+func (app *Application) configAt(directory string) (*BandaidFile, error) {
 	config := &BandaidFile{}
 
 	config_path := "Bandaid"
@@ -172,7 +431,7 @@ func (app *Application) Config() (*BandaidFile, error) {
 		config_path = app.SpecificConfig
 	}
 
-	_, err := toml.DecodeFile(path.Join(app.directory, config_path), config)
+	_, err := toml.DecodeFile(path.Join(directory, config_path), config)
 	if err != nil {
 		return nil, err
 	}
@@ -181,7 +440,36 @@ func (app *Application) Config() (*BandaidFile, error) {
 	return config, err
 }
 
+// Launch registers a new instance as the current one and starts it in the background. Callers holding an
+// operation call it before they finish, so a kill or reload that comes next always finds the instance.
 func (app *Application) Launch() {
+	app.lock.Lock()
+	inst := newInstance(app.directory)
+	app.current = inst
+	deployment := app.deployment
+	app.deployment = nil
+	app.lock.Unlock()
+	go app.run(inst, deployment)
+}
+
+// run configures, builds and supervises the instance.
+func (app *Application) run(inst *instance, deployment *Deployment) {
+	// Any early return below means the launch failed, unless the application was stopped meanwhile
+	launched := false
+	var err error
+	defer func() {
+		if launched {
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("launch cancelled, the application was stopped")
+		}
+		app.finishDeployment(deployment, err)
+		if !app.stopped(inst) {
+			app.setInstanceState(inst, StateFailed)
+		}
+	}()
+
 	config, err := app.Config()
 	app.Log_Event("Launching application")
 	log.Println("Reading configuration from Bandaidfile")
@@ -190,17 +478,34 @@ func (app *Application) Launch() {
 		app.Log_Errorf("failed to read configuration: %v", err)
 		return
 	}
-
-	app.event_urls = append(app.event_urls, config.Application.EventURL)
-
+	build, start, err := config.Commands()
+	if err != nil {
+		app.Log_Errorf("invalid configuration: %v", err)
+		return
+	}
+	runtime, err := runtimeFor(config)
+	if err != nil {
+		app.Log_Errorf("invalid configuration: %v", err)
+		return
+	}
+	app.lock.Lock()
+	inst.runtime = runtime
+	inst.stopSignal, inst.stopTimeout = config.StopSettings()
+	inst.metricsPath, inst.config = config.Metrics.Path, config
+	app.lock.Unlock()
+
+	app.add_event_url(config.Application.EventURL)
+	app.add_event_url(config.Application.EventURLs)
 	log.Println("setting up autoconfig")
 	resp, err := req.Post("http://localhost:2020/api/launch/"+app.ID, req.BodyJSON(Configuration{
 		DNS: struct {
 			Zone    string `json:"zone"`
+			Account string `json:"account"`
 			Domain  string `json:"domain"`
 			Proxied bool   `json:"proxied"`
 		}{
 			Zone:    config.DNS.Zone,
+			Account: config.DNS.Account,
 			Domain:  config.DNS.Domain,
 			Proxied: config.DNS.Proxied,
 		},
@@ -237,37 +542,115 @@ func (app *Application) Launch() {
 	}
 
 	if host.Error != "" {
+		err = fmt.Errorf("%v", host.Error)
 		log.Println("Error", host.Error)
 		app.Log_Errorf("failed to setup host from service: %v", host.Error)
 		return
 	}
 
-	app.env = append(app.env, fmt.Sprintf("APP_HOST=%v", host.Host))
-	app.env = append(app.env, config.Application.Envs...)
+	app.lock.Lock()
+	inst.host = host.Host
+	app.lock.Unlock()
+	command := app.command(inst, config)
 
 	log.Println("Executing service at:", host.Host)
 	app.Log_Eventf("Executing service at '%v'", host.Host)
-	for i, commands := range config.Application.Run {
-		app.Log_Eventf("Launching CMD (%v/%v) '%v'", i+1, len(config.Application.Run), commands)
-		cmd := exec.Command(commands[0], commands[1:]...)
-		cmd.Dir = app.directory
+	app.setInstanceState(inst, StateBuilding)
+	err = app.runBuild(config, build, inst, command)
+	if err != nil {
+		return
+	}
+	service, err := runtime.Service(app, inst, config, start)
+	if err != nil {
+		app.Log_Errorf("invalid configuration: %v", err)
+		return
+	}
 
-		if config.Application.BaseDirectory != "" {
-			cmd.Dir = path.Join(app.directory, config.Application.BaseDirectory)
-		}
+	if !app.setInstanceState(inst, StateStarting) {
+		return
+	}
+	launched = true
+	go app.confirmDeployment(deployment, config, host.Host, inst)
+	app.Log_Kindf(EventProcessStarted, "Starting service '%v'", service)
+	app.supervise(inst, config, func() *exec.Cmd {
+		return command(service)
+	})
+}
 
-		cmd.Env = app.env
-		app.cmd = cmd
+// command returns a constructor for commands that run in the instance's checkout, with the environment its
+// runtime gives them.
+func (app *Application) command(inst *instance, config *BandaidFile) func(commands []string) *exec.Cmd {
+	env := inst.runtime.Env(app, inst, config)
+	stdout, stderr := app.output()
+	if parser, err := config.Logs.parser(); err == nil {
+		stdout.SetParser(parser)
+		stderr.SetParser(parser)
+	}
+	app.lock.Lock()
+	directory := workDirectory(inst, config)
+	app.lock.Unlock()
 
-		cmd.Stdout = &app.log
-		cmd.Stderr = &app.err
+	return func(commands []string) *exec.Cmd {
+		cmd := exec.Command(commands[0], commands[1:]...)
+		cmd.Dir = directory
+		cmd.Env = env
+		cmd.Stdout = stdout
+		cmd.Stderr = stderr
+		return cmd
+	}
+}
 
-		err := cmd.Run()
+// runBuild prepares the instance's runtime and runs the build steps through it, killing a step once the build
+// timeout passes.
+func (app *Application) runBuild(config *BandaidFile, steps [][]string, inst *instance, command func([]string) *exec.Cmd) error {
+	app.build.Reset()
+	build, err := inst.runtime.Build(app, inst, config, steps)
+	if err != nil {
+		app.Log_Errorf("invalid configuration: %v", err)
+		return err
+	}
+	if err := inst.runtime.Prepare(app, inst, config); err != nil {
+		app.Log_Errorf("failed to set up the application's limits: %v", err)
+		return err
+	}
+	timeout := config.BuildTimeout()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for i, commands := range build {
+		app.Log_Eventf("Build step (%v/%v) '%v'", i+1, len(build), commands)
+		cmd := command(commands)
+		cmd.Stdout = &app.build
+		cmd.Stderr = &app.build
+		err := app.start(inst, cmd)
+		if err == nil {
+			// Kill the step once the build timeout passes
+			finished := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					if ctx.Err() != context.DeadlineExceeded {
+						return
+					}
+					_ = signalGroup(cmd, syscall.SIGKILL)
+					if err := inst.runtime.Cleanup(app, inst); err != nil {
+						log.Println("Error", err)
+					}
+				case <-finished:
+				}
+			}()
+			err = cmd.Wait()
+			close(finished)
+			app.exited(inst, cmd)
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			err = fmt.Errorf("build timed out after %v", timeout)
+		}
 		if err != nil {
 			log.Println("Error", err)
-			app.Log_Error(err)
-			return
+			app.Log_Errorf("build step '%v' failed: %v", commands, err)
+			return err
 		}
-		app.Log_Eventf("Finished CMD '%v'", commands)
+		app.Log_Eventf("Finished build step '%v'", commands)
 	}
+	return nil
 }
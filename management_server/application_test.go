@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCommandsValidatesRestart(t *testing.T) {
+	tests := []struct {
+		restart string
+		err     string
+	}{
+		{"", ""},
+		{RestartNever, ""},
+		{RestartOnFailure, ""},
+		{RestartAlways, ""},
+		{"onfailure", "unknown restart policy 'onfailure'"},
+		{"Always", "unknown restart policy 'Always'"},
+	}
+	for _, test := range tests {
+		config := &BandaidFile{}
+		config.Application.Start = []string{"true"}
+		config.Application.Restart = test.restart
+		_, _, err := config.Commands()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("restart = %q failed: %v", test.restart, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("restart = %q returned %v, want %q", test.restart, err, test.err)
+		}
+	}
+}
+
+func TestCommandsValidatesHealthCheck(t *testing.T) {
+	tests := []struct {
+		runtime string
+		health  string
+		err     string
+	}{
+		{RuntimeHost, HealthCommand, ""},
+		{"", HealthCommand, ""},
+		{RuntimeContainer, HealthHTTP, ""},
+		{RuntimeContainer, HealthCommand, "command health checks run on the host"},
+	}
+	for _, test := range tests {
+		config := &BandaidFile{}
+		config.Application.Start = []string{"true"}
+		config.Runtime.Type = test.runtime
+		config.Health.Type, config.Health.Command = test.health, []string{"true"}
+		_, _, err := config.Commands()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v check in %q failed: %v", test.health, test.runtime, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%v check in %q returned %v, want %q", test.health, test.runtime, err, test.err)
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -9,6 +10,9 @@ import (
 	"github.com/nokusukun/stemp"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"strings"
 	"time"
 )
 
@@ -48,40 +52,195 @@ func InitializeCommands() {
 
 	AddCommand(Command{
 		Name:        "events",
-		Usage:       "events [--app <application id>]",
-		Description: "Display the events for an application",
+		Usage:       "events [--app <application id> --kind <kinds> --severity <info|warning|error> --since <time> --until <time> --limit <events> --before <event id>]",
+		Description: "Display the events for an application, <kinds> is a comma separated list like deploy,process.exited",
 		Function:    cmdEvents,
 		Flags: func() *flag.FlagSet {
 			fs := flag.NewFlagSet("events", flag.ExitOnError)
 			fs.String("app", "", "Application ID")
+			fs.String("kind", "", "Only events of these kinds")
+			fs.String("severity", "", "Only events of this severity or above")
+			fs.String("since", "", "Only events since this time")
+			fs.String("until", "", "Only events until this time")
+			fs.Int("limit", 50, "Number of events to display")
+			fs.String("before", "", "Only events before this event ID, to page back")
 			return fs
 		},
 	})
 
 	AddCommand(Command{
 		Name:        "stdout",
-		Usage:       "stdout [--app <application id>]",
-		Description: "Display the application's stdout",
+		Usage:       "stdout [--app <application id> --tail <lines> --since <time> --until <time>]",
+		Description: "Display the application's stdout, <time> is RFC3339 or a duration like 15m",
 		Function:    cmdStdout,
 		Flags: func() *flag.FlagSet {
 			fs := flag.NewFlagSet("events", flag.ExitOnError)
 			fs.String("app", "", "Application ID")
+			fs.Int("tail", 0, "Number of lines to display from the end")
+			fs.String("since", "", "Only display lines written after this time")
+			fs.String("until", "", "Only display lines written before this time")
 			return fs
 		},
 	})
 
 	AddCommand(Command{
 		Name:        "stderr",
-		Usage:       "stderr [--app <application id>]",
-		Description: "Display the application's stderr",
+		Usage:       "stderr [--app <application id> --tail <lines> --since <time> --until <time>]",
+		Description: "Display the application's stderr, <time> is RFC3339 or a duration like 15m",
 		Function:    cmdStderr,
 		Flags: func() *flag.FlagSet {
 			fs := flag.NewFlagSet("events", flag.ExitOnError)
 			fs.String("app", "", "Application ID")
+			fs.Int("tail", 0, "Number of lines to display from the end")
+			fs.String("since", "", "Only display lines written after this time")
+			fs.String("until", "", "Only display lines written before this time")
 			return fs
 		},
 	})
 
+	AddCommand(Command{
+		Name:        "search",
+		Usage:       "search [--q <terms> --app <application id> --level <level> --since <time> --until <time> --limit <lines>]",
+		Description: "Search the output of every application, terms are words or field:value",
+		Function:    cmdSearch,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("search", flag.ExitOnError)
+			fs.String("q", "", "Words and field:value terms the lines have to contain")
+			fs.String("app", "", "Only search this application")
+			fs.String("level", "", "Only lines at this level or above")
+			fs.String("since", "", "Only lines written after this time")
+			fs.String("until", "", "Only lines written before this time")
+			fs.Int("limit", 100, "Number of lines to display from the end")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "logs",
+		Usage:       "logs [--app <application id> --follow --tail <entries> --streams <stdout,stderr,events>]",
+		Description: "Display the application's output and events interleaved, --follow keeps streaming them as they come",
+		Function:    cmdLogs,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("logs", flag.ExitOnError)
+			fs.String("app", "", "Application ID")
+			fs.Bool("follow", false, "Keep streaming, reconnecting where it left off")
+			fs.Int("tail", 20, "Number of recent entries to start with")
+			fs.String("streams", "stdout,stderr,events", "Streams to display")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "build",
+		Usage:       "build [--app <application id>]",
+		Description: "Display the application's build log",
+		Function:    cmdBuildLog,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("build", flag.ExitOnError)
+			fs.String("app", "", "Application ID")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "rollback",
+		Usage:       "rollback [--app <application id> --commit <sha> --deployment <id>]",
+		Description: "Roll an application back to a commit or deployment from its history, defaults to the previous successful deployment",
+		Function:    cmdRollback,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+			fs.String("app", "", "Application ID")
+			fs.String("commit", "", "Commit to roll back to")
+			fs.Int("deployment", 0, "Deployment to roll back to")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "deployments",
+		Usage:       "deployments [--app <application id>]",
+		Description: "Display the deployment history of an application",
+		Function:    cmdDeployments,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("deployments", flag.ExitOnError)
+			fs.String("app", "", "Application ID")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "health",
+		Usage:       "health [--app <application id> --limit <checks>]",
+		Description: "Display the uptime and the last health checks of an application",
+		Function:    cmdHealth,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("health", flag.ExitOnError)
+			fs.String("app", "", "Application ID")
+			fs.Int("limit", 20, "Number of checks to display from the end")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "deliveries",
+		Usage:       "deliveries [--app <application id> --status <pending|delivered|dead>]",
+		Description: "Display the event webhook deliveries of an application",
+		Function:    cmdDeliveries,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("deliveries", flag.ExitOnError)
+			fs.String("app", "", "Application ID")
+			fs.String("status", "", "Only deliveries with this status")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "alerts",
+		Usage:       "alerts",
+		Description: "Display the active alerts and the notifiers",
+		Function:    cmdAlerts,
+		Flags: func() *flag.FlagSet {
+			return flag.NewFlagSet("alerts", flag.ContinueOnError)
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "deploy-key",
+		Usage:       "deploy-key [--repo <git repository url> --rotate]",
+		Description: "Generate the SSH deploy key used to clone a private repository and print its public key, add it to the repository as a read-only deploy key",
+		Function:    cmdDeployKey,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("deploy-key", flag.ExitOnError)
+			fs.String("repo", "", "Clone URL")
+			fs.Bool("rotate", false, "Replace the existing key with a new one")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "git-token",
+		Usage:       "git-token [--repo <git repository url> --username <username> --token <token>]",
+		Description: "Store the HTTPS token used to clone a private repository, the token is read from stdin if --token is empty",
+		Function:    cmdGitToken,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("git-token", flag.ExitOnError)
+			fs.String("repo", "", "Clone URL")
+			fs.String("username", "", "Username the token belongs to (empty for x-access-token)")
+			fs.String("token", "", "Access token")
+			return fs
+		},
+	})
+
+	AddCommand(Command{
+		Name:        "credentials",
+		Usage:       "credentials",
+		Description: "Display the stored repository credentials",
+		Function:    cmdCredentials,
+		Flags: func() *flag.FlagSet {
+			return flag.NewFlagSet("credentials", flag.ContinueOnError)
+		},
+	})
+
 	AddCommand(Command{
 		Name:  "validate",
 		Usage: "validate [--repo <git repository url> --config <config>]",
@@ -98,13 +257,14 @@ func InitializeCommands() {
 
 	AddCommand(Command{
 		Name:        "deploy",
-		Usage:       "deploy [--repo <git repository url> --config <config>]",
-		Description: "Deploy an app. Specify <config> to use a different Bandaid file in the repository.",
+		Usage:       "deploy [--repo <git repository url> --config <config> --ref <ref>]",
+		Description: "Deploy an app. Specify <config> to use a different Bandaid file in the repository, and <ref> to deploy a commit, tag, branch or semver range of tags like '^1.2'.",
 		Function:    cmdDeploy,
 		Flags: func() *flag.FlagSet {
 			fs := flag.NewFlagSet("events", flag.ExitOnError)
 			fs.String("repo", "", "Clone URL")
 			fs.String("config", "", "Bandaid file to use (empty for default)")
+			fs.String("ref", "", "Commit, tag, branch or semver range to deploy (empty for the branch head)")
 			return fs
 		},
 	})
@@ -128,7 +288,14 @@ func cmdReload(fl Flags) (int, error) {
 		return 1, err
 	}
 
-	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/reload")
+	request, err := http.NewRequest("GET", "http://localhost:2020/manager/app/"+fl.String("app")+"/reload", nil)
+	if err != nil {
+		return 1, err
+	}
+	for key, value := range cliTrigger() {
+		request.Header.Set(key, value)
+	}
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Do(request)
 	if err != nil {
 		return 1, err
 	}
@@ -171,9 +338,10 @@ func cmdDeploy(fl Flags) (int, error) {
 		return 1, err
 	}
 	//resp, err := (&http.Client{Timeout: time.Second * 10}).Head("http://localhost:2020/manager/validate")
-	resp, err := req.Post("http://localhost:2020/manager/app", req.BodyJSON(gin.H{
+	resp, err := req.Post("http://localhost:2020/manager/app", cliTrigger(), req.BodyJSON(gin.H{
 		"repository": fl.String("repo"),
 		"config":     fl.String("config"),
+		"ref":        fl.String("ref"),
 	}))
 	if err != nil {
 		return 1, err
@@ -187,6 +355,298 @@ func cmdDeploy(fl Flags) (int, error) {
 	return 0, nil
 }
 
+func cmdRollback(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+	resp, err := req.Post("http://localhost:2020/manager/app/"+fl.String("app")+"/rollback", cliTrigger(), req.BodyJSON(gin.H{
+		"commit":     fl.String("commit"),
+		"deployment": fl.Int("deployment"),
+	}))
+	if err != nil {
+		return 1, err
+	}
+	if resp.Response().StatusCode != 200 {
+		data, _ := resp.ToString()
+		return 1, fmt.Errorf("Rollback failed: %v", data)
+	}
+	result := struct {
+		Commit string `json:"commit"`
+	}{}
+	if err := resp.ToJSON(&result); err != nil {
+		return 1, err
+	}
+	fmt.Println("Rolling back to", result.Commit+", follow the events for progress")
+	return 0, nil
+}
+
+func cmdDeployments(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/deployments")
+	if err != nil {
+		return 1, err
+	}
+
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	var deployments []Deployment
+	err = json.NewDecoder(resp.Body).Decode(&deployments)
+	if err != nil {
+		return 1, err
+	}
+
+	format := "{id:w=4} {commit:w=24} {branch:w=16} {source:w=20} {outcome:w=10} {when}"
+	fmt.Println(stemp.Compile(format, gin.H{
+		"id":      "#",
+		"commit":  "Commit",
+		"branch":  "Branch",
+		"source":  "Source",
+		"outcome": "Outcome",
+		"when":    "Started",
+	}))
+	fmt.Println("--")
+	for _, deployment := range deployments {
+		fmt.Println(stemp.Compile(format, gin.H{
+			"id":      deployment.ID,
+			"commit":  deployment.Revision(),
+			"branch":  deployment.Branch,
+			"source":  deployment.Trigger(),
+			"outcome": deployment.Outcome,
+			"when":    deployment.Timestamp.Format(time.RFC3339),
+		}))
+		if deployment.Error != "" {
+			fmt.Println("     ", deployment.Error)
+		}
+	}
+	return 0, nil
+}
+
+func cmdDeployKey(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+	endpoint := "http://localhost:2020/manager/credentials/ssh"
+	if fl.Bool("rotate") {
+		endpoint += "?rotate=true"
+	}
+	resp, err := req.Post(endpoint, req.BodyJSON(gin.H{"repository": fl.String("repo")}))
+	if err != nil {
+		return 1, err
+	}
+	if resp.Response().StatusCode != 200 {
+		data, _ := resp.ToString()
+		return 1, fmt.Errorf("Command failed: %v", data)
+	}
+	var credential Credential
+	if err := resp.ToJSON(&credential); err != nil {
+		return 1, err
+	}
+	fmt.Println("Add this public key to the repository as a deploy key:")
+	fmt.Println(credential.PublicKey)
+	return 0, nil
+}
+
+func cmdGitToken(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+	token := fl.String("token")
+	if token == "" {
+		// Reading it from stdin keeps it out of the shell history
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return 1, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	resp, err := req.Post("http://localhost:2020/manager/credentials/https", req.BodyJSON(gin.H{
+		"repository": fl.String("repo"),
+		"username":   fl.String("username"),
+		"token":      token,
+	}))
+	if err != nil {
+		return 1, err
+	}
+	if resp.Response().StatusCode != 200 {
+		data, _ := resp.ToString()
+		return 1, fmt.Errorf("Command failed: %v", data)
+	}
+	fmt.Println("Token stored for", fl.String("repo"))
+	return 0, nil
+}
+
+func cmdCredentials(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/credentials")
+	if err != nil {
+		return 1, err
+	}
+
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	var credentials []Credential
+	err = json.NewDecoder(resp.Body).Decode(&credentials)
+	if err != nil {
+		return 1, err
+	}
+
+	format := "{id:w=34} {kind:w=6} {repository:w=48} {detail}"
+	fmt.Println(stemp.Compile(format, gin.H{
+		"id":         "ID",
+		"kind":       "Kind",
+		"repository": "Repository",
+		"detail":     "Key/Username",
+	}))
+	fmt.Println("--")
+	for _, credential := range credentials {
+		detail := credential.Username
+		if credential.Kind == "ssh" {
+			detail = credential.PublicKey
+		}
+		fmt.Println(stemp.Compile(format, gin.H{
+			"id":         credential.ID,
+			"kind":       credential.Kind,
+			"repository": credential.Repository,
+			"detail":     detail,
+		}))
+	}
+	return 0, nil
+}
+
+func cmdSearch(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+	query := url.Values{}
+	for _, name := range []string{"q", "app", "level", "since", "until"} {
+		if value := fl.String(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	query.Set("limit", fmt.Sprint(fl.Int("limit")))
+
+	resp, err := (&http.Client{Timeout: time.Second * 30}).Get("http://localhost:2020/manager/logs/search?" + query.Encode())
+	if err != nil {
+		return 1, err
+	}
+
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	var matches []LogMatch
+	err = json.NewDecoder(resp.Body).Decode(&matches)
+	if err != nil {
+		return 1, err
+	}
+	for _, match := range matches {
+		fmt.Println(match)
+	}
+	return 0, nil
+}
+
+func cmdLogs(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+	query := url.Values{}
+	query.Set("streams", fl.String("streams"))
+	query.Set("tail", fmt.Sprint(fl.Int("tail")))
+	query.Set("follow", fmt.Sprint(fl.Bool("follow")))
+
+	lastID := ""
+	for {
+		var retry bool
+		var err error
+		lastID, retry, err = followStream(fl.String("app"), query, lastID)
+		if !fl.Bool("follow") || !retry {
+			if err != nil {
+				return 1, err
+			}
+			return 0, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("closed by the server")
+		}
+		fmt.Fprintln(os.Stderr, "Stream interrupted:", err, "- reconnecting")
+		time.Sleep(2 * time.Second)
+	}
+}
+
+// followStream prints the entries the manager streams until it closes the connection, resuming after lastID.
+// It returns the ID of the last entry and whether reconnecting might help.
+func followStream(app string, query url.Values, lastID string) (string, bool, error) {
+	request, err := http.NewRequest("GET", "http://localhost:2020/manager/app/"+app+"/stream?"+query.Encode(), nil)
+	if err != nil {
+		return lastID, false, err
+	}
+	request.Header.Set("Accept", "text/event-stream")
+	if lastID != "" {
+		request.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return lastID, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return lastID, false, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			lastID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			var entry StreamEntry
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &entry); err != nil {
+				return lastID, true, err
+			}
+			fmt.Println(entry)
+		}
+	}
+	return lastID, true, scanner.Err()
+}
+
+// logQuery builds the query of the log endpoints from the command's flags.
+func logQuery(fl Flags) string {
+	query := url.Values{}
+	if tail := fl.Int("tail"); tail > 0 {
+		query.Set("tail", fmt.Sprint(tail))
+	}
+	for _, name := range []string{"since", "until"} {
+		if value := fl.String(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	return query.Encode()
+}
+
+// cliTrigger identifies the CLI and the user running it to the manager.
+func cliTrigger() req.Header {
+	return req.Header{
+		"X-Bandaid-Source": "cli",
+		"X-Bandaid-User":   os.Getenv("USER"),
+	}
+}
+
 func cmdApps(fl Flags) (int, error) {
 	if err := printServerVersion(); err != nil {
 		return 1, err
@@ -219,13 +679,17 @@ func cmdApps(fl Flags) (int, error) {
 	fmt.Println("--")
 
 	for _, app := range apps {
+		event := "-"
+		if app.Application.LastEvent != nil {
+			event = app.Application.LastEvent.Text()
+		}
 		fmt.Println(stemp.Compile(
 			"{id:w=32}  {repo:w=60} {status:w=8} {event}",
 			gin.H{
 				"id":     app.Application.ID,
 				"repo":   app.Application.Repository,
-				"status": !app.Status.Error,
-				"event":  app.Application.Events[len(app.Application.Events)-1].Message}),
+				"status": app.Status.Health(),
+				"event":  event}),
 		)
 
 	}
@@ -238,7 +702,7 @@ func cmdStdout(fl Flags) (int, error) {
 		return 1, err
 	}
 
-	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/stdout")
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/stdout?" + logQuery(fl))
 	if err != nil {
 		return 1, err
 	}
@@ -260,7 +724,29 @@ func cmdStderr(fl Flags) (int, error) {
 		return 1, err
 	}
 
-	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/stderr")
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/stderr?" + logQuery(fl))
+	if err != nil {
+		return 1, err
+	}
+
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 1, err
+	}
+	fmt.Println(string(b))
+	return 0, nil
+}
+
+func cmdBuildLog(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/build")
 	if err != nil {
 		return 1, err
 	}
@@ -282,7 +768,16 @@ func cmdEvents(fl Flags) (int, error) {
 		return 1, err
 	}
 
-	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app"))
+	query := url.Values{}
+	if limit := fl.Int("limit"); limit > 0 {
+		query.Set("limit", fmt.Sprint(limit))
+	}
+	for _, name := range []string{"kind", "severity", "since", "until", "before"} {
+		if value := fl.String(name); value != "" {
+			query.Set(name, value)
+		}
+	}
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/events?" + query.Encode())
 	if err != nil {
 		return 1, err
 	}
@@ -292,13 +787,33 @@ func cmdEvents(fl Flags) (int, error) {
 		return 1, fmt.Errorf("Command failed: %v", string(d))
 	}
 
-	var app AppStatusResponse
-	err = json.NewDecoder(resp.Body).Decode(&app)
+	var page EventPage
+	err = json.NewDecoder(resp.Body).Decode(&page)
 	if err != nil {
 		return 1, err
 	}
-	for _, event := range app.Application.Events {
-		fmt.Println(event)
+
+	format := "{id:w=6} {when:w=26} {severity:w=8} {kind:w=20} {text}"
+	fmt.Println(stemp.Compile(format, gin.H{
+		"id":       "ID",
+		"when":     "Time",
+		"severity": "Severity",
+		"kind":     "Kind",
+		"text":     "Event",
+	}))
+	fmt.Println("--")
+	for _, event := range page.Events {
+		fmt.Println(stemp.Compile(format, gin.H{
+			"id":       event.ID,
+			"when":     event.Timestamp.Format(time.RFC3339),
+			"severity": event.Severity,
+			"kind":     event.Kind,
+			"text":     event.Text(),
+		}))
+		fmt.Println("      ", event.Details())
+	}
+	if page.Next != 0 {
+		fmt.Printf("\nOlder events: oakland events --app %v --before %v\n", fl.String("app"), page.Next)
 	}
 	return 0, nil
 }
@@ -326,18 +841,179 @@ func cmdStatus(fl Flags) (int, error) {
 
 	fmt.Println(app.Application.ID)
 	fmt.Println("  ", app.Application.Repository, "\n")
+	fmt.Println("STATE:", app.State)
+	if app.Application.Ref != "" {
+		fmt.Println("REF:", app.Application.Ref)
+	}
+	if app.Application.Commit != "" {
+		fmt.Println("COMMIT:", app.Application.Commit)
+	}
+	if app.Operation != "" {
+		fmt.Println("OPERATION:", app.Operation)
+	}
+	if app.Usage != nil {
+		for _, line := range app.Usage.Lines() {
+			fmt.Println(line)
+		}
+	} else if app.UsageError != "" {
+		fmt.Println("USAGE: unavailable,", app.UsageError)
+	}
+
+	switch {
+	case !app.Status.Checked:
+		fmt.Println("STATUS: NOT CHECKED YET")
+	case app.Status.Healthy:
+		fmt.Println("STATUS: OK, since", app.Status.Since.Format(time.RFC3339))
+	default:
+		fmt.Println("STATUS: ERROR, since", app.Status.Since.Format(time.RFC3339))
+		fmt.Println("[!]", app.Status.Error)
+	}
+	if uptime := app.Status.UptimeString(); uptime != "" {
+		fmt.Println("UPTIME:", uptime)
+	}
+	if app.Application.LastEvent != nil {
+		fmt.Println("Last Event:", app.Application.LastEvent)
+	}
+	return 0, nil
+}
+
+func cmdHealth(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get(fmt.Sprintf("http://localhost:2020/manager/app/%v/health/history?limit=%v", fl.String("app"), fl.Int("limit")))
+	if err != nil {
+		return 1, err
+	}
+
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	var health HealthHistory
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	if err != nil {
+		return 1, err
+	}
+
+	if uptime := health.Status.UptimeString(); uptime != "" {
+		fmt.Printf("UPTIME: %v\n\n", uptime)
+	}
+	format := "{when:w=26} {healthy:w=8} {latency:w=10} {error}"
+	fmt.Println(stemp.Compile(format, gin.H{
+		"when":    "Checked",
+		"healthy": "Healthy",
+		"latency": "Latency",
+		"error":   "Error",
+	}))
+	fmt.Println("--")
+	for _, check := range health.History {
+		fmt.Println(stemp.Compile(format, gin.H{
+			"when":    check.Timestamp.Format(time.RFC3339),
+			"healthy": check.Healthy,
+			"latency": fmt.Sprintf("%.0fms", check.LatencyMS),
+			"error":   check.Error,
+		}))
+	}
+	return 0, nil
+}
+
+func cmdDeliveries(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/app/" + fl.String("app") + "/deliveries?status=" + url.QueryEscape(fl.String("status")))
+	if err != nil {
+		return 1, err
+	}
 
-	if app.Status.Error {
-		fmt.Println("STATUS: ERROR")
-		if app.Status.ServiceError != nil {
-			fmt.Println("[!] Service Error", app.Status.ServiceError.Code, app.Status.ServiceError.Content)
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	var deliveries []Delivery
+	err = json.NewDecoder(resp.Body).Decode(&deliveries)
+	if err != nil {
+		return 1, err
+	}
+
+	format := "{id:w=32}  {type:w=20} {status:w=10} {tries:w=6} {when:w=26} {last}"
+	fmt.Println(stemp.Compile(format, gin.H{
+		"id":     "ID",
+		"type":   "Type",
+		"status": "Status",
+		"tries":  "Tries",
+		"when":   "Created",
+		"last":   "Last Attempt",
+	}))
+	fmt.Println("--")
+	for _, delivery := range deliveries {
+		fmt.Println(stemp.Compile(format, gin.H{
+			"id":     delivery.ID,
+			"type":   delivery.Type,
+			"status": delivery.Status,
+			"tries":  delivery.Tries,
+			"when":   delivery.CreatedAt.Format(time.RFC3339),
+			"last":   delivery.LastAttempt(),
+		}))
+	}
+	return 0, nil
+}
+
+func cmdAlerts(fl Flags) (int, error) {
+	if err := printServerVersion(); err != nil {
+		return 1, err
+	}
+
+	resp, err := (&http.Client{Timeout: time.Second * 10}).Get("http://localhost:2020/manager/alerts")
+	if err != nil {
+		return 1, err
+	}
+
+	if resp.StatusCode != 200 {
+		d, _ := ioutil.ReadAll(resp.Body)
+		return 1, fmt.Errorf("Command failed: %v", string(d))
+	}
+
+	var alerts Alerts
+	err = json.NewDecoder(resp.Body).Decode(&alerts)
+	if err != nil {
+		return 1, err
+	}
+
+	format := "{id:w=32}  {condition:w=14} {status:w=8} {since:w=26} {message}"
+	fmt.Println(stemp.Compile(format, gin.H{
+		"id":        "ID",
+		"condition": "Condition",
+		"status":    "Status",
+		"since":     "Since",
+		"message":   "Message",
+	}))
+	fmt.Println("--")
+	for _, alert := range alerts.Alerts {
+		status := "pending"
+		if alert.Fired {
+			status = "firing"
 		}
-		if app.Status.DialError != "" {
-			fmt.Println("[!] Dial Error", app.Status.DialError)
+		fmt.Println(stemp.Compile(format, gin.H{
+			"id":        alert.App,
+			"condition": alert.Condition,
+			"status":    status,
+			"since":     alert.Since.Format(time.RFC3339),
+			"message":   alert.Message,
+		}))
+	}
+
+	fmt.Println()
+	for _, n := range alerts.Notifiers {
+		fmt.Printf("NOTIFIER: %v (%v), %v sent, %v failed\n", n.Name, n.Type, n.Sent, n.Failed)
+		if n.LastError != "" {
+			fmt.Println("  [!]", n.LastError)
 		}
-	} else {
-		fmt.Println("STATUS: OK")
-		fmt.Println("Last Event:", app.Application.Events[len(app.Application.Events)-1])
 	}
 	return 0, nil
 }
@@ -2,61 +2,291 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 )
 
 type AppStatusResponse struct {
 	Application Application `json:"application"`
+	State       string      `json:"state"`
+	Operation   string      `json:"operation"`
+	Usage       *Usage      `json:"usage"`
+	UsageError  string      `json:"usage_error"`
 	Status      Status      `json:"status"`
-	Error       string      `json:"error"`
 }
 
 type Application struct {
-	Repository     string  `json:"repository"`
-	ID             string  `json:"id"`
-	Events         []Event `json:"events"`
-	SpecificConfig string  `json:"config"`
+	Repository     string `json:"repository"`
+	ID             string `json:"id"`
+	LastEvent      *Event `json:"last_event"`
+	SpecificConfig string `json:"config"`
+	Ref            string `json:"ref"`
+	Commit         string `json:"commit"`
+	State          string `json:"state"`
+	Restarts       int    `json:"restarts"`
 }
 
-type Event struct {
+type Deployment struct {
+	ID        int       `json:"id"`
+	Commit    string    `json:"commit"`
+	Branch    string    `json:"branch"`
+	Tag       string    `json:"tag"`
+	Source    string    `json:"source"`
+	User      string    `json:"user"`
+	Rollback  bool      `json:"rollback"`
+	Outcome   string    `json:"outcome"`
+	Error     string    `json:"error"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Revision is the abbreviated commit, with the tag it was resolved from.
+func (d Deployment) Revision() string {
+	commit := d.Commit
+	if len(commit) > 10 {
+		commit = commit[:10]
+	}
+	if d.Tag != "" {
+		commit += " (" + d.Tag + ")"
+	}
+	return commit
+}
+
+// Trigger describes who started the deployment, e.g. "rollback:slack/noku".
+func (d Deployment) Trigger() string {
+	trigger := d.Source
+	if d.User != "" {
+		trigger += "/" + d.User
+	}
+	if d.Rollback {
+		trigger = "rollback:" + trigger
+	}
+	return trigger
+}
+
+type Usage struct {
+	Memory       uint64  `json:"memory"`
+	MemoryMax    uint64  `json:"memory_max"`
+	CPUSeconds   float64 `json:"cpu_seconds"`
+	CPUWeight    int     `json:"cpu_weight"`
+	CPUQuota     float64 `json:"cpu_quota"`
+	Pids         int     `json:"pids"`
+	PidsMax      int     `json:"pids_max"`
+	OpenFilesMax int     `json:"open_files_max"`
+	User         string  `json:"user"`
+}
+
+func bytesString(size uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value, unit := float64(size), 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f%v", value, units[unit])
+}
+
+// Lines describes the usage against the limits, e.g. "MEMORY: 120.0MiB / 512.0MiB".
+func (u Usage) Lines() []string {
+	memory := "MEMORY: " + bytesString(u.Memory)
+	if u.MemoryMax != 0 {
+		memory += " / " + bytesString(u.MemoryMax)
+	}
+	cpu := fmt.Sprintf("CPU: %.1fs", u.CPUSeconds)
+	if u.CPUQuota != 0 {
+		cpu += fmt.Sprintf(", quota %.2f CPUs", u.CPUQuota)
+	}
+	if u.CPUWeight != 0 {
+		cpu += fmt.Sprintf(", weight %v", u.CPUWeight)
+	}
+	pids := fmt.Sprintf("PIDS: %v", u.Pids)
+	if u.PidsMax != 0 {
+		pids += fmt.Sprintf(" / %v", u.PidsMax)
+	}
+	lines := []string{memory, cpu, pids}
+	if u.OpenFilesMax != 0 {
+		lines = append(lines, fmt.Sprintf("OPEN FILES: %v max", u.OpenFilesMax))
+	}
+	if u.User != "" {
+		lines = append(lines, "USER: "+u.User)
+	}
+	return lines
+}
+
+type StreamEntry struct {
+	ID        int64     `json:"id"`
+	Stream    string    `json:"stream"`
 	Timestamp time.Time `json:"timestamp"`
-	Message   string    `json:"message"`
+	Text      string    `json:"text"`
+}
+
+func (e StreamEntry) String() string {
+	return fmt.Sprintf("%v %-6v | %v", e.Timestamp.Local().Format("2006-01-02 15:04:05"), e.Stream, e.Text)
+}
+
+type LogMatch struct {
+	App       string    `json:"app"`
+	Timestamp time.Time `json:"timestamp"`
+	Stream    string    `json:"stream"`
+	Text      string    `json:"text"`
+	Level     string    `json:"level"`
+}
+
+func (m LogMatch) String() string {
+	app := m.App
+	if len(app) > 8 {
+		app = app[:8]
+	}
+	return fmt.Sprintf("%v %v %-6v %-5v | %v", m.Timestamp.Local().Format("2006-01-02 15:04:05"), app, m.Stream, m.Level, m.Text)
+}
+
+type Credential struct {
+	ID         string    `json:"id"`
+	Repository string    `json:"repository"`
+	Kind       string    `json:"kind"`
+	PublicKey  string    `json:"public_key"`
+	Username   string    `json:"username"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type Event struct {
+	ID         int64             `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Kind       string            `json:"kind"`
+	Severity   string            `json:"severity"`
+	Actor      string            `json:"actor"`
+	Deployment int               `json:"deployment"`
+	Fields     map[string]string `json:"fields"`
+	Error      string            `json:"error"`
+	Message    string            `json:"message"`
+}
+
+// Text is the message of the event, or its error.
+func (e Event) Text() string {
+	if e.Error != "" {
+		return e.Error
+	}
+	return e.Message
 }
 
 func (e Event) String() string {
-	return fmt.Sprintf("<%v ago> %v", time.Now().Sub(e.Timestamp).Truncate(time.Second).String(), e.Message)
+	return fmt.Sprintf("<%v ago> %v", time.Now().Sub(e.Timestamp).Truncate(time.Second).String(), e.Text())
+}
+
+// Details are the actor, the deployment and the fields of the event.
+func (e Event) Details() string {
+	details := []string{"by " + e.Actor}
+	if e.Deployment != 0 {
+		details = append(details, fmt.Sprintf("deployment #%v", e.Deployment))
+	}
+	keys := make([]string, 0, len(e.Fields))
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if e.Fields[key] != "" {
+			details = append(details, key+"="+e.Fields[key])
+		}
+	}
+	return strings.Join(details, " ")
+}
+
+type EventPage struct {
+	Events []Event `json:"events"`
+	Next   int64   `json:"next"`
 }
 
 type Status struct {
-	Configuration Configuration `json:"configuration"`
-	DialError     string        `json:"dial_error,omitempty"`
-	ServiceError  *ServiceError `json:"service_error,omitempty"`
-	Error         bool          `json:"error"`
+	Checked   bool               `json:"checked"`
+	Healthy   bool               `json:"healthy"`
+	Error     string             `json:"error"`
+	CheckedAt *time.Time         `json:"checked_at"`
+	Since     *time.Time         `json:"since"`
+	LatencyMS float64            `json:"latency_ms"`
+	Uptime    map[string]float64 `json:"uptime"`
+}
+
+// Health is the column of the apps command.
+func (s Status) Health() string {
+	switch {
+	case !s.Checked:
+		return "-"
+	case s.Healthy:
+		return "yes"
+	}
+	return "no"
+}
+
+// UptimeString lists the uptime over the last hour, day and week.
+func (s Status) UptimeString() string {
+	windows := []string{}
+	for _, window := range []string{"1h", "24h", "7d"} {
+		if uptime, exists := s.Uptime[window]; exists {
+			windows = append(windows, fmt.Sprintf("%.2f%% (%v)", uptime, window))
+		}
+	}
+	return strings.Join(windows, ", ")
+}
+
+type HealthCheck struct {
+	Timestamp time.Time `json:"timestamp"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error"`
+}
+
+type HealthHistory struct {
+	Status  Status        `json:"status"`
+	History []HealthCheck `json:"history"`
+}
+
+type Alert struct {
+	App        string    `json:"app"`
+	Repository string    `json:"repository"`
+	Condition  string    `json:"condition"`
+	Message    string    `json:"message"`
+	Since      time.Time `json:"since"`
+	Fired      bool      `json:"fired"`
 }
 
-type ServiceError struct {
-	Code    int    `json:"code,omitempty"`
-	Content string `json:"content,omitempty"`
+type NotifierStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Sent      uint64 `json:"sent"`
+	Failed    uint64 `json:"failed"`
+	LastError string `json:"last_error"`
 }
 
-type Configuration struct {
-	Caddy  Caddy  `json:"caddy"`
-	DNS    DNS    `json:"dns"`
-	Force  bool   `json:"force"`
-	Health Health `json:"health"`
+type Alerts struct {
+	Alerts    []Alert          `json:"alerts"`
+	Notifiers []NotifierStatus `json:"notifiers"`
 }
 
-type Caddy struct {
-	Domains []string `json:"domains"`
-	Host    string   `json:"host"`
+type DeliveryAttempt struct {
+	Timestamp  time.Time `json:"timestamp"`
+	StatusCode int       `json:"status_code"`
+	Error      string    `json:"error"`
 }
 
-type DNS struct {
-	Domain  string `json:"domain"`
-	Proxied bool   `json:"proxied"`
-	Zone    string `json:"zone"`
+type Delivery struct {
+	ID        string            `json:"id"`
+	URL       string            `json:"url"`
+	Type      string            `json:"type"`
+	Status    string            `json:"status"`
+	CreatedAt time.Time         `json:"created_at"`
+	Tries     int               `json:"tries"`
+	Attempts  []DeliveryAttempt `json:"attempts"`
 }
 
-type Health struct {
-	CheckURL string `json:"check_url"`
+// LastAttempt describes how the last attempt went.
+func (d Delivery) LastAttempt() string {
+	if len(d.Attempts) == 0 {
+		return "-"
+	}
+	attempt := d.Attempts[len(d.Attempts)-1]
+	if attempt.Error != "" {
+		return attempt.Error
+	}
+	return fmt.Sprint(attempt.StatusCode)
 }
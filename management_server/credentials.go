@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CredentialSSH   = "ssh"
+	CredentialHTTPS = "https"
+)
+
+// Username sent along with HTTPS tokens that don't come with one, GitHub and GitLab accept any.
+const defaultTokenUsername = "x-access-token"
+
+// CredentialStore keeps the SSH deploy keys and HTTPS tokens used for private repositories. Everything is
+// saved in files only the manager's user can read, and secrets never leave the manager through the API.
+type CredentialStore struct {
+	Directory string
+
+	lock    sync.Mutex
+	entries map[string]*credential
+}
+
+// credential is what's saved in credentials.json, the private keys are saved in their own files.
+type credential struct {
+	Repository string    `json:"repository"`
+	Kind       string    `json:"kind"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	Token      string    `json:"token,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Credential is the public part of a stored credential.
+type Credential struct {
+	ID         string    `json:"id"`
+	Repository string    `json:"repository"`
+	Kind       string    `json:"kind"`
+	PublicKey  string    `json:"public_key,omitempty"`
+	Username   string    `json:"username,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// repositoryKey normalizes the ways to address a repository, git@host:path, ssh://, https://, with or
+// without user info, port and .git, to host/path.
+func repositoryKey(repository string) string {
+	r := strings.TrimSpace(repository)
+	if i := strings.Index(r, "://"); i >= 0 {
+		r = r[i+3:]
+	} else if colon := strings.Index(r, ":"); colon > 0 && !strings.Contains(r[:colon], "/") {
+		// scp-like syntax, git@github.com:org/repo
+		r = r[:colon] + "/" + r[colon+1:]
+	}
+
+	host, path := r, ""
+	if slash := strings.Index(r, "/"); slash >= 0 {
+		host, path = r[:slash], r[slash:]
+	}
+	if at := strings.LastIndex(host, "@"); at >= 0 {
+		host = host[at+1:]
+	}
+	if colon := strings.Index(host, ":"); colon >= 0 {
+		host = host[:colon]
+	}
+	path = strings.TrimSuffix(strings.TrimSuffix(path, "/"), ".git")
+	return strings.ToLower(host + path)
+}
+
+func credentialID(repository string) string {
+	hash := md5.Sum([]byte(repositoryKey(repository)))
+	return hex.EncodeToString(hash[:])
+}
+
+func (s *CredentialStore) load() error {
+	if s.entries != nil {
+		return nil
+	}
+	s.entries = map[string]*credential{}
+	b, err := ioutil.ReadFile(filepath.Join(s.Directory, "credentials.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &s.entries)
+}
+
+func (s *CredentialStore) save() error {
+	b, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writePrivateFile(filepath.Join(s.Directory, "credentials.json"), b)
+}
+
+// writePrivateFile atomically replaces the file with one only the manager's user can read.
+func writePrivateFile(name string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+func (s *CredentialStore) keyPath(id string) string {
+	return filepath.Join(s.Directory, id+"_ed25519")
+}
+
+func (s *CredentialStore) view(id string, entry *credential) *Credential {
+	return &Credential{
+		ID:         id,
+		Repository: entry.Repository,
+		Kind:       entry.Kind,
+		PublicKey:  entry.PublicKey,
+		Username:   entry.Username,
+		CreatedAt:  entry.CreatedAt,
+	}
+}
+
+// DeployKey returns the repository's deploy key, generating an ed25519 key pair if it has none or rotate is
+// set. The public key has to be added to the repository as a deploy key.
+func (s *CredentialStore) DeployKey(repository string, rotate bool) (*Credential, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	id := credentialID(repository)
+	if entry, exists := s.entries[id]; exists && entry.Kind == CredentialSSH && !rotate {
+		return s.view(id, entry), nil
+	}
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	comment := "bandaid@" + repositoryKey(repository)
+	if err := writePrivateFile(s.keyPath(id), marshalPrivateKey(public, private, comment)); err != nil {
+		return nil, err
+	}
+	s.entries[id] = &credential{
+		Repository: repository,
+		Kind:       CredentialSSH,
+		PublicKey:  marshalAuthorizedKey(public, comment),
+		CreatedAt:  time.Now(),
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s.view(id, s.entries[id]), nil
+}
+
+// SetToken stores an HTTPS token for the repository, replacing its deploy key if it had one.
+func (s *CredentialStore) SetToken(repository, username, token string) (*Credential, error) {
+	if token == "" {
+		return nil, fmt.Errorf("token is required")
+	}
+	if username == "" {
+		username = defaultTokenUsername
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	id := credentialID(repository)
+	_ = os.Remove(s.keyPath(id))
+	s.entries[id] = &credential{
+		Repository: repository,
+		Kind:       CredentialHTTPS,
+		Username:   username,
+		Token:      token,
+		CreatedAt:  time.Now(),
+	}
+	if err := s.save(); err != nil {
+		return nil, err
+	}
+	return s.view(id, s.entries[id]), nil
+}
+
+func (s *CredentialStore) List() ([]*Credential, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	credentials := []*Credential{}
+	for id, entry := range s.entries {
+		credentials = append(credentials, s.view(id, entry))
+	}
+	sort.Slice(credentials, func(i, j int) bool {
+		return credentials[i].Repository < credentials[j].Repository
+	})
+	return credentials, nil
+}
+
+func (s *CredentialStore) Remove(id string) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return false, err
+	}
+	if _, exists := s.entries[id]; !exists {
+		return false, nil
+	}
+	delete(s.entries, id)
+	_ = os.Remove(s.keyPath(id))
+	return true, s.save()
+}
+
+// gitOptions returns the git config flags and environment that make a git command use the repository's
+// credentials. Secrets only go through the environment, never the command line.
+func (s *CredentialStore) gitOptions(repository string) (config []string, env []string, err error) {
+	env = []string{"GIT_TERMINAL_PROMPT=0"}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.load(); err != nil {
+		return nil, nil, err
+	}
+	id := credentialID(repository)
+	entry, exists := s.entries[id]
+	if !exists {
+		return nil, env, nil
+	}
+
+	switch entry.Kind {
+	case CredentialSSH:
+		key, err := filepath.Abs(s.keyPath(id))
+		if err != nil {
+			return nil, nil, err
+		}
+		knownHosts, err := filepath.Abs(filepath.Join(s.Directory, "known_hosts"))
+		if err != nil {
+			return nil, nil, err
+		}
+		env = append(env, fmt.Sprintf(
+			"GIT_SSH_COMMAND=ssh -i '%v' -o IdentitiesOnly=yes -o StrictHostKeyChecking=accept-new -o UserKnownHostsFile='%v'",
+			key, knownHosts))
+	case CredentialHTTPS:
+		// An empty helper first drops whatever helpers the host user has configured
+		config = []string{
+			"-c", "credential.helper=",
+			"-c", `credential.helper=!f() { test "$1" = get && echo "username=$BANDAID_GIT_USERNAME" && echo "password=$BANDAID_GIT_TOKEN"; }; f`,
+		}
+		env = append(env, "BANDAID_GIT_USERNAME="+entry.Username, "BANDAID_GIT_TOKEN="+entry.Token)
+	}
+	return config, env, nil
+}
+
+func (s *CredentialStore) secrets() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.load() != nil {
+		return nil
+	}
+	secrets := []string{}
+	for _, entry := range s.entries {
+		if entry.Token != "" {
+			secrets = append(secrets, entry.Token)
+		}
+	}
+	return secrets
+}
+
+var urlCredentials = regexp.MustCompile(`(https?://)[^/@\s]+@`)
+
+// redact hides stored tokens and credentials embedded in URLs.
+func redact(text string) string {
+	text = urlCredentials.ReplaceAllString(text, "${1}***@")
+	if api == nil || api.credentials == nil {
+		return text
+	}
+	for _, secret := range api.credentials.secrets() {
+		text = strings.Replace(text, secret, "***", -1)
+	}
+	return text
+}
+
+// remoteGit runs a git command that talks to the repository's remote, using its stored credentials.
+func remoteGit(directory, repository string, args ...string) (string, error) {
+	config, env := []string(nil), []string{"GIT_TERMINAL_PROMPT=0"}
+	if api != nil && api.credentials != nil {
+		var err error
+		config, env, err = api.credentials.gitOptions(repository)
+		if err != nil {
+			return "", fmt.Errorf("failed to load credentials: %v", err)
+		}
+	}
+	cmd := exec.Command("git", append(config, args...)...)
+	cmd.Dir = directory
+	cmd.Env = append(os.Environ(), env...)
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", redact(strings.TrimSpace(string(b))), err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func sshString(b []byte) []byte {
+	out := make([]byte, 4, 4+len(b))
+	binary.BigEndian.PutUint32(out, uint32(len(b)))
+	return append(out, b...)
+}
+
+func marshalAuthorizedKey(public ed25519.PublicKey, comment string) string {
+	blob := append(sshString([]byte("ssh-ed25519")), sshString(public)...)
+	return fmt.Sprintf("ssh-ed25519 %v %v", base64.StdEncoding.EncodeToString(blob), comment)
+}
+
+// marshalPrivateKey encodes the key in OpenSSH's private key format, unencrypted.
+func marshalPrivateKey(public ed25519.PublicKey, private ed25519.PrivateKey, comment string) []byte {
+	blob := append(sshString([]byte("ssh-ed25519")), sshString(public)...)
+
+	check := make([]byte, 4)
+	_, _ = rand.Read(check)
+	var keys bytes.Buffer
+	keys.Write(check)
+	keys.Write(check)
+	keys.Write(sshString([]byte("ssh-ed25519")))
+	keys.Write(sshString(public))
+	keys.Write(sshString(private))
+	keys.Write(sshString([]byte(comment)))
+	for i := byte(1); keys.Len()%8 != 0; i++ {
+		keys.WriteByte(i)
+	}
+
+	var body bytes.Buffer
+	body.WriteString("openssh-key-v1\x00")
+	body.Write(sshString([]byte("none")))
+	body.Write(sshString([]byte("none")))
+	body.Write(sshString(nil))
+	body.Write([]byte{0, 0, 0, 1})
+	body.Write(sshString(blob))
+	body.Write(sshString(keys.Bytes()))
+	return pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: body.Bytes()})
+}
+
+func (api *API) MANAGER_GET_CREDENTIALS(ctx *gin.Context) {
+	credentials, err := api.credentials.List()
+	if IsError(500, err, ctx) {
+		return
+	}
+	ctx.JSON(200, credentials)
+}
+
+func (api *API) MANAGER_POST_DEPLOY_KEY(ctx *gin.Context) {
+	type Body struct {
+		Repository string `json:"repository"`
+	}
+	body := &Body{}
+	if IsError(400, ctx.BindJSON(body), ctx) {
+		return
+	}
+	if body.Repository == "" {
+		IsError(400, fmt.Errorf("repository is required"), ctx)
+		return
+	}
+	credential, err := api.credentials.DeployKey(body.Repository, ctx.Query("rotate") == "true")
+	if IsError(500, err, ctx) {
+		return
+	}
+	ctx.JSON(200, credential)
+}
+
+func (api *API) MANAGER_POST_GIT_TOKEN(ctx *gin.Context) {
+	type Body struct {
+		Repository string `json:"repository"`
+		Username   string `json:"username"`
+		Token      string `json:"token"`
+	}
+	body := &Body{}
+	if IsError(400, ctx.BindJSON(body), ctx) {
+		return
+	}
+	if body.Repository == "" {
+		IsError(400, fmt.Errorf("repository is required"), ctx)
+		return
+	}
+	credential, err := api.credentials.SetToken(body.Repository, body.Username, body.Token)
+	if IsError(400, err, ctx) {
+		return
+	}
+	ctx.JSON(200, credential)
+}
+
+func (api *API) MANAGER_DELETE_CREDENTIAL(ctx *gin.Context) {
+	removed, err := api.credentials.Remove(ctx.Param("credentialId"))
+	if IsError(500, err, ctx) {
+		return
+	}
+	if !removed {
+		IsError(404, fmt.Errorf("credential not found"), ctx)
+		return
+	}
+	ctx.String(200, "OK")
+}
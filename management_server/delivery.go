@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/ini.v1"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+// How many finished deliveries an outbox keeps, and how many attempts of each.
+const (
+	deliveredKept = 50
+	deadKept      = 500
+	attemptsKept  = 20
+)
+
+// EventPayload is the body of an event delivery.
+type EventPayload struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	App        string    `json:"app"`
+	Repository string    `json:"repository"`
+	Timestamp  time.Time `json:"timestamp"`
+	Event      *AppEvent `json:"event"`
+}
+
+// DeliveryAttempt is one request of a delivery.
+type DeliveryAttempt struct {
+	Timestamp  time.Time `json:"timestamp"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS float64   `json:"duration_ms"`
+}
+
+// Delivery is an event on its way to one of the application's event URLs. Tries counts the attempts since it
+// was queued or retried, Attempts keeps the last ones.
+type Delivery struct {
+	ID          string            `json:"id"`
+	URL         string            `json:"url"`
+	Type        string            `json:"type"`
+	Status      string            `json:"status"`
+	CreatedAt   time.Time         `json:"created_at"`
+	NextAttempt *time.Time        `json:"next_attempt,omitempty"`
+	Tries       int               `json:"tries"`
+	Attempts    []DeliveryAttempt `json:"attempts"`
+	Payload     json.RawMessage   `json:"payload"`
+}
+
+// outbox holds an application's deliveries. It's saved to its own file in the webhooks directory whenever it
+// changes, so pending deliveries survive manager restarts.
+type outbox struct {
+	lock sync.Mutex
+	path string
+
+	Pending   []*Delivery `json:"pending"`
+	Delivered []*Delivery `json:"delivered"`
+	Dead      []*Delivery `json:"dead"`
+
+	sending map[string]bool
+}
+
+// webhookSettings is the [webhooks] section of config.ini.
+type webhookSettings struct {
+	Directory   string
+	MaxAttempts int
+	Timeout     time.Duration
+	RetryDelay  time.Duration
+	MaxDelay    time.Duration
+}
+
+func loadWebhookSettings(config *ini.File) webhookSettings {
+	section := config.Section("webhooks")
+	return webhookSettings{
+		Directory:   section.Key("directory").MustString("webhooks"),
+		MaxAttempts: section.Key("max_attempts").MustInt(10),
+		Timeout:     section.Key("timeout").MustDuration(10 * time.Second),
+		RetryDelay:  section.Key("retry_delay").MustDuration(10 * time.Second),
+		MaxDelay:    section.Key("max_delay").MustDuration(time.Hour),
+	}
+}
+
+func (api *API) webhookSettings() webhookSettings {
+	if api == nil || api.Config == nil {
+		return loadWebhookSettings(ini.Empty())
+	}
+	return loadWebhookSettings(api.Config)
+}
+
+// outbox loads the application's outbox the first time it's needed.
+func (app *Application) outbox() *outbox {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if app.deliveries != nil {
+		return app.deliveries
+	}
+	box := &outbox{
+		path:    filepath.Join(api.webhookSettings().Directory, app.ID+".json"),
+		sending: map[string]bool{},
+	}
+	if b, err := ioutil.ReadFile(box.path); err == nil {
+		if err := json.Unmarshal(b, box); err != nil {
+			log.Printf("[webhooks] %v: failed to read the outbox, starting a new one: %v\n", app.ID, err)
+		}
+	}
+	app.deliveries = box
+	return box
+}
+
+// save has to be called with the outbox's lock held.
+func (box *outbox) save() {
+	b, err := json.Marshal(box)
+	if err == nil {
+		if err = os.MkdirAll(filepath.Dir(box.path), 0700); err == nil {
+			err = writeFileAtomic(box.path, b, 0600)
+		}
+	}
+	if err != nil {
+		log.Printf("[webhooks] failed to save %v: %v\n", box.path, err)
+	}
+}
+
+// webhookSecret returns the key the application's deliveries are signed with, it's generated the first time.
+func (app *Application) webhookSecret() string {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if app.webhook_secret == "" {
+		app.webhook_secret = randomHex(32)
+	}
+	return app.webhook_secret
+}
+
+func randomHex(size int) string {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// deliver queues the event for every event URL of the application.
+func (api *API) deliver(app *Application, event *AppEvent) {
+	snapshot := app.snapshot()
+	if len(snapshot.event_urls) == 0 {
+		return
+	}
+	kind := event.Kind
+	if kind == "" {
+		kind = EventMessage
+		if event.Error != "" {
+			kind = EventError
+		}
+	}
+
+	box := app.outbox()
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	now := time.Now()
+	for _, url := range snapshot.event_urls {
+		id := randomHex(16)
+		payload, err := json.Marshal(EventPayload{ID: id, Type: kind, App: app.ID, Repository: snapshot.Repository,
+			Timestamp: event.Timestamp, Event: event})
+		if err != nil {
+			log.Printf("[webhooks] %v: failed to encode the event: %v\n", app.ID, err)
+			return
+		}
+		box.Pending = append(box.Pending, &Delivery{ID: id, URL: url, Type: kind, Status: DeliveryPending,
+			CreatedAt: now, NextAttempt: &now, Attempts: []DeliveryAttempt{}, Payload: payload})
+	}
+	box.save()
+}
+
+// StartWebhooks sends the applications' due deliveries in the background, their outboxes are loaded as
+// they're restored.
+func (api *API) StartWebhooks() {
+	go func() {
+		for range time.Tick(time.Second) {
+			for _, app := range api.apps.Applications() {
+				app.dispatch()
+			}
+		}
+	}()
+}
+
+// dispatch starts sending the deliveries that are due and aren't being sent already.
+func (app *Application) dispatch() {
+	if len(app.snapshot().event_urls) == 0 {
+		return
+	}
+	box := app.outbox()
+	now := time.Now()
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	for _, delivery := range box.Pending {
+		if box.sending[delivery.ID] || delivery.NextAttempt == nil || delivery.NextAttempt.After(now) {
+			continue
+		}
+		box.sending[delivery.ID] = true
+		go app.send(box, delivery.ID, delivery.URL, delivery.Type, delivery.Payload)
+	}
+}
+
+// signature is the hex HMAC-SHA256 of the timestamp and the body, joined with a dot.
+func signature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// send makes one attempt at a delivery, then delivers it, schedules the next attempt with a doubling delay
+// or moves it to the dead letters once it's out of attempts.
+func (app *Application) send(box *outbox, id string, url string, kind string, payload []byte) {
+	settings := api.webhookSettings()
+	started := time.Now()
+	timestamp := strconv.FormatInt(started.Unix(), 10)
+	attempt := DeliveryAttempt{Timestamp: started}
+
+	request, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err == nil {
+		request.Header.Set("Content-Type", "application/json")
+		request.Header.Set("User-Agent", "bandaid-webhooks/"+VERSION)
+		request.Header.Set("X-Bandaid-Event", kind)
+		request.Header.Set("X-Bandaid-Delivery", id)
+		request.Header.Set("X-Bandaid-Timestamp", timestamp)
+		request.Header.Set("X-Bandaid-Signature", "sha256="+signature(app.webhookSecret(), timestamp, payload))
+		var resp *http.Response
+		if resp, err = (&http.Client{Timeout: settings.Timeout}).Do(request); err == nil {
+			attempt.StatusCode = resp.StatusCode
+			if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+				message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+				err = fmt.Errorf("answered %v: %v", resp.Status, strings.TrimSpace(string(message)))
+			}
+			resp.Body.Close()
+		}
+	}
+	attempt.DurationMS = float64(time.Since(started)) / float64(time.Millisecond)
+	if err != nil {
+		attempt.Error = redact(err.Error())
+	}
+
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	delete(box.sending, id)
+	index := -1
+	for i, delivery := range box.Pending {
+		if delivery.ID == id {
+			index = i
+		}
+	}
+	if index < 0 {
+		return
+	}
+	delivery := box.Pending[index]
+	delivery.Tries++
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	if len(delivery.Attempts) > attemptsKept {
+		delivery.Attempts = delivery.Attempts[len(delivery.Attempts)-attemptsKept:]
+	}
+
+	switch {
+	case err == nil:
+		delivery.Status, delivery.NextAttempt = DeliveryDelivered, nil
+		box.Pending = append(box.Pending[:index], box.Pending[index+1:]...)
+		box.Delivered = keepLast(append(box.Delivered, delivery), deliveredKept)
+	case delivery.Tries >= settings.MaxAttempts:
+		delivery.Status, delivery.NextAttempt = DeliveryDead, nil
+		box.Pending = append(box.Pending[:index], box.Pending[index+1:]...)
+		box.Dead = keepLast(append(box.Dead, delivery), deadKept)
+		log.Printf("[webhooks] %v: giving up on delivery %v to %v after %v attempts: %v\n", app.ID, id, url,
+			delivery.Tries, attempt.Error)
+	default:
+		delay := settings.RetryDelay
+		for i := 1; i < delivery.Tries && delay < settings.MaxDelay; i++ {
+			delay *= 2
+		}
+		if delay > settings.MaxDelay {
+			delay = settings.MaxDelay
+		}
+		next := time.Now().Add(delay)
+		delivery.NextAttempt = &next
+	}
+	box.save()
+}
+
+func keepLast(deliveries []*Delivery, size int) []*Delivery {
+	if len(deliveries) > size {
+		return append([]*Delivery{}, deliveries[len(deliveries)-size:]...)
+	}
+	return deliveries
+}
+
+// removeOutbox deletes the application's outbox with its file, when the application is deleted.
+func (app *Application) removeOutbox() {
+	box := app.outbox()
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	box.Pending = nil
+	if err := os.Remove(box.path); err != nil && !os.IsNotExist(err) {
+		log.Printf("[webhooks] failed to remove %v: %v\n", box.path, err)
+	}
+}
+
+// MANAGER_GET_DELIVERIES lists the application's pending, delivered and dead deliveries with their attempts,
+// newest first. ?status= picks one of them.
+func (api *API) MANAGER_GET_DELIVERIES(ctx *gin.Context) {
+	app, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+	status := ctx.Query("status")
+	if status != "" && status != DeliveryPending && status != DeliveryDelivered && status != DeliveryDead {
+		IsError(400, fmt.Errorf("unknown status '%v', use pending, delivered or dead", status), ctx)
+		return
+	}
+
+	box := app.outbox()
+	box.lock.Lock()
+	deliveries := []Delivery{}
+	for _, list := range [][]*Delivery{box.Pending, box.Delivered, box.Dead} {
+		for _, delivery := range list {
+			if status == "" || delivery.Status == status {
+				deliveries = append(deliveries, *delivery)
+			}
+		}
+	}
+	box.lock.Unlock()
+	// Newest first, the lists are ordered by when deliveries moved between them, not by when they were created
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].CreatedAt.After(deliveries[j].CreatedAt)
+	})
+	ctx.JSON(200, deliveries)
+}
+
+// MANAGER_POST_REDELIVER queues a dead delivery again, with a fresh set of attempts.
+func (api *API) MANAGER_POST_REDELIVER(ctx *gin.Context) {
+	app, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+	box := app.outbox()
+	box.lock.Lock()
+	defer box.lock.Unlock()
+	for i, delivery := range box.Dead {
+		if delivery.ID != ctx.Param("deliveryId") {
+			continue
+		}
+		now := time.Now()
+		delivery.Status, delivery.Tries, delivery.NextAttempt = DeliveryPending, 0, &now
+		box.Dead = append(box.Dead[:i], box.Dead[i+1:]...)
+		box.Pending = append(box.Pending, delivery)
+		box.save()
+		ctx.JSON(200, delivery)
+		return
+	}
+	IsError(404, fmt.Errorf("no dead delivery '%v'", ctx.Param("deliveryId")), ctx)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeliveriesNewestFirst(t *testing.T) {
+	testAPI(t, "")
+	start := time.Now()
+	delivery := func(id, status string, age time.Duration) *Delivery {
+		return &Delivery{ID: id, Status: status, CreatedAt: start.Add(-age)}
+	}
+	// A redelivered dead letter is appended to the pending list after newer deliveries
+	app := &Application{ID: "app", deliveries: &outbox{
+		Pending:   []*Delivery{delivery("pending", DeliveryPending, 2*time.Minute), delivery("retried", DeliveryPending, time.Hour)},
+		Delivered: []*Delivery{delivery("old", DeliveryDelivered, 2*time.Hour), delivery("new", DeliveryDelivered, time.Minute)},
+		Dead:      []*Delivery{delivery("dead", DeliveryDead, 30*time.Minute)},
+	}}
+	if err := api.apps.Add(app); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		status string
+		want   string
+	}{
+		{"", "new,pending,dead,retried,old"},
+		{DeliveryPending, "pending,retried"},
+		{DeliveryDelivered, "new,old"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.BuildAPI().ServeHTTP(w, httptest.NewRequest("GET", "/manager/app/app/deliveries?status="+test.status, nil))
+		deliveries := []Delivery{}
+		if err := json.Unmarshal(w.Body.Bytes(), &deliveries); err != nil {
+			t.Fatalf("%v: %s", err, w.Body.Bytes())
+		}
+		ids := []string{}
+		for _, delivery := range deliveries {
+			ids = append(ids, delivery.ID)
+		}
+		if got := strings.Join(ids, ","); got != test.want {
+			t.Errorf("?status=%v listed %v, want %v", test.status, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	SourceAPI     = "api"
+	SourceCLI     = "cli"
+	SourceSlack   = "slack"
+	SourceWebhook = "webhook"
+	SourceStartup = "startup"
+)
+
+const (
+	OutcomePending   = "pending"
+	OutcomeSucceeded = "succeeded"
+	OutcomeFailed    = "failed"
+)
+
+// Trigger is who or what started a deployment.
+type Trigger struct {
+	Source string
+	User   string
+}
+
+// triggerFrom reads the deployment trigger of a request, clients identify themselves with the
+// X-Bandaid-Source and X-Bandaid-User headers.
+func triggerFrom(ctx *gin.Context) Trigger {
+	trigger := Trigger{
+		Source: ctx.GetHeader("X-Bandaid-Source"),
+		User:   ctx.GetHeader("X-Bandaid-User"),
+	}
+	if trigger.Source == "" {
+		trigger.Source = SourceAPI
+	}
+	return trigger
+}
+
+type Deployment struct {
+	ID         int        `json:"id"`
+	Commit     string     `json:"commit"`
+	Branch     string     `json:"branch"`
+	Ref        string     `json:"ref,omitempty"`
+	Tag        string     `json:"tag,omitempty"`
+	Source     string     `json:"source"`
+	User       string     `json:"user,omitempty"`
+	Rollback   bool       `json:"rollback,omitempty"`
+	Outcome    string     `json:"outcome"`
+	Error      string     `json:"error,omitempty"`
+	Timestamp  time.Time  `json:"timestamp"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// succeeded also counts deployments recorded before outcomes were tracked.
+func (d *Deployment) succeeded() bool {
+	return d.Outcome == OutcomeSucceeded || d.Outcome == ""
+}
+
+func (app *Application) DeploymentList() []*Deployment {
+	return app.snapshot().Deployments
+}
+
+// beginDeployment adds a pending deployment to the history.
+func (app *Application) beginDeployment(trigger Trigger, rollback bool) *Deployment {
+	app.lock.Lock()
+	id := 1
+	if len(app.Deployments) > 0 {
+		id = app.Deployments[len(app.Deployments)-1].ID + 1
+	}
+	deployment := &Deployment{
+		ID:        id,
+		Ref:       app.Ref,
+		Source:    trigger.Source,
+		User:      trigger.User,
+		Rollback:  rollback,
+		Outcome:   OutcomePending,
+		Timestamp: time.Now(),
+	}
+	app.Deployments = append(app.Deployments, deployment)
+	app.lock.Unlock()
+	api.Persist()
+	started := trigger.Source
+	if trigger.User != "" {
+		started += " by " + trigger.User
+	}
+	app.add_event(&AppEvent{
+		Kind:       EventDeployStarted,
+		Actor:      trigger.Actor(),
+		Deployment: id,
+		Fields:     map[string]string{"source": trigger.Source, "rollback": strconv.FormatBool(rollback)},
+		Message:    fmt.Sprintf("Deployment #%v started from %v", id, started),
+	})
+	return deployment
+}
+
+// resolveDeployment fills in the commit and branch checked out in the directory, and the tag it resolved to.
+func (app *Application) resolveDeployment(deployment *Deployment, directory string, tag string) {
+	commit, _ := git(directory, "rev-parse", "HEAD")
+	branch := strings.TrimPrefix(app.upstream(directory), "origin/")
+	app.lock.Lock()
+	deployment.Commit = commit
+	deployment.Branch = branch
+	deployment.Tag = tag
+	app.lock.Unlock()
+	api.Persist()
+}
+
+// recordDeployment records the checkout as a deployment, it's finished once the next launch is healthy.
+func (app *Application) recordDeployment(trigger Trigger) {
+	deployment := app.beginDeployment(trigger, false)
+	app.resolveDeployment(deployment, app.Directory(), "")
+	app.lock.Lock()
+	app.deployment = deployment
+	app.lock.Unlock()
+}
+
+// finishDeployment records the outcome of a pending deployment.
+func (app *Application) finishDeployment(deployment *Deployment, err error) {
+	if deployment == nil {
+		return
+	}
+	now := time.Now()
+	app.lock.Lock()
+	if deployment.Outcome != OutcomePending {
+		app.lock.Unlock()
+		return
+	}
+	deployment.Outcome = OutcomeSucceeded
+	if err != nil {
+		deployment.Outcome = OutcomeFailed
+		deployment.Error = err.Error()
+	} else {
+		app.Commit = deployment.Commit
+	}
+	deployment.FinishedAt = &now
+	id, commit := deployment.ID, deployment.Commit
+	event := &AppEvent{
+		Actor:      Trigger{Source: deployment.Source, User: deployment.User}.Actor(),
+		Deployment: id,
+		Fields: map[string]string{
+			"commit":   commit,
+			"branch":   deployment.Branch,
+			"duration": now.Sub(deployment.Timestamp).Truncate(time.Second).String(),
+		},
+	}
+	app.lock.Unlock()
+	api.Persist()
+
+	if err == nil {
+		event.Kind, event.Message = EventDeploySucceeded, fmt.Sprintf("Deployment #%v of %v succeeded", id, commit)
+		app.add_event(event)
+		api.resolveAlert(app, AlertDeployFailed)
+	} else {
+		event.Kind, event.Error = EventDeployFailed, fmt.Sprintf("deployment #%v of %v failed: %v", id, commit, err)
+		app.add_event(event)
+		api.raiseAlert(app, AlertDeployFailed, fmt.Sprintf("deployment #%v of %v failed: %v", id, commit, err))
+	}
+}
+
+// confirmDeployment finishes the deployment once the launched service is healthy, and then applies its
+// [dns.cloudflare] settings. Blue/green reloads apply them once traffic is switched instead.
+func (app *Application) confirmDeployment(deployment *Deployment, config *BandaidFile, host string, inst *instance) {
+	err := app.waitReady(config, host, config.HealthTimeout(), inst.stop)
+	app.finishDeployment(deployment, err)
+	if err == nil {
+		app.applyEdgeSettings(config, host)
+	}
+}
+
+// rollbackTarget picks the commit to roll back to: the given deployment, or commit which has to be in the
+// history. By default it's the last successful deployment of a different commit than the live one.
+func (app *Application) rollbackTarget(commit string, id int) (string, error) {
+	deployments := app.DeploymentList()
+	if id != 0 {
+		for _, deployment := range deployments {
+			if deployment.ID == id && deployment.Commit != "" {
+				return deployment.Commit, nil
+			}
+		}
+		return "", fmt.Errorf("deployment #%v not found", id)
+	}
+
+	if commit != "" {
+		if len(commit) < 4 {
+			return "", fmt.Errorf("commit '%v' is too short, use at least 4 characters", commit)
+		}
+		for i := len(deployments) - 1; i >= 0; i-- {
+			if strings.HasPrefix(deployments[i].Commit, commit) {
+				return deployments[i].Commit, nil
+			}
+		}
+		return "", fmt.Errorf("commit '%v' was never deployed", commit)
+	}
+
+	live := ""
+	for i := len(deployments) - 1; i >= 0; i-- {
+		deployment := deployments[i]
+		if !deployment.succeeded() || deployment.Commit == "" {
+			continue
+		}
+		if live == "" {
+			live = deployment.Commit
+		} else if deployment.Commit != live {
+			return deployment.Commit, nil
+		}
+	}
+	return "", fmt.Errorf("there is no earlier successful deployment to roll back to")
+}
+
+// upstream returns the remote branch a checkout follows: the branch the ref names, the application's branch
+// or the remote's default.
+func (app *Application) upstream(directory string) string {
+	if app.Ref != "" {
+		if _, err := revision(directory, "refs/remotes/origin/"+app.Ref); err == nil {
+			return "origin/" + app.Ref
+		}
+	}
+	if app.Branch != "" {
+		return "origin/" + app.Branch
+	}
+	if ref, err := git(directory, "rev-parse", "--abbrev-ref", "origin/HEAD"); err == nil {
+		return ref
+	}
+	return "origin/master"
+}
+
+func git(directory string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = directory
+	b, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %v", strings.TrimSpace(string(b)), err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/nokusukun/bandaid"
+	"log"
+	"strings"
+	"time"
+)
+
+// TokenPending is the status of tokens that haven't been verified yet.
+const TokenPending = "pending"
+
+// pendingTokens reports every token in the [cloudflare] section of config.ini as pending.
+func (api *API) pendingTokens() map[string]*bandaid.TokenVerification {
+	results := map[string]*bandaid.TokenVerification{}
+	for _, key := range api.Config.Section("cloudflare").Keys() {
+		results[key.Name()] = &bandaid.TokenVerification{Status: TokenPending}
+	}
+	return results
+}
+
+// VerifyTokens checks every token in the [cloudflare] section of config.ini and keeps the results for
+// /manager/dns/tokens, which reports the tokens that aren't checked yet as pending. Retries make it slow while
+// Cloudflare is down, so the manager runs it in the background at startup.
+func (api *API) VerifyTokens() map[string]*bandaid.TokenVerification {
+	api.tokensLock.Lock()
+	api.tokens = api.pendingTokens()
+	api.tokensLock.Unlock()
+
+	results := map[string]*bandaid.TokenVerification{}
+	for _, key := range api.Config.Section("cloudflare").Keys() {
+		report, err := bandaid.AutoCloudflare(key.String()).SetZone(key.Name()).Verify()
+		if err != nil {
+			log.Printf("[cloudflare] Token for '%v' failed verification: %v\n", key.Name(), err)
+		} else {
+			log.Printf("[cloudflare] Token for '%v' OK\n", key.Name())
+		}
+		results[key.Name()] = report
+		api.tokensLock.Lock()
+		api.tokens[key.Name()] = report
+		api.tokensLock.Unlock()
+	}
+	return results
+}
+
+func (api *API) MANAGER_GET_DNS_TOKENS(ctx *gin.Context) {
+	if ctx.Query("refresh") == "true" {
+		_ = api.Config.Reload()
+		ctx.JSON(200, api.VerifyTokens())
+		return
+	}
+
+	api.tokensLock.RLock()
+	defer api.tokensLock.RUnlock()
+	if api.tokens == nil {
+		ctx.JSON(200, api.pendingTokens())
+		return
+	}
+	ctx.JSON(200, api.tokens)
+}
+
+// HTTPReqChallenge is the body sent by lego's (and Caddy's) "httpreq" DNS provider. The default mode sends
+// fqdn and value, HTTPREQ_MODE=RAW sends domain, token and keyAuth instead.
+type HTTPReqChallenge struct {
+	FQDN    string `json:"fqdn"`
+	Value   string `json:"value"`
+	Domain  string `json:"domain"`
+	Token   string `json:"token"`
+	KeyAuth string `json:"keyAuth"`
+}
+
+// Record returns the TXT record to present. Only challenge records can be written, so the endpoints can't be
+// used to change anything else in the zones the tokens cover.
+func (c HTTPReqChallenge) Record() (fqdn string, value string, err error) {
+	switch {
+	case c.FQDN != "" && c.Value != "":
+		fqdn, value = c.FQDN, c.Value
+	case c.Domain != "" && c.KeyAuth != "":
+		fqdn, value = bandaid.ChallengeFQDN(c.Domain), bandaid.ChallengeValue(c.KeyAuth)
+	default:
+		return "", "", fmt.Errorf("either fqdn and value or domain and keyAuth must be provided")
+	}
+	if !strings.HasPrefix(strings.ToLower(fqdn), "_acme-challenge.") {
+		return "", "", fmt.Errorf("'%v' is not an ACME challenge record, its name has to start with '_acme-challenge.'", fqdn)
+	}
+	return fqdn, value, nil
+}
+
+// ACMEHandlers returns the basic auth middleware for the httpreq endpoints, from [acme] username and password in
+// config.ini. Without both the endpoints aren't served.
+func (api *API) ACMEHandlers() ([]gin.HandlerFunc, error) {
+	section := api.Config.Section("acme")
+	username, password := section.Key("username").String(), section.Key("password").String()
+	if username == "" || password == "" {
+		return nil, fmt.Errorf("[acme] username and password are not set")
+	}
+	return []gin.HandlerFunc{gin.BasicAuth(gin.Accounts{username: password})}, nil
+}
+
+func (api *API) challengeClient(fqdn string) (*bandaid.CloudflareConfig, error) {
+	domain := strings.TrimSuffix(fqdn, ".")
+	token, err := api.CloudflareToken("", domain)
+	if err != nil {
+		return nil, err
+	}
+	return bandaid.AutoCloudflare(token).SetDomain(domain), nil
+}
+
+func (api *API) ACME_POST_PRESENT(ctx *gin.Context) {
+	challenge := HTTPReqChallenge{}
+	if IsError(400, ctx.BindJSON(&challenge), ctx) {
+		return
+	}
+	fqdn, value, err := challenge.Record()
+	if IsError(400, err, ctx) {
+		return
+	}
+	auto, err := api.challengeClient(fqdn)
+	if IsError(400, err, ctx) {
+		return
+	}
+
+	if _, err := auto.PresentChallenge(fqdn, value); IsError(500, err, ctx) {
+		return
+	}
+
+	timeout, err := time.ParseDuration(api.Config.Section("acme").Key("propagation_timeout").MustString("2m"))
+	if IsError(500, err, ctx) {
+		return
+	}
+	if IsError(504, auto.WaitForChallenge(fqdn, value, timeout), ctx) {
+		return
+	}
+	ctx.String(200, "OK")
+}
+
+func (api *API) ACME_POST_CLEANUP(ctx *gin.Context) {
+	challenge := HTTPReqChallenge{}
+	if IsError(400, ctx.BindJSON(&challenge), ctx) {
+		return
+	}
+	fqdn, value, err := challenge.Record()
+	if IsError(400, err, ctx) {
+		return
+	}
+	auto, err := api.challengeClient(fqdn)
+	if IsError(400, err, ctx) {
+		return
+	}
+
+	if IsError(500, auto.CleanupChallenge(fqdn, value), ctx) {
+		return
+	}
+	ctx.String(200, "OK")
+}
+
+// ApplyEdgeSettings applies a Bandaidfile's [dns.cloudflare] settings to the application's domain.
+func (api *API) ApplyEdgeSettings(config *BandaidFile) error {
+	edge := config.DNS.Cloudflare
+	host := config.DNS.Domain
+	if host == "" {
+		return fmt.Errorf("[dns.cloudflare] requires a [dns] domain")
+	}
+	token, err := api.CloudflareToken(config.DNS.Zone, host)
+	if err != nil {
+		return err
+	}
+	auto := bandaid.AutoCloudflare(token).
+		SetZone(config.DNS.Zone).
+		SetAccount(config.DNS.Account).
+		SetDomain(host)
+
+	if edge.SSL != "" {
+		if err := auto.SetSSLMode(edge.SSL); err != nil {
+			return err
+		}
+	}
+
+	rules := []bandaid.PageRule{}
+	for _, redirect := range edge.Redirects {
+		status := redirect.Status
+		if status == 0 {
+			status = 301
+		}
+		rules = append(rules, bandaid.RedirectRule(host, redirect.Path, redirect.To, status))
+	}
+	for _, cache := range edge.Cache {
+		rules = append(rules, bandaid.CacheRule(host, cache.Path, cache.EdgeTTL))
+	}
+	// Leave page rules alone unless the Bandaidfile manages them, someone may have set them up by hand
+	if len(rules) > 0 {
+		if err := auto.ApplyPageRules(host, rules); err != nil {
+			return err
+		}
+	}
+
+	hosts := []string{}
+	if edge.Purge {
+		hosts = append(hosts, host)
+	}
+	return auto.PurgeCache(hosts, edge.PurgePrefixes)
+}
+
+// RemoveEdgeSettings removes the page rules created for a Bandaidfile's [dns.cloudflare] settings.
+func (api *API) RemoveEdgeSettings(config *BandaidFile) error {
+	edge := config.DNS.Cloudflare
+	if len(edge.Redirects) == 0 && len(edge.Cache) == 0 {
+		return nil
+	}
+	token, err := api.CloudflareToken(config.DNS.Zone, config.DNS.Domain)
+	if err != nil {
+		return err
+	}
+	return bandaid.AutoCloudflare(token).
+		SetZone(config.DNS.Zone).
+		SetAccount(config.DNS.Account).
+		SetDomain(config.DNS.Domain).
+		RemovePageRules(config.DNS.Domain)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/nokusukun/bandaid"
+)
+
+func TestHTTPReqChallengeRecord(t *testing.T) {
+	tests := []struct {
+		challenge HTTPReqChallenge
+		fqdn      string
+		err       string
+	}{
+		{HTTPReqChallenge{FQDN: "_acme-challenge.example.com.", Value: "v"}, "_acme-challenge.example.com.", ""},
+		{HTTPReqChallenge{FQDN: "_ACME-Challenge.example.com.", Value: "v"}, "_ACME-Challenge.example.com.", ""},
+		{HTTPReqChallenge{Domain: "example.com", KeyAuth: "key"}, "_acme-challenge.example.com.", ""},
+		{HTTPReqChallenge{FQDN: "example.com.", Value: "v"}, "", "not an ACME challenge record"},
+		{HTTPReqChallenge{FQDN: "www._acme-challenge.example.com.", Value: "v"}, "", "not an ACME challenge record"},
+		{HTTPReqChallenge{FQDN: "_acme-challenge.example.com."}, "", "must be provided"},
+	}
+	for _, test := range tests {
+		fqdn, _, err := test.challenge.Record()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%+v failed: %v", test.challenge, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%+v returned %v, want %q", test.challenge, err, test.err)
+		case fqdn != test.fqdn:
+			t.Errorf("%+v wrote %q, want %q", test.challenge, fqdn, test.fqdn)
+		}
+	}
+}
+
+func TestACMERoutesRequireCredentials(t *testing.T) {
+	tests := []struct {
+		config string
+		code   int
+	}{
+		{"[acme]\nusername=\npassword=\n", 404},
+		{"[acme]\nusername=caddy\npassword=\n", 404},
+		{"[acme]\nusername=caddy\npassword=secret\n", 401},
+	}
+	for _, test := range tests {
+		testAPI(t, test.config)
+		w := httptest.NewRecorder()
+		api.BuildAPI().ServeHTTP(w, httptest.NewRequest("POST", "/acme/httpreq/present",
+			strings.NewReader(`{"fqdn": "_acme-challenge.example.com.", "value": "v"}`)))
+		if w.Code != test.code {
+			t.Errorf("%q answered %v, want %v", test.config, w.Code, test.code)
+		}
+	}
+}
+
+func TestDNSTokensPendingUntilVerified(t *testing.T) {
+	testAPI(t, "[cloudflare]\nexample.com=token\n")
+	w := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(w)
+	ctx.Request = httptest.NewRequest("GET", "/manager/dns/tokens", nil)
+	api.MANAGER_GET_DNS_TOKENS(ctx)
+
+	tokens := map[string]*bandaid.TokenVerification{}
+	if err := json.Unmarshal(w.Body.Bytes(), &tokens); err != nil {
+		t.Fatal(err)
+	}
+	if token := tokens["example.com"]; token == nil || token.Status != TokenPending || token.OK {
+		t.Errorf("reported %s before verifying, want example.com pending", w.Body.Bytes())
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/ini.v1"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AppEvent is something that happened to an application. IDs order an application's events, Actor is who
+// caused it, the system or whoever triggered a deployment, and Deployment the deployment it belongs to.
+type AppEvent struct {
+	ID         int64             `json:"id"`
+	Timestamp  time.Time         `json:"timestamp"`
+	Kind       string            `json:"kind,omitempty"`
+	Severity   string            `json:"severity,omitempty"`
+	Actor      string            `json:"actor,omitempty"`
+	Deployment int               `json:"deployment,omitempty"`
+	Fields     map[string]string `json:"fields,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	Message    string            `json:"message,omitempty"`
+}
+
+// The kinds of events, webhooks are delivered with them. Events logged without one are messages or errors.
+const (
+	EventMessage           = "message"
+	EventError             = "error"
+	EventDeployStarted     = "deploy.started"
+	EventDeploySucceeded   = "deploy.succeeded"
+	EventDeployFailed      = "deploy.failed"
+	EventProcessStarted    = "process.started"
+	EventProcessExited     = "process.exited"
+	EventProcessRestarting = "process.restarting"
+	EventProcessCrashLoop  = "process.crash_loop"
+	EventProcessStopped    = "process.stopped"
+	EventHealthChanged     = "health.changed"
+	EventTrafficSwitched   = "traffic.switched"
+)
+
+// The severities of events, from least to most severe.
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+var severities = []string{SeverityInfo, SeverityWarning, SeverityError}
+
+func severityRank(severity string) int {
+	for i, known := range severities {
+		if severity == known {
+			return i
+		}
+	}
+	return -1
+}
+
+// The severity of the events of a kind that don't have an error.
+var kindSeverities = map[string]string{
+	EventProcessRestarting: SeverityWarning,
+	EventProcessCrashLoop:  SeverityError,
+	EventDeployFailed:      SeverityError,
+}
+
+const ActorSystem = "system"
+
+// normalize fills in what the event was logged without, events saved by older versions too.
+func (event *AppEvent) normalize() {
+	if event.Timestamp.IsZero() {
+		event.Timestamp = time.Now()
+	}
+	if event.Kind == "" {
+		event.Kind = EventMessage
+		if event.Error != "" {
+			event.Kind = EventError
+		}
+	}
+	if event.Severity == "" {
+		event.Severity = SeverityInfo
+		if severity, exists := kindSeverities[event.Kind]; exists {
+			event.Severity = severity
+		}
+		if event.Error != "" {
+			event.Severity = SeverityError
+		}
+	}
+	if event.Actor == "" {
+		event.Actor = ActorSystem
+	}
+}
+
+// Actor names who triggered a deployment, for its events.
+func (trigger Trigger) Actor() string {
+	if trigger.User == "" {
+		return trigger.Source
+	}
+	return trigger.Source + ":" + trigger.User
+}
+
+// eventSettings is the [events] section of config.ini, how many events of an application are kept and for how
+// long.
+type eventSettings struct {
+	Directory string
+	MaxEvents int
+	MaxAge    time.Duration
+}
+
+func loadEventSettings(config *ini.File) eventSettings {
+	section := config.Section("events")
+	return eventSettings{
+		Directory: section.Key("directory").MustString("events"),
+		MaxEvents: section.Key("max_events").MustInt(1000),
+		MaxAge:    section.Key("max_age").MustDuration(30 * 24 * time.Hour),
+	}
+}
+
+func (api *API) eventSettings() eventSettings {
+	if api == nil || api.Config == nil {
+		return loadEventSettings(ini.Empty())
+	}
+	return loadEventSettings(api.Config)
+}
+
+// retain drops the oldest events beyond the limits.
+func (settings eventSettings) retain(events []*AppEvent, now time.Time) []*AppEvent {
+	start := 0
+	if settings.MaxEvents > 0 && len(events) > settings.MaxEvents {
+		start = len(events) - settings.MaxEvents
+	}
+	for settings.MaxAge > 0 && start < len(events) && now.Sub(events[start].Timestamp) > settings.MaxAge {
+		start++
+	}
+	if start == 0 {
+		return events
+	}
+	return append([]*AppEvent{}, events[start:]...)
+}
+
+func (settings eventSettings) path(id string) string {
+	return filepath.Join(settings.Directory, id+".jsonl")
+}
+
+// writeEvent appends the event to the application's event log, a line of JSON per event. The log is rewritten
+// with the retained events once it's twice as long as max_events, or twice as long as what max_age kept. It's
+// called with the application's lock held, so events are written in order.
+func (app *Application) writeEvent(event *AppEvent, settings eventSettings) {
+	limited := settings.MaxEvents > 0 && app.events_logged >= 2*settings.MaxEvents
+	if limited || len(app.Events) < app.events_logged/2 {
+		app.rewriteEvents(settings)
+		return
+	}
+	err := os.MkdirAll(settings.Directory, 0700)
+	if err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(settings.path(app.ID), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err == nil {
+			b, _ := json.Marshal(event)
+			_, err = file.Write(append(b, '\n'))
+			file.Close()
+		}
+	}
+	if err != nil {
+		log.Printf("[events] %v: failed to save an event: %v\n", app.ID, err)
+		return
+	}
+	app.events_logged++
+}
+
+// rewriteEvents replaces the event log with the retained events, with the application's lock held.
+func (app *Application) rewriteEvents(settings eventSettings) {
+	var b []byte
+	for _, event := range app.Events {
+		line, _ := json.Marshal(event)
+		b = append(append(b, line...), '\n')
+	}
+	err := os.MkdirAll(settings.Directory, 0700)
+	if err == nil {
+		err = writeFileAtomic(settings.path(app.ID), b, 0600)
+	}
+	if err != nil {
+		log.Printf("[events] %v: failed to save the events: %v\n", app.ID, err)
+		return
+	}
+	app.events_logged = len(app.Events)
+}
+
+// loadEvents reads the application's event log, or takes the events saved in state.json by older versions,
+// and applies the retention limits.
+func (app *Application) loadEvents(legacy []*AppEvent) error {
+	settings := api.eventSettings()
+	events := legacy
+	file, err := os.Open(settings.path(app.ID))
+	if err == nil {
+		defer file.Close()
+		events = []*AppEvent{}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+		for scanner.Scan() {
+			event := &AppEvent{}
+			if json.Unmarshal(scanner.Bytes(), event) == nil {
+				events = append(events, event)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	last := int64(0)
+	for _, event := range events {
+		if event.ID <= last {
+			event.ID = last + 1
+		}
+		last = event.ID
+		event.normalize()
+	}
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	app.Events, app.last_event_id = settings.retain(events, time.Now()), last
+	app.rewriteEvents(settings)
+	return nil
+}
+
+// removeEvents deletes the application's event log, when it's deleted.
+func (app *Application) removeEvents() {
+	if err := os.Remove(api.eventSettings().path(app.ID)); err != nil && !os.IsNotExist(err) {
+		log.Printf("[events] %v: failed to remove the events: %v\n", app.ID, err)
+	}
+}
+
+// eventQuery filters events: kinds match exactly or as a prefix before a dot, deploy matches deploy.started,
+// severity keeps the events at or above it, and before the ones older than an event ID, to page through them.
+type eventQuery struct {
+	kinds    []string
+	severity int
+	since    time.Time
+	until    time.Time
+	before   int64
+}
+
+func parseEventQuery(ctx *gin.Context) (*eventQuery, error) {
+	query := &eventQuery{kinds: splitList(ctx.Query("kind")), severity: -1}
+	if severity := ctx.Query("severity"); severity != "" {
+		if query.severity = severityRank(severity); query.severity < 0 {
+			return nil, fmt.Errorf("unknown severity '%v', use %v", severity, strings.Join(severities, ", "))
+		}
+	}
+	var err error
+	if query.since, err = parseLogTime(ctx.Query("since")); err != nil {
+		return nil, err
+	}
+	if query.until, err = parseLogTime(ctx.Query("until")); err != nil {
+		return nil, err
+	}
+	if before := ctx.Query("before"); before != "" {
+		if query.before, err = strconv.ParseInt(before, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid before '%v'", before)
+		}
+	}
+	return query, nil
+}
+
+func (query *eventQuery) match(event *AppEvent) bool {
+	if query.before != 0 && event.ID >= query.before {
+		return false
+	}
+	if query.severity >= 0 && severityRank(event.Severity) < query.severity {
+		return false
+	}
+	if !query.since.IsZero() && event.Timestamp.Before(query.since) {
+		return false
+	}
+	if !query.until.IsZero() && event.Timestamp.After(query.until) {
+		return false
+	}
+	if len(query.kinds) == 0 {
+		return true
+	}
+	for _, kind := range query.kinds {
+		if event.Kind == kind || strings.HasPrefix(event.Kind, kind+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// EventPage is a page of events, oldest first. Next is the ?before= of the page before it, when there's one.
+type EventPage struct {
+	Events []*AppEvent `json:"events"`
+	Next   int64       `json:"next,omitempty"`
+}
+
+// MANAGER_GET_EVENTS returns the application's last ?limit= events, 100 by default, filtered by ?kind=,
+// ?severity=, ?since= and ?until=. ?before= pages back through older ones.
+func (api *API) MANAGER_GET_EVENTS(ctx *gin.Context) {
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+	query, err := parseEventQuery(ctx)
+	if IsError(400, err, ctx) {
+		return
+	}
+	limit := 100
+	if value := ctx.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			IsError(400, fmt.Errorf("invalid limit '%v'", value), ctx)
+			return
+		}
+	}
+
+	page := EventPage{Events: []*AppEvent{}}
+	events := service.EventList()
+	for i := len(events) - 1; i >= 0; i-- {
+		if !query.match(events[i]) {
+			continue
+		}
+		if len(page.Events) == limit {
+			page.Next = page.Events[len(page.Events)-1].ID
+			break
+		}
+		page.Events = append(page.Events, events[i])
+	}
+	for i, j := 0, len(page.Events)-1; i < j; i, j = i+1, j-1 {
+		page.Events[i], page.Events[j] = page.Events[j], page.Events[i]
+	}
+	ctx.JSON(200, page)
+}
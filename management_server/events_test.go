@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteEventCompacts(t *testing.T) {
+	start := time.Now()
+	tests := []struct {
+		name     string
+		settings eventSettings
+		ages     []time.Duration // how long after start each event is written
+		lines    int
+	}{
+		{"max_events", eventSettings{MaxEvents: 2}, []time.Duration{0, 0, 0, 0, 0}, 2},
+		{"unlimited", eventSettings{}, []time.Duration{0, 0, 0, 0, 0}, 5},
+		{"max_age only", eventSettings{MaxAge: time.Hour}, []time.Duration{0, 0, 0, 0, 2 * time.Hour}, 1},
+	}
+	for _, test := range tests {
+		directory := testAPI(t, "")
+		settings := test.settings
+		settings.Directory = directory + "/events"
+		// As add_event does
+		app := &Application{ID: "app"}
+		for _, age := range test.ages {
+			event := &AppEvent{Timestamp: start.Add(age), Message: "event"}
+			app.Events = settings.retain(append(app.Events, event), event.Timestamp)
+			app.writeEvent(event, settings)
+		}
+
+		b, err := ioutil.ReadFile(settings.path(app.ID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := bytes.Count(b, []byte("\n")); lines != test.lines || app.events_logged != test.lines {
+			t.Errorf("%v logged %v lines (counted %v), want %v", test.name, lines, app.events_logged, test.lines)
+		}
+	}
+}
+
+func TestOnlyStateChangesPersist(t *testing.T) {
+	directory := testAPI(t, "")
+	app := &Application{ID: "app"}
+	if err := api.apps.Add(app); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Log_Eventf("an event")
+	if _, err := os.Stat(directory + "/state.json"); !os.IsNotExist(err) {
+		t.Fatalf("an event saved the state: %v", err)
+	}
+	app.setState(StateCloning)
+	state, err := api.store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := state.Applications["app"]; stored == nil || stored.State != StateCloning || len(stored.Events) != 0 {
+		t.Errorf("saved %+v, want the cloning state without events", stored)
+	}
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/ini.v1"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ForwardSyslog = "syslog"
+	ForwardLoki   = "loki"
+	ForwardHTTP   = "http"
+)
+
+// ForwardEntry is a line of an application's output, or one of its events, as it's forwarded.
+type ForwardEntry struct {
+	App        string    `json:"app"`
+	Repository string    `json:"repository"`
+	Stream     string    `json:"stream"`
+	Timestamp  time.Time `json:"timestamp"`
+	Level      string    `json:"level,omitempty"`
+	Text       string    `json:"text"`
+}
+
+// destination delivers entries to wherever logs are centralized. It returns how many of them, in order,
+// were delivered before it failed.
+type destination interface {
+	Send(entries []ForwardEntry) (int, error)
+}
+
+// rejectedError is returned by destinations that won't ever take the entries, they aren't retried.
+type rejectedError struct {
+	error
+}
+
+// forwarder batches entries for a destination, set in a [forward.<name>] section of config.ini. Entries wait in
+// a bounded queue while it's slow or unreachable, the ones that don't fit are dropped so applications never
+// wait on it.
+type forwarder struct {
+	Name          string
+	Type          string
+	Streams       map[string]bool
+	BatchSize     int
+	FlushInterval time.Duration
+
+	destination destination
+	queue       chan ForwardEntry
+
+	lock      sync.Mutex
+	sent      uint64
+	dropped   uint64
+	dropping  bool
+	lastError string
+}
+
+// ForwarderStatus is what a forwarder has done so far.
+type ForwarderStatus struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Queued    int    `json:"queued"`
+	Sent      uint64 `json:"sent"`
+	Dropped   uint64 `json:"dropped"`
+	LastError string `json:"last_error,omitempty"`
+}
+
+// loadForwarders reads the [forward.<name>] sections of config.ini.
+func loadForwarders(config *ini.File) ([]*forwarder, error) {
+	forwarders := []*forwarder{}
+	for _, section := range config.Sections() {
+		if !strings.HasPrefix(section.Name(), "forward.") {
+			continue
+		}
+		f, err := newForwarder(section)
+		if err != nil {
+			return nil, fmt.Errorf("[%v]: %v", section.Name(), err)
+		}
+		forwarders = append(forwarders, f)
+	}
+	return forwarders, nil
+}
+
+func newForwarder(section *ini.Section) (*forwarder, error) {
+	f := &forwarder{
+		Name:          strings.TrimPrefix(section.Name(), "forward."),
+		Type:          section.Key("type").String(),
+		Streams:       map[string]bool{},
+		BatchSize:     section.Key("batch").MustInt(100),
+		FlushInterval: section.Key("flush").MustDuration(time.Second),
+		queue:         make(chan ForwardEntry, section.Key("buffer").MustInt(10000)),
+	}
+	for _, stream := range strings.Split(section.Key("streams").MustString("stdout,stderr,events"), ",") {
+		stream = strings.TrimSpace(stream)
+		if stream != StreamStdout && stream != StreamStderr && stream != StreamEvents {
+			return nil, fmt.Errorf("unknown stream '%v'", stream)
+		}
+		f.Streams[stream] = true
+	}
+	if f.BatchSize < 1 || f.FlushInterval <= 0 {
+		return nil, fmt.Errorf("batch and flush have to be positive")
+	}
+
+	address := section.Key("url").String()
+	target, err := url.Parse(address)
+	if err != nil || target.Host == "" {
+		return nil, fmt.Errorf("invalid url '%v'", address)
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	authorization := section.Key("authorization").String()
+	switch f.Type {
+	case ForwardSyslog:
+		if target.Scheme != "udp" && target.Scheme != "tcp" && target.Scheme != "tls" {
+			return nil, fmt.Errorf("syslog urls start with udp://, tcp:// or tls://")
+		}
+		facility := section.Key("facility").MustInt(1)
+		if facility < 0 || facility > 23 {
+			return nil, fmt.Errorf("facility must be between 0 and 23")
+		}
+		hostname, _ := os.Hostname()
+		f.destination = &syslogDestination{network: target.Scheme, address: target.Host, facility: facility,
+			hostname: hostname}
+	case ForwardLoki, ForwardHTTP:
+		if target.Scheme != "http" && target.Scheme != "https" {
+			return nil, fmt.Errorf("%v urls start with http:// or https://", f.Type)
+		}
+		if f.Type == ForwardLoki {
+			f.destination = &lokiDestination{url: address, authorization: authorization, client: client}
+		} else {
+			f.destination = &httpDestination{url: address, authorization: authorization, client: client}
+		}
+	default:
+		return nil, fmt.Errorf("unknown type '%v', use syslog, loki or http", f.Type)
+	}
+	return f, nil
+}
+
+// enqueue queues the entry without ever blocking, dropping it when the queue is full.
+func (f *forwarder) enqueue(entry ForwardEntry) {
+	if !f.Streams[entry.Stream] {
+		return
+	}
+	select {
+	case f.queue <- entry:
+	default:
+		f.lock.Lock()
+		f.dropped++
+		if !f.dropping {
+			log.Printf("[forward.%v] queue is full, dropping entries until it catches up\n", f.Name)
+		}
+		f.dropping = true
+		f.lock.Unlock()
+	}
+}
+
+// run sends the queued entries in batches of BatchSize, or whatever has been queued every FlushInterval.
+func (f *forwarder) run() {
+	ticker := time.NewTicker(f.FlushInterval)
+	defer ticker.Stop()
+	batch := make([]ForwardEntry, 0, f.BatchSize)
+	for {
+		select {
+		case entry := <-f.queue:
+			batch = append(batch, entry)
+			if len(batch) < f.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		f.deliver(batch)
+		batch = batch[:0]
+	}
+}
+
+// deliver retries the batch with a growing delay until the destination takes it or rejects it. The queue fills
+// up meanwhile, which is where the backpressure ends.
+func (f *forwarder) deliver(batch []ForwardEntry) {
+	delay := time.Second
+	for {
+		sent, err := f.destination.Send(batch)
+		batch = batch[sent:]
+		f.lock.Lock()
+		f.sent += uint64(sent)
+		var rejected rejectedError
+		if err == nil || errors.As(err, &rejected) {
+			if err != nil {
+				f.dropped += uint64(len(batch))
+				f.lastError = err.Error()
+				log.Printf("[forward.%v] dropped %v entries: %v\n", f.Name, len(batch), err)
+			} else {
+				f.lastError = ""
+			}
+			f.dropping = false
+			f.lock.Unlock()
+			return
+		}
+		if f.lastError == "" {
+			log.Printf("[forward.%v] failed to send entries, retrying: %v\n", f.Name, err)
+		}
+		f.lastError = err.Error()
+		f.lock.Unlock()
+		time.Sleep(delay)
+		if delay *= 2; delay > 30*time.Second {
+			delay = 30 * time.Second
+		}
+	}
+}
+
+func (f *forwarder) Status() ForwarderStatus {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return ForwarderStatus{
+		Name:      f.Name,
+		Type:      f.Type,
+		Queued:    len(f.queue),
+		Sent:      f.sent,
+		Dropped:   f.dropped,
+		LastError: f.lastError,
+	}
+}
+
+// forward hands the entry to every forwarder.
+func (api *API) forward(entry ForwardEntry) {
+	if api == nil {
+		return
+	}
+	for _, f := range api.forwarders {
+		f.enqueue(entry)
+	}
+}
+
+// StartForwarders starts the forwarders set in config.ini, before any application writes to them.
+func (api *API) StartForwarders() error {
+	forwarders, err := loadForwarders(api.Config)
+	if err != nil {
+		return err
+	}
+	for _, f := range forwarders {
+		log.Printf("[startup] Forwarding %v to %v\n", strings.Join(streamNames(f.Streams), ","), f.Name)
+		go f.run()
+	}
+	api.forwarders = forwarders
+	return nil
+}
+
+func streamNames(streams map[string]bool) []string {
+	names := []string{}
+	for _, stream := range []string{StreamStdout, StreamStderr, StreamEvents} {
+		if streams[stream] {
+			names = append(names, stream)
+		}
+	}
+	return names
+}
+
+func (api *API) MANAGER_GET_FORWARDERS(ctx *gin.Context) {
+	statuses := []ForwarderStatus{}
+	for _, f := range api.forwarders {
+		statuses = append(statuses, f.Status())
+	}
+	ctx.JSON(200, statuses)
+}
+
+// syslogDestination sends RFC 5424 messages, one per datagram over UDP and octet counted over TCP and TLS.
+type syslogDestination struct {
+	network  string
+	address  string
+	facility int
+	hostname string
+
+	conn net.Conn
+}
+
+// The private enterprise number reserved for documentation, which names the structured data of the messages.
+const syslogEnterprise = 32473
+
+var syslogEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func syslogSeverity(entry ForwardEntry) int {
+	switch entry.Level {
+	case "trace", "debug":
+		return 7
+	case "info":
+		return 6
+	case "warn":
+		return 4
+	case "error":
+		return 3
+	case "fatal":
+		return 2
+	}
+	if entry.Stream == StreamStderr {
+		return 3
+	}
+	return 6
+}
+
+func (d *syslogDestination) format(entry ForwardEntry) string {
+	hostname := d.hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	return fmt.Sprintf(`<%v>1 %v %v %v - %v [bandaid@%v app="%v" repository="%v"] %v`,
+		d.facility*8+syslogSeverity(entry), entry.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, entry.App, entry.Stream, syslogEnterprise, syslogEscaper.Replace(entry.App),
+		syslogEscaper.Replace(entry.Repository), entry.Text)
+}
+
+func (d *syslogDestination) Send(entries []ForwardEntry) (int, error) {
+	if d.conn == nil {
+		dialer := &net.Dialer{Timeout: 10 * time.Second}
+		var err error
+		if d.network == "tls" {
+			d.conn, err = tls.DialWithDialer(dialer, "tcp", d.address, &tls.Config{})
+		} else {
+			d.conn, err = dialer.Dial(d.network, d.address)
+		}
+		if err != nil {
+			d.conn = nil
+			return 0, err
+		}
+	}
+	for i, entry := range entries {
+		message := d.format(entry)
+		if d.network != "udp" {
+			message = fmt.Sprintf("%v %v", len(message), message)
+		}
+		_ = d.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		if _, err := io.WriteString(d.conn, message); err != nil {
+			_ = d.conn.Close()
+			d.conn = nil
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+// postJSON posts the body, answers other than 2xx are errors and the ones retrying won't fix are rejected.
+func postJSON(client *http.Client, url string, authorization string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return rejectedError{err}
+	}
+	request, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		return rejectedError{err}
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	err = fmt.Errorf("%v answered %v: %v", url, resp.Status, strings.TrimSpace(string(message)))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != 408 && resp.StatusCode != 429 {
+		return rejectedError{err}
+	}
+	return err
+}
+
+// lokiDestination pushes to Loki's push API, labelling the lines with the application, repository, stream and
+// level.
+type lokiDestination struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+func (d *lokiDestination) Send(entries []ForwardEntry) (int, error) {
+	type lokiStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+	streams := []*lokiStream{}
+	byLabels := map[string]*lokiStream{}
+	for _, entry := range entries {
+		key := entry.App + "\x00" + entry.Stream + "\x00" + entry.Level
+		stream, exists := byLabels[key]
+		if !exists {
+			stream = &lokiStream{Stream: map[string]string{
+				"job":        "bandaid",
+				"app":        entry.App,
+				"repository": entry.Repository,
+				"stream":     entry.Stream,
+			}}
+			if entry.Level != "" {
+				stream.Stream["level"] = entry.Level
+			}
+			byLabels[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.Values = append(stream.Values, [2]string{fmt.Sprint(entry.Timestamp.UnixNano()), entry.Text})
+	}
+	if err := postJSON(d.client, d.url, d.authorization, map[string]interface{}{"streams": streams}); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
+
+// httpDestination posts every batch as a JSON array of entries.
+type httpDestination struct {
+	url           string
+	authorization string
+	client        *http.Client
+}
+
+func (d *httpDestination) Send(entries []ForwardEntry) (int, error) {
+	if err := postJSON(d.client, d.url, d.authorization, entries); err != nil {
+		return 0, err
+	}
+	return len(entries), nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gopkg.in/ini.v1"
+)
+
+func testForwarder(t *testing.T, config string) *forwarder {
+	file, err := ini.Load([]byte("[forward.test]\n" + config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	forwarders, err := loadForwarders(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if syslog, ok := forwarders[0].destination.(*syslogDestination); ok {
+		syslog.hostname = "host"
+	}
+	return forwarders[0]
+}
+
+var forwardTime = time.Date(2020, 10, 9, 8, 7, 6, 543210000, time.UTC)
+
+func forwardEntries(n int) []ForwardEntry {
+	entries := []ForwardEntry{}
+	for i := 0; i < n; i++ {
+		entries = append(entries, ForwardEntry{App: "app", Repository: "https://example.com/app.git",
+			Stream: StreamStdout, Timestamp: forwardTime, Text: fmt.Sprintf("line %v", i)})
+	}
+	return entries
+}
+
+func TestLoadForwardersValidates(t *testing.T) {
+	tests := []string{
+		"type=syslog\nurl=http://localhost:514\n",
+		"type=syslog\nurl=udp://localhost:514\nfacility=24\n",
+		"type=loki\nurl=udp://localhost:3100\n",
+		"type=http\nurl=http://localhost\nstreams=stdout,audit\n",
+		"type=kafka\nurl=http://localhost\n",
+		"type=http\nurl=http://localhost\nbatch=0\n",
+	}
+	for _, config := range tests {
+		file, _ := ini.Load([]byte("[forward.test]\n" + config))
+		if _, err := loadForwarders(file); err == nil {
+			t.Errorf("%q was accepted", config)
+		}
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	d := &syslogDestination{facility: 1, hostname: "host"}
+	tests := []struct {
+		entry ForwardEntry
+		want  string
+	}{
+		{
+			ForwardEntry{App: "app", Repository: "repo", Stream: StreamStdout, Timestamp: forwardTime, Text: "hello"},
+			`<14>1 2020-10-09T08:07:06.543210Z host app - stdout [bandaid@32473 app="app" repository="repo"] hello`,
+		},
+		{
+			ForwardEntry{App: "app", Repository: `a"b]`, Stream: StreamStderr, Timestamp: forwardTime, Text: "oops"},
+			`<11>1 2020-10-09T08:07:06.543210Z host app - stderr [bandaid@32473 app="app" repository="a\"b\]"] oops`,
+		},
+		{
+			ForwardEntry{App: "app", Stream: StreamStdout, Level: "warn", Timestamp: forwardTime, Text: "careful"},
+			`<12>1 2020-10-09T08:07:06.543210Z host app - stdout [bandaid@32473 app="app" repository=""] careful`,
+		},
+	}
+	for _, test := range tests {
+		if got := d.format(test.entry); got != test.want {
+			t.Errorf("got  %v\nwant %v", got, test.want)
+		}
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f := testForwarder(t, "type=syslog\nurl=udp://"+conn.LocalAddr().String()+"\n")
+
+	entries := forwardEntries(2)
+	if sent, err := f.destination.Send(entries); sent != 2 || err != nil {
+		t.Fatalf("sent %v: %v", sent, err)
+	}
+	buffer := make([]byte, 2048)
+	for _, entry := range entries {
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := f.destination.(*syslogDestination).format(entry); string(buffer[:n]) != want {
+			t.Errorf("got datagram %q, want %q", buffer[:n], want)
+		}
+	}
+}
+
+// readOctetCounted reads a message framed as in RFC 6587, its length, a space and the message.
+func readOctetCounted(reader *bufio.Reader) (string, error) {
+	length, err := reader.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(length))
+	if err != nil {
+		return "", err
+	}
+	message := make([]byte, n)
+	if _, err := io.ReadFull(reader, message); err != nil {
+		return "", err
+	}
+	return string(message), nil
+}
+
+func TestSyslogTCPReconnects(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	f := testForwarder(t, "type=syslog\nurl=tcp://"+listener.Addr().String()+"\n")
+	d := f.destination.(*syslogDestination)
+
+	messages := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			for {
+				message, err := readOctetCounted(reader)
+				if err != nil {
+					break
+				}
+				messages <- message
+			}
+			conn.Close()
+		}
+	}()
+
+	receive := func(entry ForwardEntry) {
+		select {
+		case message := <-messages:
+			if want := d.format(entry); message != want {
+				t.Errorf("got %q, want %q", message, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the message never arrived")
+		}
+	}
+
+	entries := forwardEntries(3)
+	if sent, err := d.Send(entries[:2]); sent != 2 || err != nil {
+		t.Fatalf("sent %v: %v", sent, err)
+	}
+	receive(entries[0])
+	receive(entries[1])
+
+	// A broken connection is dialed again on the next send
+	d.conn.Close()
+	if _, err := d.Send(entries[2:]); err == nil {
+		t.Fatal("sending over a closed connection succeeded")
+	}
+	if sent, err := d.Send(entries[2:]); sent != 1 || err != nil {
+		t.Fatalf("sent %v after reconnecting: %v", sent, err)
+	}
+	receive(entries[2])
+}
+
+// sink is a local HTTP receiver that fails the first requests with the given statuses.
+type sink struct {
+	lock     sync.Mutex
+	failures []int
+	bodies   [][]byte
+	headers  []http.Header
+	received chan struct{}
+}
+
+func newSink(failures ...int) (*sink, *httptest.Server) {
+	s := &sink{failures: failures, received: make(chan struct{}, 100)}
+	return s, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if len(s.failures) > 0 {
+			status := s.failures[0]
+			s.failures = s.failures[1:]
+			w.WriteHeader(status)
+			return
+		}
+		s.bodies = append(s.bodies, body)
+		s.headers = append(s.headers, r.Header)
+		s.received <- struct{}{}
+	}))
+}
+
+func (s *sink) wait(t *testing.T, requests int) {
+	for i := 0; i < requests; i++ {
+		select {
+		case <-s.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v requests, want %v", i, requests)
+		}
+	}
+}
+
+func TestLokiFormat(t *testing.T) {
+	s, server := newSink()
+	defer server.Close()
+	f := testForwarder(t, "type=loki\nurl="+server.URL+"/loki/api/v1/push\nauthorization=Bearer token\n")
+
+	entries := forwardEntries(3)
+	entries[1].Stream, entries[1].Level = StreamStderr, "error"
+	if sent, err := f.destination.Send(entries); sent != 3 || err != nil {
+		t.Fatalf("sent %v: %v", sent, err)
+	}
+	s.wait(t, 1)
+
+	if got := s.headers[0].Get("Authorization"); got != "Bearer token" {
+		t.Errorf("sent Authorization %q", got)
+	}
+	if got := s.headers[0].Get("Content-Type"); got != "application/json" {
+		t.Errorf("sent Content-Type %q", got)
+	}
+	push := struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}{}
+	if err := json.Unmarshal(s.bodies[0], &push); err != nil {
+		t.Fatal(err)
+	}
+	if len(push.Streams) != 2 {
+		t.Fatalf("pushed %v streams, want stdout and stderr apart: %s", len(push.Streams), s.bodies[0])
+	}
+	stdout, stderr := push.Streams[0], push.Streams[1]
+	if stdout.Stream["app"] != "app" || stdout.Stream["stream"] != StreamStdout || stdout.Stream["job"] != "bandaid" ||
+		stdout.Stream["repository"] != "https://example.com/app.git" {
+		t.Errorf("stdout labels are %v", stdout.Stream)
+	}
+	if stderr.Stream["level"] != "error" || stderr.Stream["stream"] != StreamStderr {
+		t.Errorf("stderr labels are %v", stderr.Stream)
+	}
+	timestamp := fmt.Sprint(forwardTime.UnixNano())
+	if len(stdout.Values) != 2 || stdout.Values[0] != [2]string{timestamp, "line 0"} ||
+		stdout.Values[1] != [2]string{timestamp, "line 2"} {
+		t.Errorf("stdout values are %v", stdout.Values)
+	}
+}
+
+func TestForwarderBatches(t *testing.T) {
+	s, server := newSink()
+	defer server.Close()
+	f := testForwarder(t, "type=http\nurl="+server.URL+"\nbatch=3\nflush=100ms\nstreams=stdout\n")
+	go f.run()
+
+	for _, entry := range forwardEntries(7) {
+		f.enqueue(entry)
+	}
+	f.enqueue(ForwardEntry{App: "app", Stream: StreamStderr, Text: "not forwarded"})
+	s.wait(t, 3)
+
+	sizes := []int{}
+	texts := []string{}
+	for _, body := range s.bodies {
+		batch := []ForwardEntry{}
+		if err := json.Unmarshal(body, &batch); err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(batch))
+		for _, entry := range batch {
+			texts = append(texts, entry.Text)
+		}
+	}
+	if fmt.Sprint(sizes) != "[3 3 1]" {
+		t.Errorf("sent batches of %v, want [3 3 1]", sizes)
+	}
+	if want := "line 0,line 1,line 2,line 3,line 4,line 5,line 6"; strings.Join(texts, ",") != want {
+		t.Errorf("sent %v, want %v", texts, want)
+	}
+	// The last batch is counted once the sink answered
+	deadline := time.Now().Add(time.Second)
+	for f.Status().Sent != 7 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := f.Status(); status.Sent != 7 || status.Dropped != 0 {
+		t.Errorf("status is %+v", status)
+	}
+}
+
+func TestForwarderRetries(t *testing.T) {
+	s, server := newSink(503, 429)
+	defer server.Close()
+	f := testForwarder(t, "type=http\nurl="+server.URL+"\n")
+
+	started := time.Now()
+	f.deliver(forwardEntries(2))
+	if waited := time.Since(started); waited < 3*time.Second {
+		t.Errorf("retried after %v, want 1s and then 2s", waited)
+	}
+	s.wait(t, 1)
+	if status := f.Status(); status.Sent != 2 || status.LastError != "" {
+		t.Errorf("status is %+v", status)
+	}
+}
+
+func TestForwarderDropsRejected(t *testing.T) {
+	s, server := newSink(400)
+	defer server.Close()
+	f := testForwarder(t, "type=http\nurl="+server.URL+"\n")
+
+	f.deliver(forwardEntries(2))
+	status := f.Status()
+	if status.Sent != 0 || status.Dropped != 2 || !strings.Contains(status.LastError, "400") {
+		t.Errorf("status is %+v", status)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.failures) != 0 || len(s.bodies) != 0 {
+		t.Errorf("the rejected batch was sent again")
+	}
+}
+
+func TestForwarderDropsWhenFull(t *testing.T) {
+	f := testForwarder(t, "type=http\nurl=http://127.0.0.1:1\nbuffer=2\n")
+	for _, entry := range forwardEntries(5) {
+		f.enqueue(entry)
+	}
+	if status := f.Status(); status.Queued != 2 || status.Dropped != 3 {
+		t.Errorf("status is %+v", status)
+	}
+}
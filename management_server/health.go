@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HealthHTTP    = "http"
+	HealthTCP     = "tcp"
+	HealthCommand = "command"
+)
+
+// HealthCheck is the [health] table of a Bandaidfile, how the running service is checked in the background.
+// HTTP checks request path, application.health_endpoint by default, and expect expect_status or any 2xx or 3xx,
+// with expect_body somewhere in the body. TCP checks connect to the service, command checks run a command in
+// the checkout that has to exit with 0, on the host, so they aren't available to containers.
+type HealthCheck struct {
+	Type         string   `toml:"type"`
+	Path         string   `toml:"path"`
+	ExpectStatus int      `toml:"expect_status"`
+	ExpectBody   string   `toml:"expect_body"`
+	Command      []string `toml:"command"`
+	Interval     string   `toml:"interval"`
+	Timeout      string   `toml:"timeout"`
+}
+
+// Validate checks the health check of an application that runs in the given runtime.
+func (check HealthCheck) Validate(runtime string) error {
+	switch check.Type {
+	case "", HealthHTTP, HealthTCP:
+	case HealthCommand:
+		if len(check.Command) == 0 {
+			return fmt.Errorf("command health checks need a command")
+		}
+		if runtime == RuntimeContainer {
+			return fmt.Errorf("command health checks run on the host, use an http or tcp check for containers")
+		}
+	default:
+		return fmt.Errorf("unknown health check type '%v', use http, tcp or command", check.Type)
+	}
+	for _, duration := range []string{check.Interval, check.Timeout} {
+		if duration == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(duration); err != nil || d <= 0 {
+			return fmt.Errorf("invalid health check duration '%v'", duration)
+		}
+	}
+	return nil
+}
+
+func (check HealthCheck) Settings() (interval time.Duration, timeout time.Duration) {
+	interval, timeout = 30*time.Second, 5*time.Second
+	if d, err := time.ParseDuration(check.Interval); err == nil && d > 0 {
+		interval = d
+	}
+	if d, err := time.ParseDuration(check.Timeout); err == nil && d > 0 {
+		timeout = d
+	}
+	return
+}
+
+// HealthResult is the outcome of a single health check.
+type HealthResult struct {
+	Timestamp time.Time `json:"timestamp"`
+	Healthy   bool      `json:"healthy"`
+	LatencyMS float64   `json:"latency_ms"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// HealthStatus is the last health check of an application and its uptime, the percentage of healthy checks
+// over the last hour, day and week.
+type HealthStatus struct {
+	Checked   bool               `json:"checked"`
+	Healthy   bool               `json:"healthy"`
+	Error     string             `json:"error,omitempty"`
+	CheckedAt *time.Time         `json:"checked_at,omitempty"`
+	Since     *time.Time         `json:"since,omitempty"`
+	LatencyMS float64            `json:"latency_ms"`
+	Uptime    map[string]float64 `json:"uptime"`
+}
+
+// How much history is kept, it's only in memory and starts over with the manager.
+const (
+	healthHistoryWindow = 7 * 24 * time.Hour
+	healthHistoryMax    = 20160
+)
+
+var uptimeWindows = []struct {
+	name     string
+	duration time.Duration
+}{{"1h", time.Hour}, {"24h", 24 * time.Hour}, {"7d", 7 * 24 * time.Hour}}
+
+// healthState is the rolling health check history of an application.
+type healthState struct {
+	lock     sync.Mutex
+	history  []HealthResult
+	since    time.Time
+	next     time.Time
+	checking bool
+}
+
+func (app *Application) healthState() *healthState {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if app.health == nil {
+		app.health = &healthState{}
+	}
+	return app.health
+}
+
+// record adds the result to the history and tells if the application became healthy or unhealthy.
+func (health *healthState) record(result HealthResult) (changed bool, first bool) {
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	first = len(health.history) == 0
+	changed = first || health.history[len(health.history)-1].Healthy != result.Healthy
+	if changed {
+		health.since = result.Timestamp
+	}
+	health.history = append(health.history, result)
+	cutoff := 0
+	for cutoff < len(health.history) && result.Timestamp.Sub(health.history[cutoff].Timestamp) > healthHistoryWindow {
+		cutoff++
+	}
+	if len(health.history)-cutoff > healthHistoryMax {
+		cutoff = len(health.history) - healthHistoryMax
+	}
+	if cutoff > 0 {
+		health.history = append([]HealthResult{}, health.history[cutoff:]...)
+	}
+	health.checking = false
+	return changed, first
+}
+
+// HealthStatus returns the cached health of the application, it never checks it.
+func (app *Application) HealthStatus() HealthStatus {
+	health := app.healthState()
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	status := HealthStatus{Uptime: map[string]float64{}}
+	if len(health.history) == 0 {
+		return status
+	}
+	last := health.history[len(health.history)-1]
+	since := health.since
+	status.Checked, status.Healthy, status.Error = true, last.Healthy, last.Error
+	status.CheckedAt, status.Since, status.LatencyMS = &last.Timestamp, &since, last.LatencyMS
+	for _, window := range uptimeWindows {
+		checks, healthy := 0, 0
+		for i := len(health.history) - 1; i >= 0 && time.Since(health.history[i].Timestamp) <= window.duration; i-- {
+			checks++
+			if health.history[i].Healthy {
+				healthy++
+			}
+		}
+		if checks > 0 {
+			status.Uptime[window.name] = float64(healthy) * 100 / float64(checks)
+		}
+	}
+	return status
+}
+
+// HealthHistory returns the last limit results, all of them when limit is 0.
+func (app *Application) HealthHistory(limit int) []HealthResult {
+	health := app.healthState()
+	health.lock.Lock()
+	defer health.lock.Unlock()
+	history := health.history
+	if limit > 0 && len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return append([]HealthResult{}, history...)
+}
+
+// StartHealthChecks checks every running application on its own interval, in the background.
+func (api *API) StartHealthChecks() {
+	go func() {
+		for range time.Tick(time.Second) {
+			for _, app := range api.apps.Applications() {
+				app.scheduleHealthCheck()
+			}
+		}
+	}()
+}
+
+// scheduleHealthCheck starts a check of the running instance once its interval passed, unless one is still
+// running.
+func (app *Application) scheduleHealthCheck() {
+	health := app.healthState()
+	app.lock.Lock()
+	inst, state := app.current, app.State
+	var config *BandaidFile
+	if inst != nil {
+		config = inst.config
+	}
+	app.lock.Unlock()
+	if config == nil || state != StateRunning {
+		return
+	}
+
+	interval, _ := config.Health.Settings()
+	health.lock.Lock()
+	if health.checking || time.Now().Before(health.next) {
+		health.lock.Unlock()
+		return
+	}
+	health.checking, health.next = true, time.Now().Add(interval)
+	health.lock.Unlock()
+
+	go func() {
+		result := app.checkHealth(inst, config)
+		metrics.healthCheck(app.ID, time.Duration(result.LatencyMS*float64(time.Millisecond)), !result.Healthy)
+		changed, first := health.record(result)
+		if result.Healthy {
+			api.resolveAlert(app, AlertUnhealthy)
+		} else {
+			api.raiseAlert(app, AlertUnhealthy, result.Error)
+		}
+		event := &AppEvent{Kind: EventHealthChanged, Fields: map[string]string{
+			"healthy":    strconv.FormatBool(result.Healthy),
+			"latency_ms": strconv.FormatFloat(result.LatencyMS, 'f', 1, 64),
+		}}
+		switch {
+		case changed && !result.Healthy:
+			event.Error = "health check failed: " + result.Error
+			app.add_event(event)
+		case changed && !first:
+			event.Message = "Health check passing again"
+			app.add_event(event)
+		}
+	}()
+}
+
+// checkHealth runs the Bandaidfile's health check against the instance.
+func (app *Application) checkHealth(inst *instance, config *BandaidFile) HealthResult {
+	check := config.Health
+	_, timeout := check.Settings()
+	app.lock.Lock()
+	host, box := inst.host, inst.sandbox
+	directory := workDirectory(inst, config)
+	app.lock.Unlock()
+
+	started := time.Now()
+	var err error
+	switch check.Type {
+	case HealthTCP:
+		var conn net.Conn
+		if conn, err = net.DialTimeout("tcp", host, timeout); err == nil {
+			_ = conn.Close()
+		}
+	case HealthCommand:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, check.Command[0], check.Command[1:]...)
+		cmd.Dir = directory
+		cmd.Env = inst.runtime.Env(app, inst, config)
+		setProcessGroup(cmd)
+		if box != nil && box.user != "" {
+			setCredential(cmd, box.uid, box.gid)
+		}
+		if output, runErr := cmd.CombinedOutput(); runErr != nil {
+			message := strings.TrimSpace(string(output))
+			if len(message) > 200 {
+				message = message[:200] + "..."
+			}
+			err = fmt.Errorf("%v: %v", runErr, message)
+			if ctx.Err() == context.DeadlineExceeded {
+				err = fmt.Errorf("timed out after %v", timeout)
+			}
+		}
+	default:
+		err = httpHealthCheck(config, host, timeout)
+	}
+
+	result := HealthResult{Timestamp: started, Healthy: err == nil, LatencyMS: float64(time.Since(started)) / float64(time.Millisecond)}
+	if err != nil {
+		result.Error = redact(err.Error())
+	}
+	return result
+}
+
+func httpHealthCheck(config *BandaidFile, host string, timeout time.Duration) error {
+	check := config.Health
+	path := check.Path
+	if path == "" {
+		path = config.Application.Health
+	}
+	url := fmt.Sprintf("http://%v/%v", host, strings.TrimPrefix(path, "/"))
+	resp, err := (&http.Client{Timeout: timeout}).Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case check.ExpectStatus != 0:
+		if resp.StatusCode != check.ExpectStatus {
+			return fmt.Errorf("%v answered %v, expected %v", url, resp.StatusCode, check.ExpectStatus)
+		}
+	case path != "":
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("%v answered %v", url, resp.StatusCode)
+		}
+	case resp.StatusCode >= 500:
+		// Without a health endpoint anything but a server error will do, like when the service is launched
+		return fmt.Errorf("%v answered %v", url, resp.StatusCode)
+	}
+	if check.ExpectBody != "" {
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		if err != nil {
+			return err
+		}
+		if !strings.Contains(string(body), check.ExpectBody) {
+			return fmt.Errorf("%v didn't answer with '%v'", url, check.ExpectBody)
+		}
+	}
+	return nil
+}
+
+// MANAGER_GET_HEALTH_HISTORY returns the application's health status and its last ?limit= checks, 100 by
+// default and 0 for all of them.
+func (api *API) MANAGER_GET_HEALTH_HISTORY(ctx *gin.Context) {
+	app, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+	limit := 100
+	if value := ctx.Query("limit"); value != "" {
+		var err error
+		if limit, err = strconv.Atoi(value); err != nil || limit < 0 {
+			IsError(400, fmt.Errorf("invalid limit '%v'", value), ctx)
+			return
+		}
+	}
+	ctx.JSON(200, gin.H{
+		"status":  app.HealthStatus(),
+		"history": app.HealthHistory(limit),
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// instance is one revision of an application: the checkout it runs from, the host it listens on and its
+// process. An application normally has a single instance, a blue/green reload starts a candidate next to it
+// and swaps them once the candidate is healthy. All fields are guarded by the application's lock.
+type instance struct {
+	directory string
+	host      string
+	runtime   Runtime
+	sandbox   *sandbox
+	stop      chan struct{}
+	stopped   bool
+
+	cmd     *exec.Cmd
+	running bool
+	done    chan struct{}
+
+	stopSignal  syscall.Signal
+	stopTimeout time.Duration
+	metricsPath string
+	// config is the Bandaidfile the instance was launched with, health checks are run from it
+	config *BandaidFile
+}
+
+func newInstance(directory string) *instance {
+	return &instance{directory: directory, runtime: hostRuntime{}, stop: make(chan struct{})}
+}
+
+// start runs the command in the instance's sandbox unless the instance was stopped.
+func (app *Application) start(inst *instance, cmd *exec.Cmd) error {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if inst.stopped {
+		return fmt.Errorf("launch cancelled, the application was stopped")
+	}
+	setProcessGroup(cmd)
+	confined, err := inst.sandbox.confine(cmd)
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		_ = confined()
+		return err
+	}
+	if err := confined(); err != nil {
+		_ = signalGroup(cmd, syscall.SIGKILL)
+		_ = cmd.Wait()
+		return err
+	}
+	inst.cmd = cmd
+	inst.running = true
+	inst.done = make(chan struct{})
+	return nil
+}
+
+// exited marks the command as finished, it must be called after cmd.Wait returns.
+func (app *Application) exited(inst *instance, cmd *exec.Cmd) {
+	// Clean up whatever the process left behind in its group
+	_ = signalGroup(cmd, syscall.SIGKILL)
+
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if inst.cmd == cmd && inst.running {
+		inst.running = false
+		close(inst.done)
+	}
+}
+
+func (app *Application) stopped(inst *instance) bool {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	return inst.stopped
+}
+
+// setInstanceState changes the application's state on behalf of the instance, as long as it's the one
+// serving the application. A candidate's progress doesn't affect the state of the revision that's live.
+func (app *Application) setInstanceState(inst *instance, state string) bool {
+	app.lock.Lock()
+	if app.current != inst {
+		app.lock.Unlock()
+		return false
+	}
+	previous := app.State
+	ok := app.setStateLocked(state)
+	changed := app.State != previous
+	app.lock.Unlock()
+	if changed {
+		api.Persist()
+	}
+	return ok
+}
+
+// stopInstance keeps the instance from starting anything else, stops its process, see stopProcess, and has
+// its runtime clean up after it.
+func (app *Application) stopInstance(inst *instance) error {
+	if inst == nil {
+		return nil
+	}
+	app.lock.Lock()
+	if !inst.stopped {
+		inst.stopped = true
+		close(inst.stop)
+	}
+	cmd, running, done := inst.cmd, inst.running, inst.done
+	signal, timeout := inst.stopSignal, inst.stopTimeout
+	runtime := inst.runtime
+	app.lock.Unlock()
+
+	defer func() {
+		if err := runtime.Cleanup(app, inst); err != nil {
+			log.Println("Error", err)
+			app.Log_Errorf("failed to clean up after the process: %v", err)
+		}
+	}()
+	if cmd == nil || !running {
+		return nil
+	}
+	if signal == 0 {
+		signal, timeout = (&BandaidFile{}).StopSettings()
+	}
+	return stopProcess(cmd, done, signal, timeout)
+}
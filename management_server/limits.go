@@ -0,0 +1,362 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limits is the [limits] table of a Bandaidfile.
+type Limits struct {
+	Memory    string  `toml:"memory"`
+	CPUWeight int     `toml:"cpu_weight"`
+	CPUQuota  float64 `toml:"cpu_quota"`
+	Pids      int     `toml:"pids"`
+	OpenFiles int     `toml:"open_files"`
+}
+
+// The period cpu_quota is enforced over.
+const cpuPeriod = 100 * time.Millisecond
+
+func (limits Limits) Validate() error {
+	if limits.Memory != "" {
+		if _, err := parseBytes(limits.Memory); err != nil {
+			return err
+		}
+	}
+	if limits.CPUWeight != 0 && (limits.CPUWeight < 1 || limits.CPUWeight > 10000) {
+		return fmt.Errorf("cpu_weight must be between 1 and 10000")
+	}
+	if limits.CPUQuota < 0 || limits.Pids < 0 || limits.OpenFiles < 0 {
+		return fmt.Errorf("limits can't be negative")
+	}
+	return nil
+}
+
+// parseBytes reads sizes like "512M", "1.5GiB" or "1048576", units are powers of 1024.
+func parseBytes(size string) (uint64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	multiplier := float64(1)
+	if s != "" {
+		if i := strings.IndexByte("KMGT", s[len(s)-1]); i >= 0 {
+			multiplier = float64(uint64(1) << (10 * uint(i+1)))
+			s = s[:len(s)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid size '%v'", size)
+	}
+	return uint64(value * multiplier), nil
+}
+
+// ResourceUsage is what an instance currently uses against its limits, a limit of 0 means there is none.
+type ResourceUsage struct {
+	Memory       uint64  `json:"memory"`
+	MemoryMax    uint64  `json:"memory_max,omitempty"`
+	CPUSeconds   float64 `json:"cpu_seconds"`
+	CPUWeight    int     `json:"cpu_weight,omitempty"`
+	CPUQuota     float64 `json:"cpu_quota,omitempty"`
+	Pids         int     `json:"pids"`
+	PidsMax      int     `json:"pids_max,omitempty"`
+	OpenFilesMax int     `json:"open_files_max,omitempty"`
+	User         string  `json:"user,omitempty"`
+}
+
+// Usage reports the resources the running revision uses, or nil when its runtime can't tell.
+func (app *Application) Usage() (*ResourceUsage, error) {
+	app.lock.Lock()
+	inst := app.current
+	app.lock.Unlock()
+	if inst == nil {
+		return nil, nil
+	}
+	return inst.runtime.Usage(app, inst)
+}
+
+// sandbox confines the processes of an instance on the host: they run as the configured user in the
+// instance's cgroup, which enforces the Bandaidfile's limits.
+type sandbox struct {
+	cgroup    string
+	user      string
+	uid, gid  uint32
+	openFiles int
+}
+
+// cgroupRoot is the cgroup v2 subtree applications are placed in, set in the [runtime] section of
+// config.ini.
+func cgroupRoot() string {
+	if api == nil || api.Config == nil {
+		return "/sys/fs/cgroup/bandaid"
+	}
+	return api.Config.Section("runtime").Key("cgroup").MustString("/sys/fs/cgroup/bandaid")
+}
+
+// runtimeUser is the unprivileged user applications run as, set in the [runtime] section of config.ini.
+func runtimeUser() string {
+	if api == nil || api.Config == nil {
+		return ""
+	}
+	return api.Config.Section("runtime").Key("user").String()
+}
+
+// cgroupsAvailable tells if the cgroup root can be created in a cgroup v2 hierarchy.
+func cgroupsAvailable(root string) bool {
+	if runtime.GOOS != "linux" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(filepath.Dir(root), "cgroup.controllers"))
+	return err == nil
+}
+
+// newSandbox prepares the instance's cgroup and hands its checkout over to the configured user. Without
+// cgroup v2, or a cgroup root the manager can't write to, applications still run, unless they ask for limits.
+func newSandbox(app *Application, inst *instance, config *BandaidFile) (*sandbox, error) {
+	limits := config.Limits
+	if err := limits.Validate(); err != nil {
+		return nil, err
+	}
+	app.lock.Lock()
+	directory := inst.directory
+	app.lock.Unlock()
+	box := &sandbox{openFiles: limits.OpenFiles}
+
+	if name := runtimeUser(); name != "" {
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("running applications as '%v' isn't supported on windows", name)
+		}
+		account, err := user.Lookup(name)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(account.Uid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		gid, err := strconv.ParseUint(account.Gid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		box.user, box.uid, box.gid = name, uint32(uid), uint32(gid)
+		err = filepath.Walk(directory, func(name string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(name, int(uid), int(gid))
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to hand the checkout over to '%v': %v", box.user, err)
+		}
+	}
+
+	limited := limits.Memory != "" || limits.CPUWeight != 0 || limits.CPUQuota != 0 || limits.Pids != 0
+	root := cgroupRoot()
+	if !cgroupsAvailable(root) {
+		if limited {
+			return nil, fmt.Errorf("resource limits need a cgroup v2 hierarchy at %v", filepath.Dir(root))
+		}
+		return box, nil
+	}
+	// Without limits the cgroup only measures the application and cleans up after it, it can do without
+	if err := box.createCgroup(filepath.Join(root, containerName(app, inst)), limits); err != nil {
+		if limited {
+			return nil, err
+		}
+		log.Printf("[%v] running without a cgroup: %v\n", app.ID, err)
+	}
+	return box, nil
+}
+
+// createCgroup creates the cgroup with the limits set on it, the sandbox only uses it once it's ready.
+func (box *sandbox) createCgroup(cgroup string, limits Limits) error {
+	// Controllers have to be enabled all the way down to the instance's cgroup
+	root := filepath.Dir(cgroup)
+	for _, parent := range []string{filepath.Dir(root), root} {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return err
+		}
+		for _, controller := range []string{"+memory", "+cpu", "+pids"} {
+			_ = ioutil.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(controller), 0644)
+		}
+	}
+
+	if err := os.MkdirAll(cgroup, 0755); err != nil {
+		return err
+	}
+	settings := map[string]string{}
+	if limits.Memory != "" {
+		memory, _ := parseBytes(limits.Memory)
+		settings["memory.max"] = fmt.Sprint(memory)
+		// Keep the kernel from swapping the application out instead of enforcing the limit
+		settings["memory.swap.max"] = "0"
+	}
+	if limits.CPUWeight != 0 {
+		settings["cpu.weight"] = fmt.Sprint(limits.CPUWeight)
+	}
+	if limits.CPUQuota != 0 {
+		period := cpuPeriod.Microseconds()
+		settings["cpu.max"] = fmt.Sprintf("%v %v", int64(limits.CPUQuota*float64(period)), period)
+	}
+	if limits.Pids != 0 {
+		settings["pids.max"] = fmt.Sprint(limits.Pids)
+	}
+	for name, value := range settings {
+		err := ioutil.WriteFile(filepath.Join(cgroup, name), []byte(value), 0644)
+		if err != nil && !(name == "memory.swap.max" && os.IsNotExist(err)) {
+			_ = os.Remove(cgroup)
+			return fmt.Errorf("failed to set %v: %v", name, err)
+		}
+	}
+	box.cgroup = cgroup
+	return nil
+}
+
+// confine makes the command run in the sandbox. Processes can only be moved into a cgroup once they exist, so
+// the command is wrapped in a shell that waits for the returned function to place it before running it, and
+// that lowers its open files limit. The function kills the process if it can't be placed.
+func (box *sandbox) confine(cmd *exec.Cmd) (func() error, error) {
+	none := func() error { return nil }
+	if box == nil {
+		return none, nil
+	}
+	if box.user != "" {
+		setCredential(cmd, box.uid, box.gid)
+	}
+	if box.cgroup == "" && box.openFiles == 0 {
+		return none, nil
+	}
+	shell, err := exec.LookPath("sh")
+	if err != nil {
+		return nil, err
+	}
+	gate, release, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	script := `read _ <&3; exec 3<&-; exec "$@"`
+	if box.openFiles != 0 {
+		script = fmt.Sprintf(`read _ <&3; exec 3<&-; ulimit -n %v || exit 126; exec "$@"`, box.openFiles)
+	}
+	cmd.Args = append([]string{"sh", "-c", script, "bandaid-sandbox", cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = shell
+	cmd.ExtraFiles = append(cmd.ExtraFiles, gate)
+
+	return func() error {
+		_ = gate.Close()
+		defer release.Close()
+		if cmd.Process == nil {
+			return nil
+		}
+		if box.cgroup != "" {
+			procs := filepath.Join(box.cgroup, "cgroup.procs")
+			if err := ioutil.WriteFile(procs, []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+				_ = cmd.Process.Kill()
+				return fmt.Errorf("failed to move the process into its cgroup: %v", err)
+			}
+		}
+		_, err := release.Write([]byte("\n"))
+		return err
+	}, nil
+}
+
+// remove kills whatever is left in the cgroup, children that escaped the process group included, and
+// removes it.
+func (box *sandbox) remove() error {
+	if box == nil || box.cgroup == "" {
+		return nil
+	}
+	_ = ioutil.WriteFile(filepath.Join(box.cgroup, "cgroup.kill"), []byte("1"), 0644)
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(box.cgroup); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("failed to remove cgroup %v: %v", box.cgroup, err)
+}
+
+// cgroupUsage reads the current usage and limits of a cgroup.
+func cgroupUsage(cgroup string) (*ResourceUsage, error) {
+	read := func(name string) string {
+		b, _ := ioutil.ReadFile(filepath.Join(cgroup, name))
+		return strings.TrimSpace(string(b))
+	}
+	if _, err := os.Stat(cgroup); err != nil {
+		return nil, err
+	}
+
+	usage := &ResourceUsage{}
+	usage.Memory, _ = strconv.ParseUint(read("memory.current"), 10, 64)
+	usage.MemoryMax, _ = strconv.ParseUint(read("memory.max"), 10, 64)
+	usage.Pids, _ = strconv.Atoi(read("pids.current"))
+	usage.PidsMax, _ = strconv.Atoi(read("pids.max"))
+	usage.CPUWeight, _ = strconv.Atoi(read("cpu.weight"))
+	if quota := strings.Fields(read("cpu.max")); len(quota) == 2 {
+		max, err1 := strconv.ParseFloat(quota[0], 64)
+		period, err2 := strconv.ParseFloat(quota[1], 64)
+		if err1 == nil && err2 == nil && period > 0 {
+			usage.CPUQuota = max / period
+		}
+	}
+	for _, line := range strings.Split(read("cpu.stat"), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 && fields[0] == "usage_usec" {
+			microseconds, _ := strconv.ParseFloat(fields[1], 64)
+			usage.CPUSeconds = microseconds / 1e6
+		}
+	}
+	return usage, nil
+}
+
+// processCgroup returns the path of the cgroup v2 a process is in.
+func processCgroup(pid string) (string, error) {
+	b, err := ioutil.ReadFile(filepath.Join("/proc", pid, "cgroup"))
+	if err != nil {
+		return "", err
+	}
+	mount, err := cgroupMount()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.HasPrefix(line, "0::") {
+			return filepath.Join(mount, strings.TrimPrefix(line, "0::")), nil
+		}
+	}
+	return "", fmt.Errorf("process %v isn't in a cgroup v2 hierarchy", pid)
+}
+
+// cgroupMount finds where the cgroup v2 hierarchy is mounted.
+func cgroupMount() (string, error) {
+	b, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return "", err
+	}
+	return parseCgroupMount(string(b))
+}
+
+// parseCgroupMount reads the cgroup2 mount point from mountinfo, the fifth field of a line whose filesystem
+// type, after the " - " separator, is cgroup2.
+func parseCgroupMount(mountinfo string) (string, error) {
+	for _, line := range strings.Split(mountinfo, "\n") {
+		separator := strings.Index(line, " - ")
+		if separator < 0 {
+			continue
+		}
+		fields, filesystem := strings.Fields(line[:separator]), strings.Fields(line[separator+3:])
+		if len(fields) >= 5 && len(filesystem) > 0 && filesystem[0] == "cgroup2" {
+			return fields[4], nil
+		}
+	}
+	return "", fmt.Errorf("no cgroup v2 hierarchy is mounted")
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestSandboxWithoutWritableCgroup(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("cgroups are only used on linux")
+	}
+	directory := testAPI(t, "")
+	// The cgroup root can't be created where a file is in the way
+	if err := ioutil.WriteFile(filepath.Join(directory, "cgroup.controllers"), []byte("memory cpu pids"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(directory, "bandaid"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	api.Config.Section("runtime").Key("cgroup").SetValue(filepath.Join(directory, "bandaid"))
+
+	app := &Application{ID: "app"}
+	inst := newInstance(directory)
+	config := &BandaidFile{}
+	box, err := newSandbox(app, inst, config)
+	if err != nil {
+		t.Fatalf("an application without limits didn't launch: %v", err)
+	}
+	if box.cgroup != "" {
+		t.Errorf("the sandbox uses %v", box.cgroup)
+	}
+
+	config.Limits.Pids = 10
+	if _, err := newSandbox(app, inst, config); err == nil {
+		t.Error("an application with limits launched without its cgroup")
+	}
+}
+
+func TestParseCgroupMount(t *testing.T) {
+	mountinfo := `22 28 0:21 / /proc rw,nosuid,nodev,noexec,relatime shared:13 - proc proc rw
+25 28 0:23 / /run/cgroup2 rw,nosuid,nodev,noexec,relatime shared:9 - cgroup2 cgroup2 rw,nsdelegate
+26 28 0:24 / /sys/fs/cgroup/memory rw,nosuid shared:10 - cgroup cgroup rw,memory
+`
+	if mount, err := parseCgroupMount(mountinfo); err != nil || mount != "/run/cgroup2" {
+		t.Errorf("found %q: %v", mount, err)
+	}
+	if _, err := parseCgroupMount("22 28 0:21 / /proc rw - proc proc rw\n"); err == nil {
+		t.Error("found a cgroup v2 mount without one")
+	}
+}
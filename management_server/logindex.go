@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"hash/fnv"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// logIndex is what a search needs to know about the lines of a log file without reading it: where each line
+// starts, when it was written, and which lines have each level and each field value. Field values are kept as
+// hashes, a collision only makes a search read a line that doesn't match.
+type logIndex struct {
+	offsets    []int64
+	timestamps []int64
+	levels     map[string][]int32
+	fields     map[uint64][]int32
+}
+
+func newLogIndex() *logIndex {
+	return &logIndex{levels: map[string][]int32{}, fields: map[uint64][]int32{}}
+}
+
+// fieldKey hashes a field:value term, values are folded the way the search compares them.
+func fieldKey(name, value string) uint64 {
+	hash := fnv.New64a()
+	_, _ = io.WriteString(hash, name)
+	_, _ = hash.Write([]byte{0})
+	_, _ = io.WriteString(hash, strings.ToLower(strings.ToUpper(value)))
+	return hash.Sum64()
+}
+
+// add indexes the line written at offset.
+func (index *logIndex) add(offset int64, line LogLine) {
+	n := int32(len(index.offsets))
+	index.offsets = append(index.offsets, offset)
+	index.timestamps = append(index.timestamps, line.Timestamp.UnixNano())
+	if line.Level != "" {
+		index.levels[line.Level] = append(index.levels[line.Level], n)
+	}
+	for name, value := range line.Fields {
+		key := fieldKey(name, value)
+		index.fields[key] = append(index.fields[key], n)
+	}
+}
+
+// buildLogIndex reads a whole log file into an index, a file that doesn't exist has an empty one.
+func buildLogIndex(name string, stream string, parser *logParser) (*logIndex, error) {
+	index := newLogIndex()
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReaderSize(file, 64*1024)
+	offset := int64(0)
+	for {
+		text, err := reader.ReadString('\n')
+		if len(text) > 0 && strings.HasSuffix(text, "\n") {
+			if line, ok := parseLogLine(strings.TrimSuffix(text, "\n"), stream); ok {
+				line.Level, line.Fields = parser.parse(line.Text)
+				index.add(offset, line)
+			}
+		}
+		offset += int64(len(text))
+		if err == io.EOF {
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// candidates returns the lines that can match the search, newest first. The level and the field terms are
+// answered by the index, the words and the exact values are left to whoever reads the lines.
+func (index *logIndex) candidates(search *logSearch, since, until time.Time) []int32 {
+	var lines []int32
+	all := true
+	if search.level >= 0 {
+		for level, levelLines := range index.levels {
+			if levelRank(level) >= search.level {
+				lines = append(lines, levelLines...)
+			}
+		}
+		sort.Slice(lines, func(i, j int) bool { return lines[i] < lines[j] })
+		all = false
+	}
+	for name, value := range search.fields {
+		fieldLines := index.fields[fieldKey(name, value)]
+		if all {
+			lines = append([]int32{}, fieldLines...)
+			all = false
+			continue
+		}
+		lines = intersectLines(lines, fieldLines)
+	}
+	if all {
+		lines = make([]int32, len(index.offsets))
+		for i := range lines {
+			lines[i] = int32(i)
+		}
+	}
+
+	matches := []int32{}
+	for i := len(lines) - 1; i >= 0; i-- {
+		timestamp := index.timestamps[lines[i]]
+		if (since.IsZero() || timestamp >= since.UnixNano()) && (until.IsZero() || timestamp <= until.UnixNano()) {
+			matches = append(matches, lines[i])
+		}
+	}
+	return matches
+}
+
+// intersectLines returns the lines in both of the sorted lists.
+func intersectLines(a, b []int32) []int32 {
+	both := []int32{}
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			both = append(both, a[i])
+			i++
+			j++
+		}
+	}
+	return both
+}
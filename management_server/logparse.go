@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	LogFormatAuto   = "auto"
+	LogFormatJSON   = "json"
+	LogFormatLogfmt = "logfmt"
+	LogFormatRegex  = "regex"
+	LogFormatText   = "text"
+)
+
+// LogFormat is the [logs] table of a Bandaidfile, it tells how the lines of the application's output are
+// parsed into fields. auto, the default, parses the lines that are JSON objects and leaves the rest as text.
+type LogFormat struct {
+	Format  string `toml:"format"`
+	Pattern string `toml:"pattern"`
+}
+
+func (format LogFormat) Validate() error {
+	_, err := format.parser()
+	return err
+}
+
+// logParser extracts the fields and the level of a line, a nil parser is the auto one.
+type logParser struct {
+	format  string
+	pattern *regexp.Regexp
+}
+
+func (format LogFormat) parser() (*logParser, error) {
+	switch format.Format {
+	case "", LogFormatAuto:
+		return &logParser{format: LogFormatAuto}, nil
+	case LogFormatJSON, LogFormatLogfmt, LogFormatText:
+		return &logParser{format: format.Format}, nil
+	case LogFormatRegex:
+		if format.Pattern == "" {
+			return nil, fmt.Errorf("the regex log format needs a pattern")
+		}
+		pattern, err := regexp.Compile(format.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log pattern: %v", err)
+		}
+		named := false
+		for _, name := range pattern.SubexpNames() {
+			named = named || name != ""
+		}
+		if !named {
+			return nil, fmt.Errorf("the log pattern has no named groups, like (?P<level>\\w+)")
+		}
+		return &logParser{format: LogFormatRegex, pattern: pattern}, nil
+	}
+	return nil, fmt.Errorf("unknown log format '%v'", format.Format)
+}
+
+// same tells whether the parsers parse lines the same way.
+func (parser *logParser) same(other *logParser) bool {
+	format, otherFormat := LogFormatAuto, LogFormatAuto
+	pattern, otherPattern := "", ""
+	if parser != nil {
+		format = parser.format
+		if parser.pattern != nil {
+			pattern = parser.pattern.String()
+		}
+	}
+	if other != nil {
+		otherFormat = other.format
+		if other.pattern != nil {
+			otherPattern = other.pattern.String()
+		}
+	}
+	return format == otherFormat && pattern == otherPattern
+}
+
+// The fields a level is read from, in order.
+var levelFields = []string{"level", "lvl", "severity", "levelname", "log.level", "Level"}
+
+// parse returns the normalized level and the fields of the line, nothing when it isn't in the format.
+func (parser *logParser) parse(text string) (string, map[string]string) {
+	format := LogFormatAuto
+	if parser != nil {
+		format = parser.format
+	}
+	var fields map[string]string
+	switch format {
+	case LogFormatAuto:
+		if strings.HasPrefix(strings.TrimSpace(text), "{") {
+			fields = parseJSONFields(text)
+		}
+	case LogFormatJSON:
+		fields = parseJSONFields(text)
+	case LogFormatLogfmt:
+		fields = parseLogfmt(text)
+	case LogFormatRegex:
+		if match := parser.pattern.FindStringSubmatch(text); match != nil {
+			fields = map[string]string{}
+			for i, name := range parser.pattern.SubexpNames() {
+				if name != "" {
+					fields[name] = match[i]
+				}
+			}
+		}
+	}
+	if len(fields) == 0 {
+		return "", nil
+	}
+	for _, name := range levelFields {
+		if value, exists := fields[name]; exists {
+			return normalizeLevel(value), fields
+		}
+	}
+	return "", fields
+}
+
+// parseJSONFields flattens a JSON object into its values as text, nested objects are joined with dots.
+func parseJSONFields(text string) map[string]string {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.UseNumber()
+	object := map[string]interface{}{}
+	if decoder.Decode(&object) != nil {
+		return nil
+	}
+	fields := map[string]string{}
+	var flatten func(prefix string, object map[string]interface{})
+	flatten = func(prefix string, object map[string]interface{}) {
+		for key, value := range object {
+			switch value := value.(type) {
+			case map[string]interface{}:
+				flatten(prefix+key+".", value)
+			case string:
+				fields[prefix+key] = value
+			case nil:
+				fields[prefix+key] = ""
+			case json.Number, bool:
+				fields[prefix+key] = fmt.Sprint(value)
+			default:
+				b, _ := json.Marshal(value)
+				fields[prefix+key] = string(b)
+			}
+		}
+	}
+	flatten("", object)
+	return fields
+}
+
+// parseLogfmt reads key=value pairs, values can be quoted and keys without a value are true. Lines without
+// a single pair aren't logfmt.
+func parseLogfmt(text string) map[string]string {
+	fields := map[string]string{}
+	pairs := false
+	s := strings.TrimSpace(text)
+	for s != "" {
+		end := strings.IndexAny(s, "= ")
+		if end < 0 {
+			fields[s] = "true"
+			break
+		}
+		key := s[:end]
+		if s[end] == ' ' {
+			if key != "" {
+				fields[key] = "true"
+			}
+			s = strings.TrimLeft(s[end:], " ")
+			continue
+		}
+		s = s[end+1:]
+		value := ""
+		if strings.HasPrefix(s, `"`) {
+			closing := 1
+			for closing < len(s) && s[closing] != '"' {
+				if s[closing] == '\\' {
+					closing++
+				}
+				closing++
+			}
+			if closing >= len(s) {
+				return nil
+			}
+			unquoted, err := strconv.Unquote(s[:closing+1])
+			if err != nil {
+				return nil
+			}
+			value, s = unquoted, s[closing+1:]
+		} else if space := strings.IndexByte(s, ' '); space >= 0 {
+			value, s = s[:space], s[space:]
+		} else {
+			value, s = s, ""
+		}
+		if key == "" {
+			return nil
+		}
+		fields[key], pairs = value, true
+		s = strings.TrimLeft(s, " ")
+	}
+	if !pairs {
+		return nil
+	}
+	return fields
+}
+
+// The levels from least to most severe.
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+var levelAliases = map[string]string{
+	"dbg": "debug", "information": "info", "notice": "info", "warning": "warn", "err": "error",
+	"critical": "fatal", "crit": "fatal", "panic": "fatal", "alert": "fatal", "emergency": "fatal",
+}
+
+// normalizeLevel maps the usual spellings of a level, and pino's numbers, to one of logLevels.
+func normalizeLevel(level string) string {
+	level = strings.ToLower(strings.TrimSpace(level))
+	if alias, exists := levelAliases[level]; exists {
+		return alias
+	}
+	if number, err := strconv.Atoi(level); err == nil && number >= 10 {
+		i := number/10 - 1
+		if i >= len(logLevels) {
+			i = len(logLevels) - 1
+		}
+		return logLevels[i]
+	}
+	return level
+}
+
+// levelRank orders levels by severity, unknown ones are -1.
+func levelRank(level string) int {
+	for i, known := range logLevels {
+		if level == known {
+			return i
+		}
+	}
+	return -1
+}
+
+// logSearch matches lines against the terms of a search: words have to appear in the text and field:value
+// terms have to equal a parsed field, both ignoring case. level keeps the lines at or above it.
+type logSearch struct {
+	words  []string
+	fields map[string]string
+	level  int
+}
+
+func parseLogSearch(q string, level string) (*logSearch, error) {
+	search := &logSearch{fields: map[string]string{}, level: -1}
+	if level != "" {
+		if search.level = levelRank(normalizeLevel(level)); search.level < 0 {
+			return nil, fmt.Errorf("unknown level '%v', use one of %v", level, strings.Join(logLevels, ", "))
+		}
+	}
+	for _, term := range strings.Fields(q) {
+		if i := strings.IndexByte(term, ':'); i > 0 && i < len(term)-1 {
+			search.fields[term[:i]] = term[i+1:]
+			continue
+		}
+		search.words = append(search.words, strings.ToLower(term))
+	}
+	return search, nil
+}
+
+func (search *logSearch) match(line LogLine) bool {
+	if search.level >= 0 && levelRank(line.Level) < search.level {
+		return false
+	}
+	for name, value := range search.fields {
+		if !strings.EqualFold(line.Fields[name], value) {
+			return false
+		}
+	}
+	if len(search.words) > 0 {
+		text := strings.ToLower(line.Text)
+		for _, word := range search.words {
+			if !strings.Contains(text, word) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLine is a line of a process' output and when it was written, with the level and fields parsed from it.
+type LogLine struct {
+	Timestamp time.Time         `json:"timestamp"`
+	Stream    string            `json:"stream"`
+	Text      string            `json:"text"`
+	Level     string            `json:"level,omitempty"`
+	Fields    map[string]string `json:"fields,omitempty"`
+}
+
+func (line LogLine) String() string {
+	return line.Timestamp.Format(time.RFC3339Nano) + " " + line.Text
+}
+
+// Lines longer than this are split, so a process that never writes a newline can't grow the buffer forever.
+const maxLineLength = 64 * 1024
+
+// logSink collects a process' output as timestamped lines. They're appended to a file that's rotated once
+// it's bigger than MaxSize, keeping MaxFiles old files as file.1 up to file.MaxFiles, and the last TailLines
+// are kept in memory. It's safe for concurrent use, the old and the new revision both write to it while a
+// reload switches between them. Listener is called with every line as it's written. Lines are parsed by the
+// application's parser as they're written and read, the files only keep their text. Searches go through an
+// index of each file, see logIndex.
+type logSink struct {
+	Path      string
+	Stream    string
+	MaxSize   int64
+	MaxFiles  int
+	TailLines int
+	Listener  func(LogLine)
+	Parser    *logParser
+
+	lock    sync.Mutex
+	file    *os.File
+	size    int64
+	partial []byte
+	tail    []LogLine
+	failed  bool
+	written uint64
+	// index has the indexes of the current file and of file.1 up to file.MaxFiles, they're built the first
+	// time the files are searched and kept up to date as lines are written and the files rotated
+	index []*logIndex
+}
+
+// logSettings reads the [logs] section of config.ini.
+func logSettings() (directory string, maxSize int64, maxFiles int, tailLines int) {
+	directory, maxSize, maxFiles, tailLines = "logs", 10<<20, 5, 1000
+	if api == nil || api.Config == nil {
+		return
+	}
+	section := api.Config.Section("logs")
+	directory = section.Key("directory").MustString(directory)
+	if size, err := parseBytes(section.Key("max_size").String()); err == nil {
+		maxSize = int64(size)
+	}
+	maxFiles = section.Key("max_files").MustInt(maxFiles)
+	tailLines = section.Key("tail").MustInt(tailLines)
+	return
+}
+
+// newLogSink opens the sink of an application's stream, with the tail of what it wrote before the manager
+// restarted.
+func newLogSink(app string, stream string) *logSink {
+	directory, maxSize, maxFiles, tailLines := logSettings()
+	sink := &logSink{
+		Path:      filepath.Join(directory, app, stream+".log"),
+		Stream:    stream,
+		MaxSize:   maxSize,
+		MaxFiles:  maxFiles,
+		TailLines: tailLines,
+	}
+	tail, err := sink.read(tailLines, nil, nil)
+	if err != nil {
+		log.Printf("failed to read %v: %v\n", sink.Path, err)
+	}
+	sink.tail = tail
+	return sink
+}
+
+func (sink *logSink) Write(p []byte) (int, error) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	now := time.Now()
+	sink.partial = append(sink.partial, p...)
+	for {
+		end := bytes.IndexByte(sink.partial, '\n')
+		if end < 0 {
+			if len(sink.partial) < maxLineLength {
+				break
+			}
+			// A split line goes on in the next one, nothing is dropped
+			text := string(sink.partial[:maxLineLength])
+			sink.partial = sink.partial[maxLineLength:]
+			sink.add(LogLine{Timestamp: now, Stream: sink.Stream, Text: text})
+			continue
+		}
+		text := strings.TrimSuffix(string(sink.partial[:end]), "\r")
+		sink.partial = sink.partial[end+1:]
+		sink.add(LogLine{Timestamp: now, Stream: sink.Stream, Text: text})
+	}
+	return len(p), nil
+}
+
+// add keeps the line in the tail and appends it to the file, the sink's lock must be held.
+func (sink *logSink) add(line LogLine) {
+	line.Level, line.Fields = sink.Parser.parse(line.Text)
+	sink.written += uint64(len(line.Text)) + 1
+	sink.tail = append(sink.tail, line)
+	if len(sink.tail) > sink.TailLines {
+		sink.tail = append([]LogLine{}, sink.tail[len(sink.tail)-sink.TailLines:]...)
+	}
+	if sink.Listener != nil {
+		sink.Listener(line)
+	}
+	offset, err := sink.append(line.String() + "\n")
+	if err != nil {
+		// Output is still kept in memory, only complain once
+		if !sink.failed {
+			log.Printf("failed to write %v: %v\n", sink.Path, err)
+		}
+		sink.failed = true
+		return
+	}
+	sink.failed = false
+	if len(sink.index) > 0 && sink.index[0] != nil {
+		sink.index[0].add(offset, line)
+	}
+}
+
+// append writes the text to the current file and returns where it starts.
+func (sink *logSink) append(text string) (int64, error) {
+	if sink.file == nil {
+		if err := os.MkdirAll(filepath.Dir(sink.Path), 0755); err != nil {
+			return 0, err
+		}
+		file, err := os.OpenFile(sink.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return 0, err
+		}
+		info, err := file.Stat()
+		if err != nil {
+			_ = file.Close()
+			return 0, err
+		}
+		sink.file, sink.size = file, info.Size()
+	}
+	if sink.size > 0 && sink.size+int64(len(text)) > sink.MaxSize {
+		if err := sink.rotate(); err != nil {
+			return 0, err
+		}
+		return sink.append(text)
+	}
+	offset := sink.size
+	n, err := sink.file.WriteString(text)
+	sink.size += int64(n)
+	return offset, err
+}
+
+// name is the path of the current file for 0 and of file.i otherwise.
+func (sink *logSink) name(i int) string {
+	if i == 0 {
+		return sink.Path
+	}
+	return fmt.Sprintf("%v.%v", sink.Path, i)
+}
+
+// rotate shifts the files by one, dropping the oldest, the next write starts a new file. Their indexes are
+// shifted along, or dropped to be built again if a file couldn't be moved.
+func (sink *logSink) rotate() error {
+	_ = sink.file.Close()
+	sink.file = nil
+	_ = os.Remove(sink.name(sink.MaxFiles))
+	for i := sink.MaxFiles - 1; i >= 1; i-- {
+		_ = os.Rename(sink.name(i), sink.name(i+1))
+	}
+	var err error
+	if sink.MaxFiles < 1 {
+		err = os.Remove(sink.Path)
+	} else {
+		err = os.Rename(sink.Path, sink.Path+".1")
+	}
+	switch {
+	case err != nil:
+		sink.index = nil
+	case len(sink.index) > 0:
+		copy(sink.index[1:], sink.index)
+		sink.index[0] = newLogIndex()
+	}
+	return err
+}
+
+// Written is how many bytes were written since the manager started.
+func (sink *logSink) Written() uint64 {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	return sink.written
+}
+
+// SetParser changes how lines are parsed, the ones kept in memory included. The files are indexed again the
+// next time they're searched.
+func (sink *logSink) SetParser(parser *logParser) {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	if !parser.same(sink.Parser) {
+		sink.index = nil
+	}
+	sink.Parser = parser
+	for i := range sink.tail {
+		sink.tail[i].Level, sink.tail[i].Fields = parser.parse(sink.tail[i].Text)
+	}
+}
+
+// Lines returns the lines written between since and until, zero times leave that end open, limited to the
+// last tail lines when tail is above 0. Without a range the in-memory tail answers, the files otherwise.
+func (sink *logSink) Lines(tail int, since, until time.Time) ([]LogLine, error) {
+	ranged := !since.IsZero() || !until.IsZero()
+	sink.lock.Lock()
+	if !ranged && (tail <= 0 || tail <= len(sink.tail)) {
+		if tail <= 0 || tail > len(sink.tail) {
+			tail = len(sink.tail)
+		}
+		lines := append([]LogLine{}, sink.tail[len(sink.tail)-tail:]...)
+		sink.lock.Unlock()
+		return lines, nil
+	}
+	parser := sink.Parser
+	sink.lock.Unlock()
+	return sink.read(tail, parser, between(since, until))
+}
+
+// Search returns the last limit lines of the files that match the search and were written between since and
+// until, zero times leave that end open. Only the lines the index can't rule out are read.
+func (sink *logSink) Search(limit int, search *logSearch, since, until time.Time) ([]LogLine, error) {
+	type candidates struct {
+		file    *os.File
+		offsets []int64
+	}
+	files := []candidates{}
+	defer func() {
+		for _, candidates := range files {
+			_ = candidates.file.Close()
+		}
+	}()
+
+	// The files are opened with the lock held, so a rotation can't move them away from their indexes
+	sink.lock.Lock()
+	parser := sink.Parser
+	err := sink.indexFiles()
+	for i := 0; err == nil && i < len(sink.index); i++ {
+		lines := sink.index[i].candidates(search, since, until)
+		if len(lines) == 0 {
+			continue
+		}
+		var file *os.File
+		if file, err = os.Open(sink.name(i)); os.IsNotExist(err) {
+			err = nil
+			continue
+		}
+		if err == nil {
+			offsets := make([]int64, len(lines))
+			for j, line := range lines {
+				offsets[j] = sink.index[i].offsets[line]
+			}
+			files = append(files, candidates{file: file, offsets: offsets})
+		}
+	}
+	sink.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	inRange := between(since, until)
+	lines := []LogLine{}
+	for _, candidates := range files {
+		reader := bufio.NewReaderSize(candidates.file, 4096)
+		for _, offset := range candidates.offsets {
+			if _, err := candidates.file.Seek(offset, io.SeekStart); err != nil {
+				return nil, err
+			}
+			reader.Reset(candidates.file)
+			text, err := reader.ReadString('\n')
+			if err != nil && err != io.EOF {
+				return nil, err
+			}
+			line, ok := parseLogLine(strings.TrimSuffix(text, "\n"), sink.Stream)
+			if !ok {
+				continue
+			}
+			line.Level, line.Fields = parser.parse(line.Text)
+			if !inRange(line) || !search.match(line) {
+				continue
+			}
+			lines = append(lines, line)
+			if len(lines) == limit {
+				break
+			}
+		}
+		if len(lines) == limit {
+			break
+		}
+	}
+	// Newest first so far
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, nil
+}
+
+// indexFiles builds the indexes that are missing, the sink's lock must be held. Writes wait for it, which
+// only takes long the first time the files are searched.
+func (sink *logSink) indexFiles() error {
+	files := 1
+	if sink.MaxFiles > 0 {
+		files += sink.MaxFiles
+	}
+	if len(sink.index) != files {
+		sink.index = make([]*logIndex, files)
+	}
+	for i := range sink.index {
+		if sink.index[i] != nil {
+			continue
+		}
+		index, err := buildLogIndex(sink.name(i), sink.Stream, sink.Parser)
+		if err != nil {
+			return err
+		}
+		sink.index[i] = index
+	}
+	return nil
+}
+
+// between matches the lines written between since and until, zero times leave that end open.
+func between(since, until time.Time) func(LogLine) bool {
+	return func(line LogLine) bool {
+		return (since.IsZero() || !line.Timestamp.Before(since)) && (until.IsZero() || !line.Timestamp.After(until))
+	}
+}
+
+// read reads the lines that match from the files, oldest first, all of them when match is nil.
+func (sink *logSink) read(tail int, parser *logParser, match func(LogLine) bool) ([]LogLine, error) {
+	lines := []LogLine{}
+	for i := sink.MaxFiles; i >= 0; i-- {
+		file, err := os.Open(sink.name(i))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), maxLineLength*2)
+		for scanner.Scan() {
+			line, ok := parseLogLine(scanner.Text(), sink.Stream)
+			if !ok {
+				continue
+			}
+			line.Level, line.Fields = parser.parse(line.Text)
+			if match != nil && !match(line) {
+				continue
+			}
+			lines = append(lines, line)
+			if tail > 0 && len(lines) > 2*tail {
+				lines = append([]LogLine{}, lines[len(lines)-tail:]...)
+			}
+		}
+		err = scanner.Err()
+		_ = file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if tail > 0 && len(lines) > tail {
+		lines = lines[len(lines)-tail:]
+	}
+	return lines, nil
+}
+
+func parseLogLine(text string, stream string) (LogLine, bool) {
+	space := strings.IndexByte(text, ' ')
+	if space < 0 {
+		return LogLine{}, false
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, text[:space])
+	if err != nil {
+		return LogLine{}, false
+	}
+	return LogLine{Timestamp: timestamp, Stream: stream, Text: text[space+1:]}, true
+}
+
+// Close closes the file, the next write opens it again. The files may be removed after, so their indexes are
+// dropped.
+func (sink *logSink) Close() {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	sink.index = nil
+	if sink.file != nil {
+		_ = sink.file.Close()
+		sink.file = nil
+	}
+}
+
+// output returns the sinks of the application's stdout and stderr, which stream to its hub and forwarders.
+func (app *Application) output() (stdout *logSink, stderr *logSink) {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if app.stdout == nil {
+		if app.streams == nil {
+			app.streams = &streamHub{}
+		}
+		hub, id, repository := app.streams, app.ID, app.Repository
+		listener := func(line LogLine) {
+			hub.publish(line.Stream, line.Timestamp, line.Text)
+			api.forward(ForwardEntry{App: id, Repository: repository, Stream: line.Stream, Timestamp: line.Timestamp,
+				Level: line.Level, Text: line.Text})
+		}
+		app.stdout = newLogSink(app.ID, StreamStdout)
+		app.stderr = newLogSink(app.ID, StreamStderr)
+		app.stdout.Listener, app.stderr.Listener = listener, listener
+	}
+	return app.stdout, app.stderr
+}
+
+// logQuery reads the tail, since and until query parameters. since and until are RFC3339 times or durations
+// like "15m", which are counted back from now.
+func logQuery(ctx *gin.Context) (tail int, since time.Time, until time.Time, err error) {
+	if value := ctx.Query("tail"); value != "" {
+		if tail, err = strconv.Atoi(value); err != nil || tail < 0 {
+			return 0, since, until, fmt.Errorf("invalid tail '%v'", value)
+		}
+	}
+	if since, err = parseLogTime(ctx.Query("since")); err != nil {
+		return
+	}
+	until, err = parseLogTime(ctx.Query("until"))
+	return
+}
+
+func parseLogTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if duration, err := time.ParseDuration(value); err == nil {
+		return time.Now().Add(-duration), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return t, fmt.Errorf("invalid time '%v', use RFC3339 or a duration like 15m", value)
+	}
+	return t, nil
+}
+
+// serveLogs answers with the lines of one of the application's streams, as text or ?format=json.
+func (api *API) serveLogs(ctx *gin.Context, stream string) {
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+	tail, since, until, err := logQuery(ctx)
+	if IsError(400, err, ctx) {
+		return
+	}
+	stdout, stderr := service.output()
+	sink := stdout
+	if stream == StreamStderr {
+		sink = stderr
+	}
+	lines, err := sink.Lines(tail, since, until)
+	if IsError(500, err, ctx) {
+		return
+	}
+	if ctx.Query("format") == "json" {
+		ctx.JSON(200, lines)
+		return
+	}
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line.String())
+		b.WriteByte('\n')
+	}
+	ctx.String(200, b.String())
+}
+
+// removeLogs closes the application's log files and deletes them.
+func (app *Application) removeLogs() error {
+	stdout, stderr := app.output()
+	stdout.Close()
+	stderr.Close()
+	return os.RemoveAll(filepath.Dir(stdout.Path))
+}
+
+// LogMatch is a line found by a log search and the application that wrote it.
+type LogMatch struct {
+	App string `json:"app"`
+	LogLine
+}
+
+// MANAGER_GET_LOG_SEARCH searches the stored output of every application, or of ?app=, for the lines with all
+// the words and field:value terms of ?q=, at ?level= or above, written between ?since= and ?until=. It returns
+// the last ?limit= matches, oldest first.
+func (api *API) MANAGER_GET_LOG_SEARCH(ctx *gin.Context) {
+	search, err := parseLogSearch(ctx.Query("q"), ctx.Query("level"))
+	if IsError(400, err, ctx) {
+		return
+	}
+	since, err := parseLogTime(ctx.Query("since"))
+	if IsError(400, err, ctx) {
+		return
+	}
+	until, err := parseLogTime(ctx.Query("until"))
+	if IsError(400, err, ctx) {
+		return
+	}
+	limit := 100
+	if value := ctx.Query("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+			IsError(400, fmt.Errorf("invalid limit '%v'", value), ctx)
+			return
+		}
+	}
+	apps := api.apps.Applications()
+	if id := ctx.Query("app"); id != "" {
+		app, exists := api.apps.Application(id)
+		if !exists {
+			IsError(404, fmt.Errorf("service not found"), ctx)
+			return
+		}
+		apps = []*Application{app}
+	}
+
+	matches := []LogMatch{}
+	for _, app := range apps {
+		stdout, stderr := app.output()
+		for _, sink := range []*logSink{stdout, stderr} {
+			lines, err := sink.Search(limit, search, since, until)
+			if IsError(500, err, ctx) {
+				return
+			}
+			for _, line := range lines {
+				matches = append(matches, LogMatch{App: app.ID, LogLine: line})
+			}
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.Before(matches[j].Timestamp)
+	})
+	if len(matches) > limit {
+		matches = matches[len(matches)-limit:]
+	}
+	ctx.JSON(200, matches)
+}
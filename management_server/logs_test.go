@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSink(t *testing.T, maxSize int64, maxFiles int) *logSink {
+	directory, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &logSink{Path: filepath.Join(directory, "stdout.log"), Stream: StreamStdout, MaxSize: maxSize,
+		MaxFiles: maxFiles, TailLines: 10}
+	t.Cleanup(func() {
+		sink.Close()
+		os.RemoveAll(directory)
+	})
+	return sink
+}
+
+// writeLines writes JSON lines, every third one a warning and every fifth one an error, for routes a to c.
+func writeLines(sink *logSink, from, to int) {
+	for i := from; i < to; i++ {
+		level := "info"
+		switch {
+		case i%5 == 0:
+			level = "error"
+		case i%3 == 0:
+			level = "warn"
+		}
+		fmt.Fprintf(sink, `{"level": "%v", "route": "/%c", "msg": "request %v"}`+"\n", level, 'a'+i%3, i)
+	}
+}
+
+func lineTexts(lines []LogLine) string {
+	texts := []string{}
+	for _, line := range lines {
+		texts = append(texts, line.Text)
+	}
+	return strings.Join(texts, "\n")
+}
+
+// assertSearches compares the indexed searches with reading every line of the files.
+func assertSearches(t *testing.T, sink *logSink, step string) {
+	tests := []struct {
+		q     string
+		level string
+		limit int
+	}{
+		{"", "", 1000},
+		{"", "", 5},
+		{"", "warn", 1000},
+		{"", "error", 3},
+		{"route:/B", "", 1000},
+		{"route:/b", "warn", 1000},
+		{"route:/a level:ERROR", "", 1000},
+		{"route:/c request", "", 4},
+		{"missing:field", "", 1000},
+		{"request 1", "info", 1000},
+	}
+	for _, test := range tests {
+		search, err := parseLogSearch(test.q, test.level)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := sink.Search(test.limit, search, time.Time{}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := sink.read(test.limit, sink.Parser, search.match)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lineTexts(got) != lineTexts(want) {
+			t.Errorf("%v: q=%q level=%q limit=%v found\n%v\nwant\n%v", step, test.q, test.level, test.limit,
+				lineTexts(got), lineTexts(want))
+		}
+	}
+}
+
+func TestLogSearchIndex(t *testing.T) {
+	sink := testSink(t, 1024, 2)
+	writeLines(sink, 0, 20)
+	assertSearches(t, sink, "first search")
+	if len(sink.index) != 3 || len(sink.index[0].offsets) == 0 {
+		t.Fatalf("the files weren't indexed: %v", sink.index)
+	}
+
+	// The index follows the writes and the rotations, up to dropping the oldest file
+	writeLines(sink, 20, 30)
+	assertSearches(t, sink, "after writes")
+	writeLines(sink, 30, 60)
+	if _, err := os.Stat(sink.Path + ".2"); err != nil {
+		t.Fatalf("the files weren't rotated: %v", err)
+	}
+	assertSearches(t, sink, "after rotations")
+
+	// Only the lines with the field and the level are read
+	search, _ := parseLogSearch("route:/a", "error")
+	candidates, total := 0, 0
+	for _, index := range sink.index {
+		candidates += len(index.candidates(search, time.Time{}, time.Time{}))
+		total += len(index.offsets)
+	}
+	found, _ := sink.Search(1000, search, time.Time{}, time.Time{})
+	if len(found) == 0 || candidates != len(found) {
+		t.Errorf("%v of %v lines are candidates for %v matches", candidates, total, len(found))
+	}
+}
+
+func TestLogSearchRange(t *testing.T) {
+	sink := testSink(t, 1<<20, 2)
+	writeLines(sink, 0, 5)
+	middle := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	writeLines(sink, 5, 10)
+
+	search, _ := parseLogSearch("", "")
+	before, _ := sink.Search(100, search, time.Time{}, middle)
+	after, _ := sink.Search(100, search, middle, time.Time{})
+	if len(before) != 5 || len(after) != 5 || !strings.Contains(after[0].Text, "request 5") {
+		t.Errorf("found %v lines before and %v after, from %q", len(before), len(after), lineTexts(after))
+	}
+}
+
+func TestLogSearchParserChange(t *testing.T) {
+	sink := testSink(t, 1<<20, 2)
+	fmt.Fprintln(sink, "level=error route=/a")
+	search, _ := parseLogSearch("route:/a", "")
+	if found, _ := sink.Search(10, search, time.Time{}, time.Time{}); len(found) != 0 {
+		t.Fatalf("found %v lines before logfmt was parsed", len(found))
+	}
+
+	auto, _ := LogFormat{}.parser()
+	sink.SetParser(auto)
+	if sink.index == nil {
+		t.Error("setting the same parser dropped the index")
+	}
+	logfmt, _ := LogFormat{Format: LogFormatLogfmt}.parser()
+	sink.SetParser(logfmt)
+	if found, _ := sink.Search(10, search, time.Time{}, time.Time{}); len(found) != 1 || found[0].Level != "error" {
+		t.Errorf("found %v after parsing logfmt", found)
+	}
+}
+
+func TestLogSinkSplitsLongLines(t *testing.T) {
+	sink := testSink(t, 1<<20, 2)
+	long := make([]byte, 2*maxLineLength+3)
+	for i := range long {
+		long[i] = 'a' + byte(i%26)
+	}
+	sink.Write(long)
+	sink.Write([]byte("\nnext\n"))
+
+	lines, err := sink.Lines(0, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 4 || len(lines[0].Text) != maxLineLength || len(lines[1].Text) != maxLineLength ||
+		lines[3].Text != "next" {
+		t.Fatalf("got %v lines", len(lines))
+	}
+	if got := lines[0].Text + lines[1].Text + lines[2].Text; got != string(long) {
+		t.Errorf("kept %v of the %v bytes", len(got), len(long))
+	}
+}
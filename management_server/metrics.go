@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// healthMetrics counts an application's health checks.
+type healthMetrics struct {
+	checks   uint64
+	failures uint64
+	seconds  float64
+	last     float64
+}
+
+// metricsRegistry keeps the counters that aren't part of an application's state.
+type metricsRegistry struct {
+	lock   sync.Mutex
+	health map[string]*healthMetrics
+	calls  map[[2]string]uint64
+}
+
+var metrics = &metricsRegistry{health: map[string]*healthMetrics{}, calls: map[[2]string]uint64{}}
+
+func (m *metricsRegistry) healthCheck(app string, latency time.Duration, failed bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	health, exists := m.health[app]
+	if !exists {
+		health = &healthMetrics{}
+		m.health[app] = health
+	}
+	health.checks++
+	if failed {
+		health.failures++
+	}
+	health.seconds += latency.Seconds()
+	health.last = latency.Seconds()
+}
+
+// countCall counts a call to the Caddy or Cloudflare APIs.
+func (m *metricsRegistry) countCall(service string, failed bool) {
+	outcome := "ok"
+	if failed {
+		outcome = "error"
+	}
+	m.lock.Lock()
+	m.calls[[2]string{service, outcome}]++
+	m.lock.Unlock()
+}
+
+// processUsage adds up the CPU seconds and resident memory of the processes in a process group, from /proc.
+func processUsage(group int) (cpu float64, rss uint64, err error) {
+	// The kernel reports CPU time in USER_HZ, which is 100 everywhere Linux runs
+	const ticks = 100
+	stats, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		return 0, 0, err
+	}
+	found := false
+	for _, stat := range stats {
+		b, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The command can contain anything, the fields that follow it start after the last parenthesis
+		end := strings.LastIndexByte(string(b), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(b)[end+1:])
+		if len(fields) < 22 || fields[2] != strconv.Itoa(group) {
+			continue
+		}
+		utime, _ := strconv.ParseFloat(fields[11], 64)
+		stime, _ := strconv.ParseFloat(fields[12], 64)
+		pages, _ := strconv.ParseUint(fields[21], 10, 64)
+		cpu += (utime + stime) / ticks
+		rss += pages * uint64(os.Getpagesize())
+		found = true
+	}
+	if !found {
+		return 0, 0, fmt.Errorf("no process in group %v", group)
+	}
+	return cpu, rss, nil
+}
+
+// metricsWriter writes the Prometheus text format.
+type metricsWriter struct {
+	w io.Writer
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func (mw metricsWriter) family(name, kind, help string) {
+	fmt.Fprintf(mw.w, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+// sample writes a sample, labels are pairs of names and values.
+func (mw metricsWriter) sample(name string, value float64, labels ...string) {
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], labelEscaper.Replace(labels[i+1])))
+	}
+	fmt.Fprintf(mw.w, "%v{%v} %v\n", name, strings.Join(pairs, ","), formatSample(value))
+}
+
+func formatSample(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// appMetrics is what /metrics reports about an application.
+type appMetrics struct {
+	id          string
+	state       string
+	uptime      float64
+	restarts    int
+	deployments map[string]int
+	deploySum   float64
+	deployCount int
+	health      healthMetrics
+	process     bool
+	cpu         float64
+	rss         uint64
+	logBytes    map[string]uint64
+	host        string
+	scrapePath  string
+}
+
+func collectAppMetrics(app *Application) appMetrics {
+	snapshot := app.snapshot()
+	m := appMetrics{id: app.ID, state: snapshot.State, restarts: snapshot.Restarts, deployments: map[string]int{}}
+	if snapshot.State == StateRunning {
+		m.uptime = time.Since(snapshot.StateSince).Seconds()
+	}
+	for _, deployment := range snapshot.Deployments {
+		outcome := deployment.Outcome
+		if outcome == "" {
+			outcome = OutcomeSucceeded
+		}
+		m.deployments[outcome]++
+		if deployment.FinishedAt != nil {
+			m.deploySum += deployment.FinishedAt.Sub(deployment.Timestamp).Seconds()
+			m.deployCount++
+		}
+	}
+
+	metrics.lock.Lock()
+	if health, exists := metrics.health[app.ID]; exists {
+		m.health = *health
+	}
+	metrics.lock.Unlock()
+
+	app.lock.Lock()
+	pid := 0
+	if inst := app.current; inst != nil {
+		if inst.running && inst.cmd != nil && inst.cmd.Process != nil {
+			pid = inst.cmd.Process.Pid
+		}
+		m.host, m.scrapePath = inst.host, inst.metricsPath
+	}
+	app.lock.Unlock()
+	if pid != 0 {
+		var err error
+		m.cpu, m.rss, err = processUsage(pid)
+		m.process = err == nil
+	}
+
+	stdout, stderr := app.output()
+	m.logBytes = map[string]uint64{StreamStdout: stdout.Written(), StreamStderr: stderr.Written()}
+	return m
+}
+
+// MANAGER_GET_METRICS reports the applications and the manager in the Prometheus text format, followed by
+// the metrics of the applications that declare a [metrics] path, labelled with their app.
+func (api *API) MANAGER_GET_METRICS(ctx *gin.Context) {
+	apps := []appMetrics{}
+	for _, app := range api.apps.Applications() {
+		apps = append(apps, collectAppMetrics(app))
+	}
+	ctx.Header("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	ctx.Status(200)
+	mw := metricsWriter{w: ctx.Writer}
+
+	mw.family("bandaid_app_state", "gauge", "Whether the application is in the state, 1 for the current one.")
+	for _, app := range apps {
+		for _, state := range []string{StateCloning, StateBuilding, StateStarting, StateRunning, StateRestarting,
+			StateExited, StateFailed, StateStopped} {
+			value := 0.0
+			if app.state == state {
+				value = 1
+			}
+			mw.sample("bandaid_app_state", value, "app", app.id, "state", state)
+		}
+	}
+	mw.family("bandaid_app_uptime_seconds", "gauge", "How long the application has been running, 0 when it isn't.")
+	for _, app := range apps {
+		mw.sample("bandaid_app_uptime_seconds", app.uptime, "app", app.id)
+	}
+	mw.family("bandaid_app_restarts_total", "counter", "Restarts of the application after it exited.")
+	for _, app := range apps {
+		mw.sample("bandaid_app_restarts_total", float64(app.restarts), "app", app.id)
+	}
+	mw.family("bandaid_app_deployments_total", "counter", "Deployments of the application by outcome.")
+	for _, app := range apps {
+		for _, outcome := range []string{OutcomePending, OutcomeSucceeded, OutcomeFailed} {
+			mw.sample("bandaid_app_deployments_total", float64(app.deployments[outcome]), "app", app.id, "outcome", outcome)
+		}
+	}
+	mw.family("bandaid_app_deployment_duration_seconds", "summary", "How long finished deployments took.")
+	for _, app := range apps {
+		mw.sample("bandaid_app_deployment_duration_seconds_sum", app.deploySum, "app", app.id)
+		mw.sample("bandaid_app_deployment_duration_seconds_count", float64(app.deployCount), "app", app.id)
+	}
+	mw.family("bandaid_app_health_check_duration_seconds", "summary", "How long health checks took to answer.")
+	for _, app := range apps {
+		mw.sample("bandaid_app_health_check_duration_seconds_sum", app.health.seconds, "app", app.id)
+		mw.sample("bandaid_app_health_check_duration_seconds_count", float64(app.health.checks), "app", app.id)
+	}
+	mw.family("bandaid_app_health_check_last_duration_seconds", "gauge", "How long the last health check took.")
+	for _, app := range apps {
+		mw.sample("bandaid_app_health_check_last_duration_seconds", app.health.last, "app", app.id)
+	}
+	mw.family("bandaid_app_health_check_failures_total", "counter", "Health checks that failed or timed out.")
+	for _, app := range apps {
+		mw.sample("bandaid_app_health_check_failures_total", float64(app.health.failures), "app", app.id)
+	}
+	mw.family("bandaid_app_cpu_seconds_total", "counter", "CPU time used by the service's processes.")
+	for _, app := range apps {
+		if app.process {
+			mw.sample("bandaid_app_cpu_seconds_total", app.cpu, "app", app.id)
+		}
+	}
+	mw.family("bandaid_app_resident_memory_bytes", "gauge", "Resident memory of the service's processes.")
+	for _, app := range apps {
+		if app.process {
+			mw.sample("bandaid_app_resident_memory_bytes", float64(app.rss), "app", app.id)
+		}
+	}
+	mw.family("bandaid_app_log_bytes_total", "counter", "Bytes of output the application wrote since the manager started.")
+	for _, app := range apps {
+		for _, stream := range []string{StreamStdout, StreamStderr} {
+			mw.sample("bandaid_app_log_bytes_total", float64(app.logBytes[stream]), "app", app.id, "stream", stream)
+		}
+	}
+
+	metrics.lock.Lock()
+	calls := map[[2]string]uint64{}
+	for call, count := range metrics.calls {
+		calls[call] = count
+	}
+	metrics.lock.Unlock()
+	mw.family("bandaid_api_calls_total", "counter", "Requests sent to the Caddy and Cloudflare APIs by outcome.")
+	for _, service := range []string{"caddy", "cloudflare"} {
+		for _, outcome := range []string{"ok", "error"} {
+			mw.sample("bandaid_api_calls_total", float64(calls[[2]string{service, outcome}]), "service", service, "outcome", outcome)
+		}
+	}
+
+	scraped := newScrapedFamilies()
+	var wait sync.WaitGroup
+	for _, app := range apps {
+		if app.scrapePath == "" || app.host == "" || app.state != StateRunning {
+			continue
+		}
+		wait.Add(1)
+		go func(app appMetrics) {
+			defer wait.Done()
+			scraped.scrape(app.id, fmt.Sprintf("http://%v/%v", app.host, strings.TrimPrefix(app.scrapePath, "/")))
+		}(app)
+	}
+	wait.Wait()
+	mw.family("bandaid_app_scrape_up", "gauge", "Whether the application's own metrics could be scraped.")
+	for _, app := range apps {
+		if up, scrapedApp := scraped.up[app.id]; scrapedApp {
+			value := 0.0
+			if up {
+				value = 1
+			}
+			mw.sample("bandaid_app_scrape_up", value, "app", app.id)
+		}
+	}
+	scraped.write(ctx.Writer)
+}
+
+// scrapedFamilies merges the metrics scraped from applications, so every family is declared once with the
+// samples of all of them.
+type scrapedFamilies struct {
+	lock     sync.Mutex
+	order    []string
+	families map[string]*scrapedFamily
+	up       map[string]bool
+}
+
+type scrapedFamily struct {
+	help, kind string
+	samples    []string
+}
+
+func newScrapedFamilies() *scrapedFamilies {
+	return &scrapedFamilies{families: map[string]*scrapedFamily{}, up: map[string]bool{}}
+}
+
+// scrape reads the application's metrics, adding the app label to every sample.
+func (s *scrapedFamilies) scrape(app string, url string) {
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Get(url)
+	if err == nil && resp.StatusCode != 200 {
+		err = fmt.Errorf("%v answered %v", url, resp.Status)
+	}
+	if err != nil {
+		if resp != nil {
+			_ = resp.Body.Close()
+		}
+		s.lock.Lock()
+		s.up[app] = false
+		s.lock.Unlock()
+		return
+	}
+	defer resp.Body.Close()
+
+	type parsed struct {
+		family, sample string
+	}
+	lines := []parsed{}
+	family, help, kind := "", map[string]string{}, map[string]string{}
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 16<<20))
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) >= 3 && fields[1] == "HELP" {
+				family = fields[2]
+				if len(fields) == 4 {
+					help[family] = fields[3]
+				}
+			} else if len(fields) >= 4 && fields[1] == "TYPE" {
+				family, kind[fields[2]] = fields[2], fields[3]
+			}
+			continue
+		}
+		if line == "" {
+			continue
+		}
+		name := line
+		if end := strings.IndexAny(line, "{ "); end >= 0 {
+			name = line[:end]
+		}
+		// Histograms and summaries have samples named after their family with a suffix
+		if family == "" || !strings.HasPrefix(name, family) {
+			family = name
+		}
+		sample, ok := labelSample(line, name, app)
+		if !ok || strings.HasPrefix(name, "bandaid_") {
+			continue
+		}
+		lines = append(lines, parsed{family: family, sample: sample})
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.up[app] = scanner.Err() == nil
+	for _, line := range lines {
+		f, exists := s.families[line.family]
+		if !exists {
+			f = &scrapedFamily{help: help[line.family], kind: kind[line.family]}
+			s.families[line.family] = f
+			s.order = append(s.order, line.family)
+		}
+		f.samples = append(f.samples, line.sample)
+	}
+}
+
+// labelSample adds the app label to a sample line, an app label the application set itself is renamed to
+// exported_app like Prometheus does.
+func labelSample(line string, name string, app string) (string, bool) {
+	rest := line[len(name):]
+	label := fmt.Sprintf(`app="%v"`, labelEscaper.Replace(app))
+	if !strings.HasPrefix(rest, "{") {
+		return name + "{" + label + "}" + rest, true
+	}
+	// Find the end of the labels and where their names start, values are quoted and can contain anything
+	end, quoted, naming, names := -1, false, true, []int{}
+	for i := 1; i < len(rest) && end < 0; i++ {
+		switch {
+		case quoted && rest[i] == '\\':
+			i++
+		case rest[i] == '"':
+			quoted = !quoted
+		case quoted, rest[i] == ' ', rest[i] == '\t':
+		case rest[i] == '}':
+			end = i
+		case rest[i] == ',':
+			naming = true
+		case naming:
+			names, naming = append(names, i), false
+		}
+	}
+	if end < 0 {
+		return "", false
+	}
+	var labels strings.Builder
+	from := 1
+	for _, start := range names {
+		if equals := strings.IndexByte(rest[start:end], '='); equals >= 0 &&
+			strings.TrimSpace(rest[start:start+equals]) == "app" {
+			labels.WriteString(rest[from:start])
+			labels.WriteString("exported_")
+			from = start
+		}
+	}
+	labels.WriteString(rest[from:end])
+	renamed := strings.TrimSuffix(strings.TrimSpace(labels.String()), ",")
+	if renamed != "" {
+		renamed = "," + renamed
+	}
+	return name + "{" + label + renamed + "}" + rest[end+1:], true
+}
+
+func (s *scrapedFamilies) write(w io.Writer) {
+	sort.Strings(s.order)
+	for _, name := range s.order {
+		f := s.families[name]
+		if f.help != "" {
+			fmt.Fprintf(w, "# HELP %v %v\n", name, f.help)
+		}
+		if f.kind != "" {
+			fmt.Fprintf(w, "# TYPE %v %v\n", name, f.kind)
+		}
+		for _, sample := range f.samples {
+			fmt.Fprintln(w, sample)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLabelSample(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`requests_total 3`, `requests_total{app="web"} 3`},
+		{`requests_total{} 3`, `requests_total{app="web"} 3`},
+		{`requests_total{code="200"} 3 1602269478000`, `requests_total{app="web",code="200"} 3 1602269478000`},
+		{`requests_total{code="200",} 3`, `requests_total{app="web",code="200"} 3`},
+		{`requests_total{app="api",code="200"} 3`, `requests_total{app="web",exported_app="api",code="200"} 3`},
+		{`requests_total{code="200", app="api"} 3`, `requests_total{app="web",code="200", exported_app="api"} 3`},
+		{`requests_total{path="/x,app=y"} 3`, `requests_total{app="web",path="/x,app=y"} 3`},
+		{`requests_total{path="a\"}",app="api"} 3`, `requests_total{app="web",path="a\"}",exported_app="api"} 3`},
+		{`requests_total{happ="1",apps="2"} 3`, `requests_total{app="web",happ="1",apps="2"} 3`},
+	}
+	for _, test := range tests {
+		got, ok := labelSample(test.line, "requests_total", "web")
+		if !ok || got != test.want {
+			t.Errorf("%v\ngot  %v\nwant %v", test.line, got, test.want)
+		}
+	}
+	if _, ok := labelSample(`requests_total{code="200" 3`, "requests_total", "web"); ok {
+		t.Error("a sample without the end of its labels was accepted")
+	}
+}
+
+func TestFormatSample(t *testing.T) {
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{0, "0"},
+		{3, "3"},
+		{0.25, "0.25"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, test := range tests {
+		if got := formatSample(test.value); got != test.want {
+			t.Errorf("%v formatted as %v, want %v", test.value, got, test.want)
+		}
+	}
+}
+
+func TestScrapeMerges(t *testing.T) {
+	serve := func(body string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		}))
+	}
+	web := serve(`# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="200"} 3
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 0.5
+latency_seconds_count 3
+bandaid_app_up 1
+`)
+	defer web.Close()
+	api := serve(`# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{code="500"} 1
+`)
+	defer api.Close()
+	down := serve("")
+	down.Close()
+
+	s := newScrapedFamilies()
+	s.scrape("web", web.URL)
+	s.scrape("api", api.URL)
+	s.scrape("down", down.URL)
+	var b bytes.Buffer
+	s.write(&b)
+
+	want := `# TYPE latency_seconds histogram
+latency_seconds_bucket{app="web",le="+Inf"} 3
+latency_seconds_sum{app="web"} 0.5
+latency_seconds_count{app="web"} 3
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{app="web",code="200"} 3
+requests_total{app="api",code="500"} 1
+`
+	if b.String() != want {
+		t.Errorf("wrote\n%v\nwant\n%v", b.String(), want)
+	}
+	if !s.up["web"] || !s.up["api"] || s.up["down"] {
+		t.Errorf("up is %v", s.up)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How long to wait for a process group to go away after SIGKILL.
+const killWait = 5 * time.Second
+
+var signals = map[string]syscall.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGTERM": syscall.SIGTERM,
+}
+
+func parseSignal(name string) (syscall.Signal, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if signal, exists := signals[name]; exists {
+		return signal, nil
+	}
+	return 0, fmt.Errorf("unknown stop signal '%v'", name)
+}
+
+// StopSettings returns the signal sent to stop the service and how long to wait before killing it.
+func (config *BandaidFile) StopSettings() (syscall.Signal, time.Duration) {
+	signal := syscall.SIGTERM
+	if parsed, err := parseSignal(config.Application.StopSignal); err == nil {
+		signal = parsed
+	}
+	timeout := 10 * time.Second
+	if parsed, err := time.ParseDuration(config.Application.StopTimeout); err == nil && parsed >= 0 {
+		timeout = parsed
+	}
+	return signal, timeout
+}
+
+// stopProcess sends the stop signal to the command's process group and waits for it to exit, killing the
+// whole group once the timeout passes. The group is always killed at the end so that children the service
+// left behind don't keep holding its port.
+func stopProcess(cmd *exec.Cmd, exited <-chan struct{}, signal syscall.Signal, timeout time.Duration) error {
+	pid := cmd.Process.Pid
+	if err := signalGroup(cmd, signal); err != nil {
+		log.Printf("failed to send %v to process group %v: %v\n", signal, pid, err)
+	}
+
+	select {
+	case <-exited:
+	case <-time.After(timeout):
+		log.Printf("process %v did not stop within %v, killing it\n", pid, timeout)
+	}
+	_ = signalGroup(cmd, syscall.SIGKILL)
+
+	select {
+	case <-exited:
+		return nil
+	case <-time.After(killWait):
+		return fmt.Errorf("process %v did not exit after being killed", pid)
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Windows has no process groups or signals to send, the process can only be killed.
+func signalGroup(cmd *exec.Cmd, signal syscall.Signal) error {
+	return cmd.Process.Kill()
+}
+
+func setCredential(cmd *exec.Cmd, uid, gid uint32) {}
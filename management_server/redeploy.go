@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+)
+
+func (config *BandaidFile) HealthTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(config.Application.HealthTimeout); err == nil && timeout > 0 {
+		return timeout
+	}
+	return 2 * time.Minute
+}
+
+// DrainTimeout is how long the old revision keeps running after traffic is switched away from it, so that
+// requests it's still serving can finish.
+func (config *BandaidFile) DrainTimeout() time.Duration {
+	if timeout, err := time.ParseDuration(config.Application.DrainTimeout); err == nil && timeout >= 0 {
+		return timeout
+	}
+	return 10 * time.Second
+}
+
+// waitReady polls the service until it's ready, and fails once the timeout passes or abort is closed. With
+// a health endpoint the service has to answer it with a 2xx or 3xx, without one any response that isn't a
+// server error will do. Every check is counted in the application's metrics.
+func (app *Application) waitReady(config *BandaidFile, host string, timeout time.Duration, abort <-chan struct{}) error {
+	url := fmt.Sprintf("http://%v/%v", host, strings.TrimPrefix(config.Application.Health, "/"))
+	limit := 500
+	if config.Application.Health != "" {
+		limit = 400
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		started := time.Now()
+		resp, err := (&http.Client{Timeout: time.Second * 5}).Get(url)
+		healthy := err == nil && resp.StatusCode < limit
+		metrics.healthCheck(app.ID, time.Since(started), !healthy)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		if healthy {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("service did not come up at %v within %v", url, timeout)
+		}
+		select {
+		case <-abort:
+			return fmt.Errorf("service exited before it came up at %v", url)
+		case <-time.After(time.Second * 2):
+		}
+	}
+}
+
+// Reload deploys the latest revision of the application's ref, see resolveRef.
+func (app *Application) Reload(trigger Trigger) error {
+	app.Log_Eventf("Reloading application %v", app.ID)
+	return app.deploy("", app.beginDeployment(trigger, false))
+}
+
+// Rollback deploys a commit from the application's history, the same way a reload deploys the latest one.
+func (app *Application) Rollback(commit string, trigger Trigger) error {
+	app.Log_Eventf("Rolling back application %v to %v", app.ID, commit)
+	return app.deploy(commit, app.beginDeployment(trigger, true))
+}
+
+// deploy deploys the commit, or what the application's ref resolves to when it's empty. It's done blue/green
+// whenever possible: the new revision is cloned, built and started next to the running one on a fresh host,
+// traffic is switched over once it's healthy, and only then the old revision is drained and stopped. If
+// anything fails on the way the new revision is thrown away and the old one keeps serving.
+func (app *Application) deploy(commit string, deployment *Deployment) error {
+	app.lock.Lock()
+	serving := app.current != nil && app.State == StateRunning
+	app.lock.Unlock()
+	if !serving {
+		app.Log_Event("Deploying in place, the application isn't running")
+		return app.reloadInPlace(commit, deployment)
+	}
+	return app.redeploy(commit, deployment)
+}
+
+// reloadInPlace stops the application, checks the commit out in its checkout and launches it again.
+func (app *Application) reloadInPlace(commit string, deployment *Deployment) (err error) {
+	defer func() {
+		if err != nil {
+			app.finishDeployment(deployment, err)
+		}
+	}()
+	err = app.Kill()
+	if err != nil {
+		return err
+	}
+
+	app.Log_Eventf("Pulling from repository %v", app.Repository)
+	directory := app.Directory()
+	log.Println("Pulling new files for", directory)
+	if _, err := remoteGit(directory, app.Repository, "fetch", "--tags", "--force", "origin"); err != nil {
+		return err
+	}
+	if err := app.checkout(directory, commit, deployment); err != nil {
+		return err
+	}
+	app.lock.Lock()
+	app.deployment = deployment
+	app.lock.Unlock()
+
+	app.Launch()
+	return nil
+}
+
+// inPlaceReason explains why the new revision can't run next to the current one, or returns "" if it can.
+func (app *Application) inPlaceReason(config *BandaidFile) string {
+	if config.Caddy.Host != "" {
+		return fmt.Sprintf("the Bandaidfile pins the host to '%v'", config.Caddy.Host)
+	}
+	current, exists := api.apps.Config(app.ID)
+	if !exists {
+		return "the application has no launch configuration"
+	}
+	if strings.Join(current.Caddy.Domains, ",") != strings.Join(config.Caddy.Domains, ",") ||
+		current.DNS.Zone != config.DNS.Zone || current.DNS.Domain != config.DNS.Domain {
+		return "the new revision changes its domains"
+	}
+	return ""
+}
+
+func (app *Application) redeploy(commit string, deployment *Deployment) (err error) {
+	app.lock.Lock()
+	old, oldDirectory := app.current, app.directory
+	app.lock.Unlock()
+
+	directory := app.checkoutDirectory(fmt.Sprint(time.Now().Unix()))
+	var candidate *instance
+	host := ""
+	inPlace := false
+	defer func() {
+		if err == nil || inPlace {
+			return
+		}
+		log.Println("Error", err)
+		app.Log_Errorf("deployment aborted, the running revision keeps serving: %v", err)
+		app.finishDeployment(deployment, err)
+		app.lock.Lock()
+		app.candidate = nil
+		app.lock.Unlock()
+		if err := app.stopInstance(candidate); err != nil {
+			log.Println("Error", err)
+		}
+		if host != "" {
+			api.ReleaseHost(host)
+		}
+		_ = os.RemoveAll(directory)
+	}()
+
+	app.Log_Eventf("Cloning the new revision into %v", directory)
+	if err := app.cloneInto(directory); err != nil {
+		return err
+	}
+	if err := app.checkout(directory, commit, deployment); err != nil {
+		return err
+	}
+	config, err := app.configAt(directory)
+	if err != nil {
+		return fmt.Errorf("failed to read configuration: %v", err)
+	}
+	build, start, err := config.Commands()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	runtime, err := runtimeFor(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	if reason := app.inPlaceReason(config); reason != "" {
+		inPlace = true
+		_ = os.RemoveAll(directory)
+		app.Log_Eventf("Deploying in place, %v", reason)
+		return app.reloadInPlace(commit, deployment)
+	}
+
+	host, err = api.ReserveHost()
+	if err != nil {
+		return err
+	}
+	candidate = newInstance(directory)
+	candidate.host = host
+	candidate.runtime = runtime
+	candidate.stopSignal, candidate.stopTimeout = config.StopSettings()
+	candidate.metricsPath, candidate.config = config.Metrics.Path, config
+	app.lock.Lock()
+	app.candidate = candidate
+	app.lock.Unlock()
+
+	app.Log_Eventf("Building the new revision at '%v'", host)
+	command := app.command(candidate, config)
+	if err := app.runBuild(config, build, candidate, command); err != nil {
+		return err
+	}
+	service, err := runtime.Service(app, candidate, config, start)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+
+	app.Log_Kindf(EventProcessStarted, "Starting the new revision '%v'", service)
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		app.supervise(candidate, config, func() *exec.Cmd {
+			return command(service)
+		})
+	}()
+	if err := app.waitReady(config, host, config.HealthTimeout(), exited); err != nil {
+		return err
+	}
+
+	previous, err := api.SwitchUpstream(app.ID, host)
+	if err != nil {
+		return fmt.Errorf("failed to switch the caddy upstream: %v", err)
+	}
+	app.lock.Lock()
+	app.current, app.candidate = candidate, nil
+	app.directory = directory
+	app.lock.Unlock()
+	app.add_event(&AppEvent{
+		Kind:       EventTrafficSwitched,
+		Deployment: deployment.ID,
+		Fields:     map[string]string{"host": host, "previous": previous},
+		Message:    fmt.Sprintf("Switched traffic to the new revision at '%v'", host),
+	})
+	app.finishDeployment(deployment, nil)
+	go app.applyEdgeSettings(config, host)
+
+	drain := config.DrainTimeout()
+	app.Log_Eventf("Draining the old revision at '%v' for %v", previous, drain)
+	time.Sleep(drain)
+	if err := app.stopInstance(old); err != nil {
+		log.Println("Error", err)
+		app.Log_Errorf("failed to stop the old revision: %v", err)
+	}
+	if previous != host {
+		api.ReleaseHost(previous)
+	}
+	if err := os.RemoveAll(oldDirectory); err != nil {
+		log.Println("Error", err)
+	}
+	api.Persist()
+	return nil
+}
+
+// checkoutDirectory returns where a checkout of the application goes. The configuration stays the last
+// extension so that untracked checkouts can still be adopted on startup.
+func (app *Application) checkoutDirectory(release string) string {
+	name := app.ID
+	if release != "" {
+		name += "-" + release
+	}
+	if app.SpecificConfig != "" {
+		name += "." + strings.Replace(app.SpecificConfig, ".", "-", -1)
+	}
+	return path.Join("app_data", name)
+}
+
+func (app *Application) cloneInto(directory string) error {
+	args := []string{"clone"}
+	if app.Branch != "" {
+		args = append(args, "--branch", app.Branch)
+	}
+	args = append(args, app.Repository, directory)
+
+	_, err := remoteGit("", app.Repository, args...)
+	return err
+}
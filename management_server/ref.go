@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+)
+
+var commitPattern = regexp.MustCompile(`^[0-9a-fA-F]{4,40}$`)
+
+// resolveRef finds the commit the application's ref points to in a fetched checkout, along with the tag it
+// resolved to, if any. The ref can be empty for the head of the branch, a tag, a remote branch, a semver
+// range of tags like "^1.2" which picks the newest matching tag, or a commit SHA.
+func (app *Application) resolveRef(directory string) (commit string, tag string, err error) {
+	ref := strings.TrimSpace(app.Ref)
+	if ref == "" {
+		commit, err = revision(directory, app.upstream(directory))
+		return commit, "", err
+	}
+
+	if commit, err := revision(directory, "refs/tags/"+ref); err == nil {
+		return commit, ref, nil
+	}
+	if commit, err := revision(directory, "refs/remotes/origin/"+ref); err == nil {
+		return commit, "", nil
+	}
+	if constraint, err := semver.NewConstraint(ref); err == nil {
+		tag, err := newestTag(directory, constraint)
+		if err == nil {
+			commit, err := revision(directory, "refs/tags/"+tag)
+			return commit, tag, err
+		}
+		if !commitPattern.MatchString(ref) {
+			return "", "", err
+		}
+	}
+	if commitPattern.MatchString(ref) {
+		if commit, err := revision(directory, ref); err == nil {
+			return commit, "", nil
+		}
+	}
+	return "", "", fmt.Errorf("ref '%v' is not a tag, branch, semver range or commit of the repository", ref)
+}
+
+// newestTag returns the highest version tag that satisfies the constraint.
+func newestTag(directory string, constraint *semver.Constraints) (string, error) {
+	out, err := git(directory, "tag", "--list")
+	if err != nil {
+		return "", err
+	}
+	newest, tag := (*semver.Version)(nil), ""
+	for _, name := range strings.Fields(out) {
+		version, err := semver.NewVersion(name)
+		if err != nil || !constraint.Check(version) {
+			continue
+		}
+		if newest == nil || version.GreaterThan(newest) {
+			newest, tag = version, name
+		}
+	}
+	if newest == nil {
+		return "", fmt.Errorf("no tag matches '%v'", constraint)
+	}
+	return tag, nil
+}
+
+func revision(directory, ref string) (string, error) {
+	return git(directory, "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+}
+
+// checkout checks out the commit in the directory, or what the application's ref resolves to when it's
+// empty, and records it on the deployment.
+func (app *Application) checkout(directory, commit string, deployment *Deployment) error {
+	tag := ""
+	if commit == "" {
+		var err error
+		commit, tag, err = app.resolveRef(directory)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := git(directory, "checkout", "--force", "--detach", commit); err != nil {
+		return err
+	}
+	app.resolveDeployment(deployment, directory, tag)
+	return nil
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Registry holds the deployed applications, their launch configurations and the reserved ports. It's shared
+// by every handler, so all access goes through its methods.
+type Registry struct {
+	lock     sync.RWMutex
+	deployed map[string]*Application
+	configs  map[string]Configuration
+	reserved map[int]interface{}
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		deployed: map[string]*Application{},
+		configs:  map[string]Configuration{},
+		reserved: map[int]interface{}{},
+	}
+}
+
+func (r *Registry) Application(id string) (*Application, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	app, exists := r.deployed[id]
+	return app, exists
+}
+
+// Applications returns the deployed applications sorted by ID.
+func (r *Registry) Applications() []*Application {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	apps := make([]*Application, 0, len(r.deployed))
+	for _, app := range r.deployed {
+		apps = append(apps, app)
+	}
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].ID < apps[j].ID
+	})
+	return apps
+}
+
+// Add registers the application, failing if one with the same ID already exists.
+func (r *Registry) Add(app *Application) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, exists := r.deployed[app.ID]; exists {
+		return fmt.Errorf("resource already exists as '%v', please reload or delete the deployed application first", app.ID)
+	}
+	r.deployed[app.ID] = app
+	return nil
+}
+
+func (r *Registry) Remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.deployed, id)
+}
+
+func (r *Registry) Config(id string) (Configuration, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	config, exists := r.configs[id]
+	return config, exists
+}
+
+func (r *Registry) Configs() map[string]Configuration {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	configs := map[string]Configuration{}
+	for id, config := range r.configs {
+		configs[id] = config
+	}
+	return configs
+}
+
+func (r *Registry) SetConfig(id string, config Configuration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.configs[id] = config
+}
+
+func (r *Registry) RemoveConfig(id string) (Configuration, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	config, exists := r.configs[id]
+	delete(r.configs, id)
+	return config, exists
+}
+
+// Reserve marks the port as used, returning false if it already was.
+func (r *Registry) Reserve(port int) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if _, used := r.reserved[port]; used {
+		return false
+	}
+	r.reserved[port] = true
+	return true
+}
+
+func (r *Registry) Release(port int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.reserved, port)
+}
+
+func (r *Registry) Reserved() []int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	ports := []int{}
+	for port := range r.reserved {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// BusyError is returned when an operation is attempted on an application that's already running one.
+type BusyError struct {
+	ID        string
+	Operation string
+	Since     time.Time
+}
+
+func (e *BusyError) Error() string {
+	return fmt.Sprintf("application %v is busy: %v in progress since %v, try again later",
+		e.ID, e.Operation, e.Since.Format(time.RFC3339))
+}
+
+// operationLock serializes deploy, reload, kill and delete on a single application.
+type operationLock struct {
+	lock    sync.Mutex
+	slot    chan struct{}
+	current string
+	since   time.Time
+}
+
+func (o *operationLock) init() chan struct{} {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.slot == nil {
+		o.slot = make(chan struct{}, 1)
+	}
+	return o.slot
+}
+
+func (o *operationLock) started(operation string) {
+	o.lock.Lock()
+	o.current = operation
+	o.since = time.Now()
+	o.lock.Unlock()
+}
+
+// Current returns the operation in progress, if any.
+func (o *operationLock) Current() (string, time.Time) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.current, o.since
+}
+
+// Begin starts the operation, or returns a *BusyError if another one is in progress.
+func (app *Application) Begin(operation string) (done func(), err error) {
+	select {
+	case app.operations.init() <- struct{}{}:
+		app.operations.started(operation)
+		return app.finish, nil
+	default:
+		current, since := app.operations.Current()
+		return nil, &BusyError{ID: app.ID, Operation: current, Since: since}
+	}
+}
+
+// Queue waits until every earlier operation finished and then starts this one.
+func (app *Application) Queue(operation string) (done func()) {
+	app.operations.init() <- struct{}{}
+	app.operations.started(operation)
+	return app.finish
+}
+
+func (app *Application) finish() {
+	app.operations.started("")
+	<-app.operations.init()
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func TestBeginConflicts(t *testing.T) {
+	app := &Application{ID: "app"}
+	done, err := app.Begin("deploy")
+	if err != nil {
+		t.Fatalf("first operation failed: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	codes := make(chan int, 20)
+	for i := 0; i < cap(codes); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			ctx, _ := gin.CreateTestContext(w)
+			ctx.Request = httptest.NewRequest("GET", "/manager/app/app/reload", nil)
+			if _, ok := beginOperation(app, "reload", ctx); ok {
+				t.Error("an operation started while the deploy was in progress")
+			}
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+	for code := range codes {
+		if code != 409 {
+			t.Errorf("got %v, want 409", code)
+		}
+	}
+
+	_, err = app.Begin("kill")
+	busy, ok := err.(*BusyError)
+	if !ok || busy.Operation != "deploy" {
+		t.Fatalf("got %v, want the deploy in progress", err)
+	}
+
+	done()
+	done, err = app.Begin("kill")
+	if err != nil {
+		t.Fatalf("operation after the deploy finished failed: %v", err)
+	}
+	done()
+}
+
+func TestBeginOnlyOneWins(t *testing.T) {
+	app := &Application{ID: "app"}
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	started := 0
+	release := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done, err := app.Begin("reload")
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			started++
+			lock.Unlock()
+			<-release
+			done()
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	if started != 1 {
+		t.Fatalf("%v operations started at once, want 1", started)
+	}
+}
+
+func TestQueueRunsAfterCurrent(t *testing.T) {
+	app := &Application{ID: "app"}
+	done, err := app.Begin("deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var lock sync.Mutex
+	order := []string{}
+	record := func(step string) {
+		lock.Lock()
+		order = append(order, step)
+		lock.Unlock()
+	}
+
+	queued := make(chan struct{})
+	go func() {
+		w := httptest.NewRecorder()
+		ctx, _ := gin.CreateTestContext(w)
+		ctx.Request = httptest.NewRequest("GET", "/manager/app/app/reload?wait=true", nil)
+		finish, ok := beginOperation(app, "reload", ctx)
+		if !ok {
+			t.Error("the queued operation was refused")
+			close(queued)
+			return
+		}
+		record("reload")
+		if current, _ := app.operations.Current(); current != "reload" {
+			t.Errorf("current operation is %q, want reload", current)
+		}
+		finish()
+		close(queued)
+	}()
+
+	select {
+	case <-queued:
+		t.Fatal("the queued operation ran while the deploy was in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+	record("deploy")
+	done()
+
+	select {
+	case <-queued:
+	case <-time.After(time.Second):
+		t.Fatal("the queued operation never ran")
+	}
+	if len(order) != 2 || order[0] != "deploy" || order[1] != "reload" {
+		t.Fatalf("ran %v, want deploy then reload", order)
+	}
+	if current, _ := app.operations.Current(); current != "" {
+		t.Fatalf("operation %q still in progress", current)
+	}
+}
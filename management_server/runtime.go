@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const (
+	RuntimeHost      = "host"
+	RuntimeContainer = "container"
+)
+
+// Runtime decides how an instance's build steps and service run. Whatever commands it returns are started,
+// supervised and stopped like any other process, Cleanup removes what they leave behind outside of their
+// process group.
+type Runtime interface {
+	// Build returns the commands that build the instance from the Bandaidfile's build steps.
+	Build(app *Application, inst *instance, config *BandaidFile, steps [][]string) ([][]string, error)
+	// Service returns the command that runs the service in the foreground.
+	Service(app *Application, inst *instance, config *BandaidFile, start []string) ([]string, error)
+	// Env returns the environment the commands run with.
+	Env(app *Application, inst *instance, config *BandaidFile) []string
+	// Prepare is called before the instance is built, to set up its limits.
+	Prepare(app *Application, inst *instance, config *BandaidFile) error
+	// Usage reports the resources the instance uses against its limits.
+	Usage(app *Application, inst *instance) (*ResourceUsage, error)
+	// Cleanup is called once the instance is stopped.
+	Cleanup(app *Application, inst *instance) error
+}
+
+// runtimes are picked by the Bandaidfile's [runtime] type.
+var runtimes = map[string]Runtime{
+	RuntimeHost:      hostRuntime{},
+	RuntimeContainer: containerRuntime{},
+}
+
+func runtimeFor(config *BandaidFile) (Runtime, error) {
+	name := config.Runtime.Type
+	if name == "" {
+		name = RuntimeHost
+	}
+	runtime, exists := runtimes[name]
+	if !exists {
+		return nil, fmt.Errorf("unknown runtime '%v'", name)
+	}
+	return runtime, nil
+}
+
+// workDirectory is where the instance's commands run.
+func workDirectory(inst *instance, config *BandaidFile) string {
+	return path.Join(inst.directory, config.Application.BaseDirectory)
+}
+
+// inheritedEnv are the variables of the manager's environment that applications' commands get. Everything else,
+// the manager's tokens and secrets included, stays with the manager.
+var inheritedEnv = []string{"PATH", "HOME"}
+
+// engineEnv are the variables the container engine's CLI needs to reach the engine. Containers only get the
+// variables run names, so they're safe to hand to it.
+var engineEnv = []string{"DOCKER_HOST", "DOCKER_CONFIG", "DOCKER_CERT_PATH", "DOCKER_TLS_VERIFY", "CONTAINER_HOST",
+	"XDG_RUNTIME_DIR"}
+
+// baseEnv picks the named variables from the manager's environment.
+func baseEnv(names ...string) []string {
+	env := []string{}
+	for _, name := range names {
+		if value, exists := os.LookupEnv(name); exists {
+			env = append(env, name+"="+value)
+		}
+	}
+	return env
+}
+
+// hostRuntime runs the commands directly on the host with a minimal environment, confined by a sandbox.
+type hostRuntime struct{}
+
+func (hostRuntime) Build(app *Application, inst *instance, config *BandaidFile, steps [][]string) ([][]string, error) {
+	return steps, nil
+}
+
+func (hostRuntime) Service(app *Application, inst *instance, config *BandaidFile, start []string) ([]string, error) {
+	return start, nil
+}
+
+func (hostRuntime) Env(app *Application, inst *instance, config *BandaidFile) []string {
+	app.lock.Lock()
+	env := append(baseEnv(inheritedEnv...), fmt.Sprintf("APP_HOST=%v", inst.host))
+	app.lock.Unlock()
+	return append(env, config.Application.Envs...)
+}
+
+func (hostRuntime) Prepare(app *Application, inst *instance, config *BandaidFile) error {
+	box, err := newSandbox(app, inst, config)
+	if err != nil {
+		return err
+	}
+	app.lock.Lock()
+	inst.sandbox = box
+	app.lock.Unlock()
+	return nil
+}
+
+func (hostRuntime) Usage(app *Application, inst *instance) (*ResourceUsage, error) {
+	app.lock.Lock()
+	box := inst.sandbox
+	app.lock.Unlock()
+	if box == nil {
+		return nil, nil
+	}
+	usage := &ResourceUsage{}
+	if box.cgroup != "" {
+		var err error
+		if usage, err = cgroupUsage(box.cgroup); err != nil {
+			return nil, err
+		}
+	}
+	usage.OpenFilesMax, usage.User = box.openFiles, box.user
+	return usage, nil
+}
+
+func (hostRuntime) Cleanup(app *Application, inst *instance) error {
+	app.lock.Lock()
+	box := inst.sandbox
+	app.lock.Unlock()
+	return box.remove()
+}
+
+// containerRuntime runs the service in a container, built from the repository's Dockerfile or from the
+// Bandaidfile's image with the checkout mounted at /app. The container only gets APP_HOST and the
+// Bandaidfile's envs, and its port is published on the instance's host.
+type containerRuntime struct{}
+
+// The label every container of an instance gets, used to clean them up.
+const instanceLabel = "bandaid.instance"
+
+var containerNameInvalid = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// containerEngine is the docker compatible CLI set in the [runtime] section of config.ini.
+func containerEngine() string {
+	if api == nil || api.Config == nil {
+		return "docker"
+	}
+	return api.Config.Section("runtime").Key("engine").MustString("docker")
+}
+
+// containerName names the instance's image and containers after its checkout, which is unique per revision.
+func containerName(app *Application, inst *instance) string {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	return "bandaid-" + containerNameInvalid.ReplaceAllString(strings.ToLower(path.Base(inst.directory)), "-")
+}
+
+// containerPorts returns the address the container is published on and the port it listens on inside.
+func containerPorts(app *Application, inst *instance, config *BandaidFile) (publish string, port string, err error) {
+	app.lock.Lock()
+	host := inst.host
+	app.lock.Unlock()
+	hostname, hostPort, err := net.SplitHostPort(host)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid host '%v': %v", host, err)
+	}
+	if hostname == "" || hostname == "localhost" {
+		hostname = "127.0.0.1"
+	}
+	if net.ParseIP(hostname) == nil {
+		return "", "", fmt.Errorf("containers can only be published on an IP address, not '%v'", hostname)
+	}
+	port = hostPort
+	if config.Runtime.Port != 0 {
+		port = fmt.Sprint(config.Runtime.Port)
+	}
+	return net.JoinHostPort(hostname, hostPort) + ":" + port, port, nil
+}
+
+// run returns the arguments that run a container of the instance, up to the image. Only the names of the
+// variables are passed, their values come from the CLI's environment so they don't show up in events.
+func (containerRuntime) run(app *Application, inst *instance, config *BandaidFile) ([]string, error) {
+	args := []string{containerEngine(), "run", "--rm", "--label", instanceLabel + "=" + containerName(app, inst),
+		"--env", "APP_HOST"}
+	args = append(args, containerLimits(config.Limits)...)
+	for _, env := range config.Application.Envs {
+		// A bare name would be copied from the manager's environment
+		if i := strings.Index(env, "="); i > 0 {
+			args = append(args, "--env", env[:i])
+		}
+	}
+	if config.Runtime.Image == "" {
+		return append(args, containerName(app, inst)), nil
+	}
+	app.lock.Lock()
+	directory, err := filepath.Abs(workDirectory(inst, config))
+	app.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return append(args, "--volume", directory+":/app", "--workdir", "/app", config.Runtime.Image), nil
+}
+
+func (rt containerRuntime) Build(app *Application, inst *instance, config *BandaidFile, steps [][]string) ([][]string, error) {
+	if config.Runtime.Image == "" {
+		if len(steps) > 0 {
+			return nil, fmt.Errorf("build steps don't run with a Dockerfile, move them into the Dockerfile")
+		}
+		dockerfile := config.Runtime.Dockerfile
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		name := containerName(app, inst)
+		return [][]string{{containerEngine(), "build", "--tag", name, "--label", instanceLabel + "=" + name,
+			"--file", dockerfile, "."}}, nil
+	}
+
+	commands := [][]string{}
+	for _, step := range steps {
+		args, err := rt.run(app, inst, config)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, append(args, step...))
+	}
+	return commands, nil
+}
+
+func (rt containerRuntime) Service(app *Application, inst *instance, config *BandaidFile, start []string) ([]string, error) {
+	publish, _, err := containerPorts(app, inst, config)
+	if err != nil {
+		return nil, err
+	}
+	args, err := rt.run(app, inst, config)
+	if err != nil {
+		return nil, err
+	}
+	image := args[len(args)-1]
+	args = append(args[:len(args)-1], "--publish", publish, image)
+	return append(args, start...), nil
+}
+
+// containerLimits returns the engine's flags for the Bandaidfile's limits.
+func containerLimits(limits Limits) []string {
+	args := []string{}
+	if memory, err := parseBytes(limits.Memory); err == nil {
+		args = append(args, "--memory", fmt.Sprint(memory), "--memory-swap", fmt.Sprint(memory))
+	}
+	if limits.CPUWeight != 0 {
+		// The engine takes cgroup v1 shares, 1024 of which are the default weight of 100
+		args = append(args, "--cpu-shares", fmt.Sprint(limits.CPUWeight*1024/100))
+	}
+	if limits.CPUQuota != 0 {
+		args = append(args, "--cpus", fmt.Sprint(limits.CPUQuota))
+	}
+	if limits.Pids != 0 {
+		args = append(args, "--pids-limit", fmt.Sprint(limits.Pids))
+	}
+	if limits.OpenFiles != 0 {
+		args = append(args, "--ulimit", fmt.Sprintf("nofile=%v:%v", limits.OpenFiles, limits.OpenFiles))
+	}
+	return args
+}
+
+// Env is the environment of the engine's CLI, containers only get the variables run names.
+func (containerRuntime) Env(app *Application, inst *instance, config *BandaidFile) []string {
+	env := append(baseEnv(inheritedEnv...), baseEnv(engineEnv...)...)
+	if _, port, err := containerPorts(app, inst, config); err == nil {
+		env = append(env, "APP_HOST=0.0.0.0:"+port)
+	}
+	return append(env, config.Application.Envs...)
+}
+
+func (containerRuntime) Prepare(app *Application, inst *instance, config *BandaidFile) error {
+	return config.Limits.Validate()
+}
+
+// Usage reads the cgroup of the instance's running container.
+func (containerRuntime) Usage(app *Application, inst *instance) (*ResourceUsage, error) {
+	engine, name := containerEngine(), containerName(app, inst)
+	b, err := exec.Command(engine, "ps", "--quiet", "--filter", "label="+instanceLabel+"="+name).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the containers of %v: %v", name, err)
+	}
+	containers := strings.Fields(string(b))
+	if len(containers) == 0 {
+		return nil, nil
+	}
+	b, err = exec.Command(engine, "inspect", "--format", "{{.State.Pid}}", containers[0]).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect container %v: %v", containers[0], err)
+	}
+	cgroup, err := processCgroup(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, err
+	}
+	return cgroupUsage(cgroup)
+}
+
+// Cleanup removes the containers that outlived their CLI, which is what gets killed when the service doesn't
+// stop in time, and the image built for the instance.
+func (containerRuntime) Cleanup(app *Application, inst *instance) error {
+	engine, name := containerEngine(), containerName(app, inst)
+	b, err := exec.Command(engine, "ps", "--all", "--quiet", "--filter", "label="+instanceLabel+"="+name).Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the containers of %v: %v", name, err)
+	}
+	if containers := strings.Fields(string(b)); len(containers) > 0 {
+		if b, err := exec.Command(engine, append([]string{"rm", "--force"}, containers...)...).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to remove the containers of %v: %v: %v", name, strings.TrimSpace(string(b)), err)
+		}
+	}
+	// Instances running a Bandaidfile image have no image of their own
+	_ = exec.Command(engine, "image", "rm", "--force", name).Run()
+	return nil
+}
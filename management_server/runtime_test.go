@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"gopkg.in/ini.v1"
+)
+
+// testAPI points the global api at a temporary directory for the duration of a test, with the extra config.ini
+// sections given.
+func testAPI(t *testing.T, config string) string {
+	directory, err := ioutil.TempDir("", "bandaid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := ini.Load([]byte("[logs]\ndirectory=" + directory + "/logs\n" +
+		"[events]\ndirectory=" + directory + "/events\n" +
+		"[webhooks]\ndirectory=" + directory + "/webhooks\n" + config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := api
+	api = &API{Config: file, apps: NewRegistry(), store: &Store{Path: directory + "/state.json"}}
+	t.Cleanup(func() {
+		api = saved
+		os.RemoveAll(directory)
+	})
+	return directory
+}
+
+// setenv sets an environment variable for the duration of a test.
+func setenv(t *testing.T, name, value string) {
+	saved, existed := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if existed {
+			os.Setenv(name, saved)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+func envNames(env []string) []string {
+	names := []string{}
+	for _, variable := range env {
+		names = append(names, strings.SplitN(variable, "=", 2)[0])
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestRuntimeEnvLeavesSecretsOut(t *testing.T) {
+	setenv(t, "PATH", "/usr/bin:/bin")
+	setenv(t, "HOME", "/home/bandaid")
+	setenv(t, "CLOUDFLARE_TOKEN", "secret")
+	setenv(t, "DOCKER_HOST", "unix:///run/docker.sock")
+
+	app := &Application{ID: "app"}
+	inst := newInstance("app_data/app")
+	inst.host = "127.0.0.1:9000"
+	config := &BandaidFile{}
+	config.Application.Envs = []string{"GREETING=hello"}
+
+	tests := []struct {
+		runtime Runtime
+		want    string
+	}{
+		{hostRuntime{}, "APP_HOST,GREETING,HOME,PATH"},
+		{containerRuntime{}, "APP_HOST,DOCKER_HOST,GREETING,HOME,PATH"},
+	}
+	for _, test := range tests {
+		env := test.runtime.Env(app, inst, config)
+		if got := strings.Join(envNames(env), ","); got != test.want {
+			t.Errorf("%T passes %v, want %v", test.runtime, got, test.want)
+		}
+		for _, variable := range env {
+			if strings.Contains(variable, "secret") {
+				t.Errorf("%T leaks %v", test.runtime, variable)
+			}
+		}
+	}
+}
+
+// fakeRuntime runs the build steps as they are with its own environment, and records what it was asked to do.
+type fakeRuntime struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (rt *fakeRuntime) record(call string) {
+	rt.lock.Lock()
+	rt.calls = append(rt.calls, call)
+	rt.lock.Unlock()
+}
+
+func (rt *fakeRuntime) Build(app *Application, inst *instance, config *BandaidFile, steps [][]string) ([][]string, error) {
+	rt.record("build")
+	return steps, nil
+}
+
+func (rt *fakeRuntime) Service(app *Application, inst *instance, config *BandaidFile, start []string) ([]string, error) {
+	rt.record("service")
+	return start, nil
+}
+
+func (rt *fakeRuntime) Env(app *Application, inst *instance, config *BandaidFile) []string {
+	rt.record("env")
+	return append([]string{"PATH=" + os.Getenv("PATH"), "RUNTIME=fake"}, config.Application.Envs...)
+}
+
+func (rt *fakeRuntime) Prepare(app *Application, inst *instance, config *BandaidFile) error {
+	rt.record("prepare")
+	return nil
+}
+
+func (rt *fakeRuntime) Usage(app *Application, inst *instance) (*ResourceUsage, error) {
+	return nil, nil
+}
+
+func (rt *fakeRuntime) Cleanup(app *Application, inst *instance) error {
+	rt.record("cleanup")
+	return nil
+}
+
+func TestBuildRunsThroughRuntime(t *testing.T) {
+	directory := testAPI(t, "")
+	setenv(t, "CLOUDFLARE_TOKEN", "secret")
+	fake := &fakeRuntime{}
+	runtimes["fake"] = fake
+	defer delete(runtimes, "fake")
+
+	config := &BandaidFile{}
+	config.Runtime.Type = "fake"
+	config.Application.Envs = []string{"GREETING=hello"}
+	runtime, err := runtimeFor(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &Application{ID: "fake-app"}
+	inst := newInstance(directory)
+	inst.runtime = runtime
+	err = app.runBuild(config, [][]string{{"sh", "-c", `echo "$RUNTIME $GREETING token=$CLOUDFLARE_TOKEN"`}}, inst,
+		app.command(inst, config))
+	if err != nil {
+		t.Fatalf("build failed: %v\n%v", err, app.build.String())
+	}
+
+	if output := strings.TrimSpace(app.build.String()); output != "fake hello token=" {
+		t.Errorf("build printed %q, want the fake runtime's environment", output)
+	}
+	if calls := strings.Join(fake.calls, ","); calls != "env,build,prepare" {
+		t.Errorf("runtime was called for %v, want env,build,prepare", calls)
+	}
+}
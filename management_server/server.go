@@ -1,21 +1,18 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"github.com/gin-gonic/gin"
 	"github.com/levigross/grequests"
+	"github.com/nokusukun/bandaid"
 	"gopkg.in/ini.v1"
-	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -27,7 +24,8 @@ var (
 	caddy_address   string
 )
 
-func init() {
+// setup loads config.ini and checks that git is installed.
+func setup() {
 	config, err := ini.Load("config.ini")
 	manager_address = config.Section("locations").Key("manager").String()
 	slack_address = config.Section("locations").Key("slack_engine").String()
@@ -40,10 +38,12 @@ func init() {
 		//CFToken:  config.Section("cloudflare").Key("token").String(),
 		Config:   config,
 		CaddyAPI: "http://localhost:2019",
-		reserved: map[int]interface{}{},
-		configs:  map[string]Configuration{},
-		deployed: map[string]*Application{},
+		apps:     NewRegistry(),
+		store:    &Store{Path: "state.json"},
+
+		credentials: &CredentialStore{Directory: "credentials"},
 	}
+	bandaid.ObserveCall = metrics.countCall
 
 	err = exec.Command("git", "--version").Run()
 	if err != nil {
@@ -53,12 +53,23 @@ func init() {
 }
 
 func main() {
+	setup()
+
 	// Making sure that caddy is actually running
 	_, err := grequests.Get(fmt.Sprintf("http://%v", caddy_address), nil)
 	if err != nil {
 		panic(fmt.Errorf("Initial request failed, make sure caddy-admin is running on localhost:2019 (%v)", err))
 	}
 
+	if err := api.StartForwarders(); err != nil {
+		panic(fmt.Errorf("Invalid log forwarder %v", err))
+	}
+	if err := api.StartAlerts(); err != nil {
+		panic(fmt.Errorf("Invalid alerts %v", err))
+	}
+	api.StartHealthChecks()
+	api.StartWebhooks()
+
 	go func() {
 		panic(api.BuildAPI().Run(manager_address))
 	}()
@@ -68,6 +79,9 @@ func main() {
 
 	time.Sleep(time.Second)
 
+	log.Println("[startup] Verifying cloudflare tokens in the background...")
+	go api.VerifyTokens()
+
 	LoadApplications()
 
 	log.Println("[startup] Initialization done, ctrl+c to exit")
@@ -76,28 +90,59 @@ func main() {
 	go func() {
 		for _ = range c {
 			log.Println("Exiting...")
-			for _, application := range api.deployed {
-				_ = application.Kill()
+			var stopping sync.WaitGroup
+			for _, application := range api.apps.Applications() {
+				stopping.Add(1)
+				go func(application *Application) {
+					defer stopping.Done()
+					if err := application.Kill(); err != nil {
+						log.Println("Failed to stop", application.ID, err)
+					}
+				}(application)
 			}
+			stopping.Wait()
 			os.Exit(1)
 		}
 	}()
 	select {}
 }
 
+// launchRestored launches an application found at startup as an operation, unless a deploy or reload that came
+// in through the API since it was registered already launched it.
+func launchRestored(application *Application) {
+	done := application.Queue("restore")
+	defer done()
+	application.lock.Lock()
+	launched := application.current != nil
+	application.lock.Unlock()
+	if !launched {
+		application.Launch()
+	}
+}
+
 func LoadApplications() {
-	log.Println("[startup] Looking for deployed services...")
+	log.Println("[startup] Restoring saved applications...")
+	restored, err := api.Restore()
+	if err != nil {
+		log.Println("[startup] Failed to restore state:", err)
+	}
+	tracked := map[string]bool{}
+	for _, application := range restored {
+		log.Println("[startup] Restored", application.ID, application.Repository)
+		tracked[path.Clean(application.directory)] = true
+		application.Log_Event("Restored after manager restart")
+		launchRestored(application)
+	}
+
+	log.Println("[startup] Looking for untracked services...")
 	matches, err := filepath.Glob(path.Join("app_data", "**"))
 	if err != nil {
 		panic(err)
 	}
 	for _, match := range matches {
-		// check if it's a valid hash by attempting to hex decode the folder name
-		//id := filepath.Base(match)
-		// Check if it's a valid application folder by attempting to decode it as a hex string
-		//if _, err := hex.DecodeString(id); err != nil {
-		//	continue
-		//}
+		if tracked[path.Clean(match)] {
+			continue
+		}
 
 		stat_dir, err := os.Stat(match)
 
@@ -132,20 +177,24 @@ func LoadApplications() {
 			specificConfig = strings.Replace(specificConfig[1:], "-", ".", -1)
 		}
 
-		body, _ := json.Marshal(gin.H{
-			"repository": origin,
-			"config":     specificConfig,
-		})
-		manager_address := api.Config.Section("locations").Key("manager").String()
-		response, err := (&http.Client{Timeout: time.Minute * 10}).Post(fmt.Sprintf("http://%v/manager/app", manager_address), "application/json", bytes.NewBuffer(body))
-		if err != nil {
-			log.Println("[startup] Failed:", err)
+		// Adopt the existing checkout instead of cloning it again
+		application := &Application{
+			Repository:     origin,
+			SpecificConfig: specificConfig,
+			ID:             ApplicationID(origin, specificConfig),
+			directory:      match,
+		}
+		if _, err := application.Config(); err != nil {
+			log.Println("[startup] Failed reading Bandaidfile:", err)
 			continue
 		}
-		data, err := ioutil.ReadAll(response.Body)
-		if err != nil {
-			log.Println("[startup] Failed:", err)
+		if err := api.apps.Add(application); err != nil {
+			log.Println("[startup]", err)
+			continue
 		}
-		log.Println("[startup] OK:", string(data))
+		application.recordDeployment(Trigger{Source: SourceStartup})
+		launchRestored(application)
+		log.Println("[startup] OK:", application.ID)
 	}
+	api.Persist()
 }
@@ -9,6 +9,7 @@ import (
 	"github.com/levigross/grequests"
 	"github.com/nokusukun/bandaid"
 	"gopkg.in/ini.v1"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -19,6 +20,7 @@ import (
 const (
 	ACT_SHOWACTIONS = "button-actions"
 	ACT_RELOAD      = "button-reload"
+	ACT_ROLLBACK    = "button-rollback"
 	ACT_KILL        = "button-kill"
 	ACT_STDOUT      = "button-log-stdout"
 	ACT_STDERR      = "button-log-stderr"
@@ -110,7 +112,7 @@ func (Oakland) DeployApplication(g *gin.Context) {
 		return
 	}
 	go func() {
-		r, err := (&http.Client{Timeout: 60 * time.Second}).Post("http://"+manager_address+"/manager/app", "application/json", bytes.NewBuffer(payload))
+		r, err := managerRequest("POST", "http://"+manager_address+"/manager/app", command.UserName, bytes.NewBuffer(payload), 60*time.Second)
 		if IsErrorSlack(err, "Oakland management server seems to be down", command.Command, g) {
 			return
 		}
@@ -173,7 +175,15 @@ func (Oakland) GetApplicationStatus(g *gin.Context) {
 		return
 	}
 
-	statuses := []*AppStatus{}
+	// The applications are listed with only their last event.
+	statuses := []*struct {
+		Application struct {
+			ID         string    `json:"id"`
+			Repository string    `json:"repository"`
+			LastEvent  *AppEvent `json:"last_event"`
+		} `json:"application"`
+		Status HealthStatus `json:"status"`
+	}{}
 	err = json.NewDecoder(response.Body).Decode(&statuses)
 	if IsErrorSlack(err, "Cannot decode body to JSON", command.Command, g) {
 		return
@@ -186,18 +196,19 @@ func (Oakland) GetApplicationStatus(g *gin.Context) {
 
 	blocks := []gin.H{}
 	for _, status := range statuses {
-		emoji := "✔️"
-		switch v := status.Status.(map[string]interface{})["error"].(type) {
-		case bool:
-			if v {
-				emoji = "❌"
-			}
-		case string:
-			if v != "" {
-				emoji = "❌"
+		last := "none"
+		if event := status.Application.LastEvent; event != nil {
+			last = event.Message
+			if event.Error != "" {
+				last = event.Error
 			}
-		default:
+		}
+		emoji := "✔️"
+		switch {
+		case !status.Status.Checked:
 			emoji = "❓"
+		case !status.Status.Healthy:
+			emoji = "❌"
 		}
 		blocks = append(blocks, gin.H{
 			"type": "section",
@@ -207,7 +218,7 @@ func (Oakland) GetApplicationStatus(g *gin.Context) {
 					emoji,
 					status.Application.ID,
 					status.Application.Repository,
-					status.Application.Events[len(status.Application.Events)-1].Message,
+					last,
 				),
 			},
 			"accessory": gin.H{
@@ -247,12 +258,17 @@ func (app *Oakland) Interact(g *gin.Context) {
 		fmt.Println("Showing action buttons")
 		app.InteractShowActionButtons(action, payload.ResponseURL)
 	case ACT_RELOAD:
-		err = app.InteractReloadApplication(action.ApplicationID())
+		err = app.InteractReloadApplication(action.ApplicationID(), payload.User.Username)
 		if err == nil {
 			_, _ = grequests.Post(payload.ResponseURL, &grequests.RequestOptions{
 				JSON: gin.H{"text": "Operation Successful"}})
 			LogEvent(BuildSuccessBlock(fmt.Sprintf("%v(%v)", payload.User.Username, payload.User.ID), "Reload", action.ApplicationRepo()), app.LogHook)
 		}
+	case ACT_ROLLBACK:
+		err = app.InteractRollbackApplication(action.ApplicationID(), payload.User.Username, payload.ResponseURL)
+		if err == nil {
+			LogEvent(BuildSuccessBlock(fmt.Sprintf("%v(%v)", payload.User.Username, payload.User.ID), "Rollback", action.ApplicationRepo()), app.LogHook)
+		}
 	case ACT_KILL:
 		err = app.InteractDeleteApplication(action.ApplicationID(), payload.ResponseURL)
 		if err == nil {
@@ -278,8 +294,8 @@ func (app *Oakland) InteractDefaultResponse(action Action, responseURL string) {
 	_, _ = grequests.Post(responseURL, &grequests.RequestOptions{JSON: gin.H{"text": "Unknown action selected: " + action.ActionID}})
 }
 
-func (app *Oakland) InteractReloadApplication(id string) error {
-	resp, err := (&http.Client{Timeout: time.Minute * 2}).Get(fmt.Sprintf("http://"+manager_address+"/manager/app/%v/reload", id))
+func (app *Oakland) InteractReloadApplication(id string, user string) error {
+	resp, err := managerRequest("GET", fmt.Sprintf("http://"+manager_address+"/manager/app/%v/reload", id), user, nil, time.Minute*2)
 	if err != nil {
 		return err
 	}
@@ -289,6 +305,44 @@ func (app *Oakland) InteractReloadApplication(id string) error {
 	return nil
 }
 
+// InteractRollbackApplication rolls the application back to its previous successful deployment.
+func (app *Oakland) InteractRollbackApplication(id string, user string, responseURL string) error {
+	resp, err := managerRequest("POST", fmt.Sprintf("http://%v/manager/app/%v/rollback", manager_address, id), user, nil, time.Minute*2)
+	if err != nil {
+		return err
+	}
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("Command failed: %v", string(msg))
+	}
+	result := struct {
+		Commit string `json:"commit"`
+	}{}
+	if err := json.Unmarshal(msg, &result); err != nil {
+		return err
+	}
+	_, _ = grequests.Post(responseURL, &grequests.RequestOptions{
+		JSON: gin.H{"text": fmt.Sprintf("Rolling back to `%v`", result.Commit)}})
+	return nil
+}
+
+// managerRequest calls the management server on behalf of a Slack user, so deployments record who started them.
+func managerRequest(method, url, user string, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	request.Header.Set("X-Bandaid-Source", SourceSlack)
+	request.Header.Set("X-Bandaid-User", user)
+	return (&http.Client{Timeout: timeout}).Do(request)
+}
+
 func (app *Oakland) InteractDeleteApplication(id string, responseURL string) error {
 	resp, _ := req.Delete(fmt.Sprintf("http://"+manager_address+"/manager/app/%v", id))
 	//if err != nil {
@@ -331,34 +385,43 @@ func (app *Oakland) InteractStderr(id string, responseURL string) error {
 }
 
 func (app *Oakland) InteractEvents(id string, responseURL string) error {
-	resp, err := (&http.Client{Timeout: time.Minute * 2}).Get(fmt.Sprintf("http://%v/manager/app/%v/events", manager_address, id))
+	resp, err := (&http.Client{Timeout: time.Minute * 2}).Get(fmt.Sprintf("http://%v/manager/app/%v/events?limit=20", manager_address, id))
 	if err != nil {
 		return err
 	}
 	if resp.StatusCode != 200 {
 		return fmt.Errorf("Command failed")
 	}
-	events := []AppEvent{}
-	err = json.NewDecoder(resp.Body).Decode(&events)
+	page := EventPage{}
+	err = json.NewDecoder(resp.Body).Decode(&page)
 	if err != nil {
 		return err
 	}
 
 	blocks := []gin.H{}
 
-	for _, event := range events {
+	for _, event := range page.Events {
 		ts := event.Timestamp.Format(time.Stamp)
-		msgtype := "⚠️ Error"
-		msg := fmt.Sprintf("%v", event.Error)
-		if event.Message != "" {
-			msgtype = "ℹ️ Message"
-			msg = event.Message
+		emoji := "ℹ️"
+		switch event.Severity {
+		case SeverityWarning:
+			emoji = "⚠️"
+		case SeverityError:
+			emoji = "❌"
+		}
+		msg := event.Message
+		if event.Error != "" {
+			msg = event.Error
+		}
+		context := fmt.Sprintf("by %v", event.Actor)
+		if event.Deployment != 0 {
+			context += fmt.Sprintf(", deployment #%v", event.Deployment)
 		}
 		blocks = append(blocks, gin.H{
 			"type": "section",
 			"text": gin.H{
 				"type": "mrkdwn",
-				"text": fmt.Sprintf("*%v* %v\n`%v`", ts, msgtype, msg),
+				"text": fmt.Sprintf("*%v* %v `%v` _%v_\n`%v`", ts, emoji, event.Kind, context, msg),
 			},
 		}, gin.H{
 			"type": "divider",
@@ -402,6 +465,15 @@ func (app *Oakland) InteractShowActionButtons(action Action, responseURL string)
 					"action_id": ACT_RELOAD,
 					"style":     "primary",
 				},
+				{
+					"type": "button",
+					"text": gin.H{
+						"type": "plain_text",
+						"text": "Rollback",
+					},
+					"value":     action.Value,
+					"action_id": ACT_ROLLBACK,
+				},
 				{
 					"type": "button",
 					"text": gin.H{
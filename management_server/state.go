@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	StateCloning    = "cloning"
+	StateBuilding   = "building"
+	StateStarting   = "starting"
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateExited     = "exited"
+	StateFailed     = "failed"
+	StateStopped    = "stopped"
+)
+
+// transitions lists the states an application can move to from each state. Any state can move to failed or
+// stopped, "" is a freshly registered application.
+var transitions = map[string][]string{
+	"":              {StateCloning, StateBuilding},
+	StateCloning:    {StateBuilding},
+	StateBuilding:   {StateStarting},
+	StateStarting:   {StateRunning},
+	StateRunning:    {StateRestarting, StateExited},
+	StateRestarting: {StateRunning},
+	StateExited:     {StateCloning, StateBuilding},
+	StateFailed:     {StateCloning, StateBuilding},
+	StateStopped:    {StateCloning, StateBuilding},
+}
+
+func canTransition(from, to string) bool {
+	if to == StateFailed || to == StateStopped {
+		return true
+	}
+	for _, allowed := range transitions[from] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+// setState moves the application to the given state, invalid transitions are logged and ignored. The state is
+// persisted when it changes.
+func (app *Application) setState(state string) bool {
+	app.lock.Lock()
+	previous := app.State
+	ok := app.setStateLocked(state)
+	changed := app.State != previous
+	app.lock.Unlock()
+	if changed {
+		api.Persist()
+	}
+	return ok
+}
+
+// setStateLocked is setState with the application's lock held, callers persist the state once they unlock.
+func (app *Application) setStateLocked(state string) bool {
+	if app.State == state {
+		return true
+	}
+	if !canTransition(app.State, state) {
+		log.Printf("[%v] ignoring invalid state transition %v -> %v\n", app.ID, app.State, state)
+		return false
+	}
+	app.State = state
+	app.StateSince = time.Now()
+	return true
+}
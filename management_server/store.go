@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Store persists the manager's state as JSON so deployed applications survive restarts. Writes go to a
+// temporary file that is renamed over the old one, so a crash never leaves a half written state behind.
+type Store struct {
+	Path string
+
+	lock sync.Mutex
+}
+
+// ApplicationRecord has the same fields as Application, without its locking MarshalJSON.
+type ApplicationRecord Application
+
+type StoredApplication struct {
+	*ApplicationRecord
+	Directory string   `json:"directory"`
+	EventURLs []string `json:"event_urls"`
+	// WebhookSecret signs the deliveries to the event URLs
+	WebhookSecret string `json:"webhook_secret,omitempty"`
+}
+
+type State struct {
+	Applications map[string]*StoredApplication `json:"applications"`
+	Configs      map[string]Configuration      `json:"configs"`
+	Reserved     []int                         `json:"reserved"`
+}
+
+func (s *Store) Load() (*State, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	state := &State{
+		Applications: map[string]*StoredApplication{},
+		Configs:      map[string]Configuration{},
+	}
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// Update saves the state built by snapshot. Snapshots are taken under the store's lock, so an older state
+// can never overwrite a newer one.
+func (s *Store) Update(snapshot func() *State) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	b, err := json.MarshalIndent(snapshot(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.Path, b, 0600)
+}
+
+// writeFileAtomic writes to a temporary file that's renamed over the file once it's synced.
+func writeFileAtomic(name string, b []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(perm); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// Persist saves a snapshot of the deployed applications, their configurations and reserved ports. It runs when
+// they change, events are left to their own log.
+func (api *API) Persist() {
+	if api == nil || api.store == nil {
+		return
+	}
+
+	err := api.store.Update(func() *State {
+		state := &State{
+			Applications: map[string]*StoredApplication{},
+			Configs:      api.apps.Configs(),
+			Reserved:     api.apps.Reserved(),
+		}
+		for _, app := range api.apps.Applications() {
+			snapshot := app.snapshot()
+			// Events have their own log
+			snapshot.Events = nil
+			state.Applications[app.ID] = &StoredApplication{
+				ApplicationRecord: (*ApplicationRecord)(snapshot),
+				Directory:         snapshot.directory,
+				EventURLs:         snapshot.event_urls,
+				WebhookSecret:     snapshot.webhook_secret,
+			}
+		}
+		return state
+	})
+	if err != nil {
+		log.Println("[store] Failed to save state:", err)
+	}
+}
+
+// Restore loads the saved state and registers every application that still has a checkout, without
+// cloning it again. The restored applications are returned so they can be launched.
+func (api *API) Restore() ([]*Application, error) {
+	state, err := api.store.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	for id, config := range state.Configs {
+		api.apps.SetConfig(id, config)
+	}
+	for _, port := range state.Reserved {
+		api.apps.Reserve(port)
+	}
+
+	restored := []*Application{}
+	for id, stored := range state.Applications {
+		if stored.ApplicationRecord == nil {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(stored.Directory, ".git")); err != nil {
+			log.Println("[startup]", id, "no longer has a checkout at", stored.Directory, "skipping...")
+			continue
+		}
+		app := (*Application)(stored.ApplicationRecord)
+		app.directory = stored.Directory
+		app.event_urls = stored.EventURLs
+		app.webhook_secret = stored.WebhookSecret
+		if err := app.loadEvents(app.Events); err != nil {
+			log.Println("[startup]", id, "failed to read the events:", err)
+		}
+		// Nothing is running yet, Launch takes it from here
+		app.State = StateStopped
+		for _, deployment := range app.Deployments {
+			if deployment.Outcome == OutcomePending {
+				deployment.Outcome = OutcomeFailed
+				deployment.Error = "interrupted by a manager restart"
+			}
+		}
+		if err := api.apps.Add(app); err != nil {
+			log.Println("[startup]", err)
+			continue
+		}
+		restored = append(restored, app)
+	}
+	return restored, nil
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamEvents = "events"
+)
+
+// How many entries a hub keeps for clients that resume or ask for a tail.
+const streamBacklog = 1000
+
+// How many entries can wait for a slow client before it's disconnected, it can resume from where it was.
+const subscriberBuffer = 256
+
+// StreamEntry is a line of output or an event as it's streamed. IDs only increase, also across restarts of
+// the manager, and are what clients resume from.
+type StreamEntry struct {
+	ID        int64     `json:"id"`
+	Stream    string    `json:"stream"`
+	Timestamp time.Time `json:"timestamp"`
+	Text      string    `json:"text"`
+}
+
+// streamHub fans the application's output and events out to the clients following them.
+type streamHub struct {
+	lock        sync.Mutex
+	last        int64
+	backlog     []StreamEntry
+	subscribers map[chan StreamEntry]struct{}
+}
+
+func (hub *streamHub) publish(stream string, timestamp time.Time, text string) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	hub.last++
+	if now := time.Now().UnixNano(); now > hub.last {
+		hub.last = now
+	}
+	entry := StreamEntry{ID: hub.last, Stream: stream, Timestamp: timestamp, Text: text}
+	hub.backlog = append(hub.backlog, entry)
+	if len(hub.backlog) > streamBacklog {
+		hub.backlog = append([]StreamEntry{}, hub.backlog[len(hub.backlog)-streamBacklog:]...)
+	}
+	for subscriber := range hub.subscribers {
+		select {
+		case subscriber <- entry:
+		default:
+			delete(hub.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+}
+
+// subscribe returns the kept entries of the streams after the given ID, or their last tail entries when after
+// is 0, and a channel with the entries that follow. The channel is closed when the client falls behind or cancels.
+func (hub *streamHub) subscribe(streams map[string]bool, after int64, tail int) ([]StreamEntry, chan StreamEntry, func()) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	backlog := []StreamEntry{}
+	for _, entry := range hub.backlog {
+		if streams[entry.Stream] && (after > 0 && entry.ID > after || after == 0 && tail > 0) {
+			backlog = append(backlog, entry)
+		}
+	}
+	if after == 0 && tail > 0 && len(backlog) > tail {
+		backlog = backlog[len(backlog)-tail:]
+	}
+
+	subscriber := make(chan StreamEntry, subscriberBuffer)
+	if hub.subscribers == nil {
+		hub.subscribers = map[chan StreamEntry]struct{}{}
+	}
+	hub.subscribers[subscriber] = struct{}{}
+	cancel := func() {
+		hub.lock.Lock()
+		defer hub.lock.Unlock()
+		if _, exists := hub.subscribers[subscriber]; exists {
+			delete(hub.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+	return backlog, subscriber, cancel
+}
+
+func (app *Application) hub() *streamHub {
+	app.lock.Lock()
+	defer app.lock.Unlock()
+	if app.streams == nil {
+		app.streams = &streamHub{}
+	}
+	return app.streams
+}
+
+// publishEvent streams and forwards an event, errors are prefixed so clients can tell them apart.
+func (app *Application) publishEvent(event *AppEvent) {
+	text, level := event.Message, "info"
+	if event.Severity == SeverityWarning {
+		level = "warn"
+	}
+	if event.Error != "" {
+		text, level = "error: "+event.Error, "error"
+	}
+	app.hub().publish(StreamEvents, event.Timestamp, text)
+	app.lock.Lock()
+	repository := app.Repository
+	app.lock.Unlock()
+	api.forward(ForwardEntry{App: app.ID, Repository: repository, Stream: StreamEvents, Timestamp: event.Timestamp,
+		Level: level, Text: text})
+}
+
+// MANAGER_GET_STREAM follows the application's stdout, stderr and events, over Server-Sent Events or a
+// WebSocket when the request asks for an upgrade. ?streams= picks some of them, ?tail= starts with the last
+// entries and ?follow=false stops after them. Clients resume with the Last-Event-ID header or ?last_event_id=.
+func (api *API) MANAGER_GET_STREAM(ctx *gin.Context) {
+	service, exists := api.apps.Application(ctx.Param("serviceId"))
+	if !exists {
+		IsError(404, fmt.Errorf("service not found"), ctx)
+		return
+	}
+
+	streams := map[string]bool{}
+	for _, stream := range strings.Split(ctx.DefaultQuery("streams", "stdout,stderr,events"), ",") {
+		stream = strings.TrimSpace(stream)
+		if stream != StreamStdout && stream != StreamStderr && stream != StreamEvents {
+			IsError(400, fmt.Errorf("unknown stream '%v'", stream), ctx)
+			return
+		}
+		streams[stream] = true
+	}
+	lastID := ctx.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = ctx.Query("last_event_id")
+	}
+	after, tail := int64(0), 0
+	var err error
+	if lastID != "" {
+		if after, err = strconv.ParseInt(lastID, 10, 64); IsError(400, err, ctx) {
+			return
+		}
+	}
+	if value := ctx.Query("tail"); value != "" {
+		if tail, err = strconv.Atoi(value); err != nil || tail < 0 {
+			IsError(400, fmt.Errorf("invalid tail '%v'", value), ctx)
+			return
+		}
+	}
+	follow := ctx.DefaultQuery("follow", "true") != "false"
+
+	// Make sure output is hooked up to the hub even if nothing was launched since the manager started
+	service.output()
+	backlog, entries, cancel := service.hub().subscribe(streams, after, tail)
+	defer cancel()
+
+	if strings.EqualFold(ctx.GetHeader("Upgrade"), "websocket") {
+		server := websocket.Server{
+			Handshake: api.checkOrigin,
+			Handler: func(conn *websocket.Conn) {
+				closed := make(chan struct{})
+				go func() {
+					_, _ = io.Copy(ioutil.Discard, conn)
+					close(closed)
+				}()
+				streamEntries(backlog, entries, streams, follow, closed, func(entry StreamEntry) error {
+					return websocket.JSON.Send(conn, entry)
+				}, nil)
+			},
+		}
+		server.ServeHTTP(ctx.Writer, ctx.Request)
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(200)
+	ctx.Writer.Flush()
+	streamEntries(backlog, entries, streams, follow, ctx.Request.Context().Done(), func(entry StreamEntry) error {
+		data, _ := json.Marshal(entry)
+		_, err := fmt.Fprintf(ctx.Writer, "id: %v\nevent: %v\ndata: %s\n\n", entry.ID, entry.Stream, data)
+		ctx.Writer.Flush()
+		return err
+	}, func() error {
+		_, err := io.WriteString(ctx.Writer, ": keepalive\n\n")
+		ctx.Writer.Flush()
+		return err
+	})
+}
+
+// checkOrigin refuses WebSockets opened by other sites, a browser visiting them could otherwise follow an
+// application's output through the manager. Clients that aren't browsers don't send an Origin and are accepted,
+// browsers have to come from the manager itself or from the [stream] allowed_origins of config.ini.
+func (api *API) checkOrigin(config *websocket.Config, request *http.Request) error {
+	origin := request.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if parsed, err := url.Parse(origin); err == nil && strings.EqualFold(parsed.Host, request.Host) {
+		return nil
+	}
+	for _, allowed := range splitList(api.Config.Section("stream").Key("allowed_origins").String()) {
+		if strings.EqualFold(strings.TrimSuffix(allowed, "/"), origin) {
+			return nil
+		}
+	}
+	return fmt.Errorf("origin '%v' isn't allowed to stream", origin)
+}
+
+// streamEntries sends the backlog and then the entries as they come, until the client goes away, falls
+// behind, or there's nothing to follow.
+func streamEntries(backlog []StreamEntry, entries <-chan StreamEntry, streams map[string]bool, follow bool,
+	closed <-chan struct{}, send func(StreamEntry) error, keepalive func() error) {
+	for _, entry := range backlog {
+		if send(entry) != nil {
+			return
+		}
+	}
+	if !follow {
+		return
+	}
+
+	ticker := time.NewTicker(15 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closed:
+			return
+		case entry, open := <-entries:
+			if !open {
+				return
+			}
+			if streams[entry.Stream] && send(entry) != nil {
+				return
+			}
+		case <-ticker.C:
+			if keepalive != nil && keepalive() != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+func TestStreamWebSocketOrigin(t *testing.T) {
+	testAPI(t, "[stream]\nallowed_origins=https://dashboard.example.com/, http://localhost:3000\n")
+	app := &Application{ID: "app"}
+	if err := api.apps.Add(app); err != nil {
+		t.Fatal(err)
+	}
+	app.hub().publish(StreamStdout, time.Now(), "hello")
+	server := httptest.NewServer(api.BuildAPI())
+	defer server.Close()
+	location := "ws" + strings.TrimPrefix(server.URL, "http") + "/manager/app/app/stream?follow=false&tail=1"
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{server.URL, true},
+		{"https://dashboard.example.com", true},
+		{"http://localhost:3000", true},
+		{"https://evil.example.com", false},
+		{"https://dashboard.example.com.evil.example.com", false},
+	}
+	for _, test := range tests {
+		conn, err := websocket.Dial(location, "", test.origin)
+		if !test.allowed {
+			if err == nil {
+				conn.Close()
+				t.Errorf("a WebSocket from %q was accepted", test.origin)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("a WebSocket from %q was refused: %v", test.origin, err)
+			continue
+		}
+		entry := StreamEntry{}
+		if err := websocket.JSON.Receive(conn, &entry); err != nil || entry.Text != "hello" {
+			t.Errorf("from %q received %+v: %v", test.origin, entry, err)
+		}
+		conn.Close()
+	}
+
+	// Clients that aren't browsers don't send an Origin
+	if err := api.checkOrigin(nil, httptest.NewRequest("GET", location, nil)); err != nil {
+		t.Errorf("a WebSocket without an Origin was refused: %v", err)
+	}
+}
+
+func TestStreamTail(t *testing.T) {
+	testAPI(t, "")
+	app := &Application{ID: "app"}
+	if err := api.apps.Add(app); err != nil {
+		t.Fatal(err)
+	}
+	for _, text := range []string{"one", "two", "three"} {
+		app.hub().publish(StreamStdout, time.Now(), text)
+	}
+
+	tests := []struct {
+		tail  string
+		code  int
+		lines int
+	}{
+		{"2", 200, 2},
+		{"0", 200, 0},
+		{"-1", 400, 0},
+		{"many", 400, 0},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		api.BuildAPI().ServeHTTP(w, httptest.NewRequest("GET", "/manager/app/app/stream?follow=false&tail="+test.tail, nil))
+		if w.Code != test.code {
+			t.Errorf("tail=%v answered %v, want %v", test.tail, w.Code, test.code)
+			continue
+		}
+		if lines := strings.Count(w.Body.String(), "data: "); test.code == 200 && lines != test.lines {
+			t.Errorf("tail=%v streamed %v entries, want %v", test.tail, lines, test.lines)
+		}
+	}
+
+	// The hub doesn't rely on the handler's checks
+	backlog, _, cancel := app.hub().subscribe(map[string]bool{StreamStdout: true}, 0, -1)
+	defer cancel()
+	if len(backlog) != 0 {
+		t.Errorf("a negative tail returned %v entries", len(backlog))
+	}
+}
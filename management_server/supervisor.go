@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// A run that lasts this long is considered healthy, and resets the restart backoff.
+const stableRun = time.Minute
+
+const maxRestartDelay = time.Minute
+
+type ExitStatus struct {
+	Code      int       `json:"code"`
+	Signal    string    `json:"signal,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	ExitedAt  time.Time `json:"exited_at"`
+}
+
+func (e *ExitStatus) Success() bool {
+	return e.Code == 0 && e.Signal == "" && e.Error == ""
+}
+
+func (e *ExitStatus) String() string {
+	if e.Signal != "" {
+		return fmt.Sprintf("killed by signal %v", e.Signal)
+	}
+	if e.Error != "" && e.Code <= 0 {
+		return e.Error
+	}
+	return fmt.Sprintf("exit code %v", e.Code)
+}
+
+func exitStatus(state *os.ProcessState, err error, started time.Time) *ExitStatus {
+	status := &ExitStatus{Code: -1, StartedAt: started, ExitedAt: time.Now()}
+	if state != nil {
+		status.Code = state.ExitCode()
+		if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			status.Signal = ws.Signal().String()
+		}
+	}
+	if err != nil {
+		if _, isExit := err.(*exec.ExitError); !isExit {
+			status.Error = err.Error()
+		}
+	}
+	return status
+}
+
+// restartPolicy returns the Bandaidfile's restart policy settings with their defaults filled in.
+func restartPolicy(config *BandaidFile) (policy string, maxRestarts int, delay time.Duration) {
+	policy = config.Application.Restart
+	if policy == "" {
+		policy = RestartNever
+	}
+	maxRestarts = config.Application.MaxRestarts
+	if maxRestarts <= 0 {
+		maxRestarts = 5
+	}
+	delay = time.Second
+	if parsed, err := time.ParseDuration(config.Application.RestartDelay); err == nil && parsed > 0 {
+		delay = parsed
+	}
+	return
+}
+
+// supervise runs the service command, restarting it according to the Bandaidfile's restart policy until
+// the application is killed, the policy says not to, or it crash-loops.
+func (app *Application) supervise(inst *instance, config *BandaidFile, command func() *exec.Cmd) {
+	policy, maxRestarts, baseDelay := restartPolicy(config)
+	delay := baseDelay
+	failures := 0
+
+	for {
+		cmd := command()
+		started := time.Now()
+		err := app.start(inst, cmd)
+		if err == nil {
+			app.setInstanceState(inst, StateRunning)
+			api.resolveAlert(app, AlertCrashLoop)
+			err = cmd.Wait()
+			app.exited(inst, cmd)
+		}
+
+		status := exitStatus(cmd.ProcessState, err, started)
+		app.lock.Lock()
+		current := app.current == inst
+		if current {
+			app.LastExit = status
+		}
+		app.lock.Unlock()
+		if current {
+			api.Persist()
+		}
+
+		if app.stopped(inst) {
+			app.Log_Kindf(EventProcessStopped, "Process stopped (%v)", status)
+			return
+		}
+		exited := &AppEvent{Kind: EventProcessExited, Fields: map[string]string{
+			"code":   strconv.Itoa(status.Code),
+			"signal": status.Signal,
+			"uptime": status.ExitedAt.Sub(status.StartedAt).Truncate(time.Second).String(),
+		}}
+		if status.Success() {
+			exited.Message = fmt.Sprintf("Process exited (%v)", status)
+		} else {
+			log.Println("Error", app.ID, status)
+			exited.Error = fmt.Sprintf("process exited (%v)", status)
+		}
+		app.add_event(exited)
+
+		if policy == RestartNever || (policy == RestartOnFailure && status.Success()) {
+			if status.Success() {
+				app.setInstanceState(inst, StateExited)
+			} else {
+				app.setInstanceState(inst, StateFailed)
+			}
+			return
+		}
+
+		if status.ExitedAt.Sub(started) >= stableRun {
+			failures = 0
+			delay = baseDelay
+		}
+		failures++
+		if failures > maxRestarts {
+			app.setInstanceState(inst, StateFailed)
+			app.Log_KindErrorf(EventProcessCrashLoop, "crash loop detected: %v restarts without a stable run, giving up", maxRestarts)
+			api.raiseAlert(app, AlertCrashLoop, fmt.Sprintf("%v restarts without a stable run, last exit: %v", maxRestarts, status))
+			return
+		}
+
+		app.lock.Lock()
+		current = app.current == inst
+		if current {
+			app.Restarts++
+			app.setStateLocked(StateRestarting)
+		}
+		app.lock.Unlock()
+		if current {
+			api.Persist()
+		}
+		app.add_event(&AppEvent{
+			Kind:    EventProcessRestarting,
+			Fields:  map[string]string{"delay": delay.String(), "attempt": strconv.Itoa(failures), "max_restarts": strconv.Itoa(maxRestarts)},
+			Message: fmt.Sprintf("Restarting in %v (%v/%v)", delay, failures, maxRestarts),
+		})
+
+		select {
+		case <-inst.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}